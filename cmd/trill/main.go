@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 
 	"trill/internal/codex"
@@ -20,17 +24,221 @@ var uiFS embed.FS
 
 func main() {
 	cfg := config.Load()
+	if cfg.Debug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
 
-	store := store.NewMemoryStore()
-	model := codex.NewCLIClient()
+	var convStore store.ConversationStore
+	switch cfg.Store {
+	case "memory":
+		convStore = store.NewMemoryStore()
+	case "sqlite":
+		sqliteStore, err := store.NewSQLiteStore(cfg.StorePath)
+		if err != nil {
+			log.Fatalf("failed to open sqlite store: %v", err)
+		}
+		defer sqliteStore.Close()
+		convStore = sqliteStore
+	case "bolt":
+		boltStore, err := store.NewBoltStore(cfg.StorePath)
+		if err != nil {
+			log.Fatalf("failed to open bolt store: %v", err)
+		}
+		defer boltStore.Close()
+		convStore = boltStore
+	case "postgres":
+		pgStore, err := store.NewPostgresStore(cfg.StoreDSN)
+		if err != nil {
+			log.Fatalf("failed to open postgres store: %v", err)
+		}
+		defer pgStore.Close()
+		pgStore.ConfigurePool(cfg.StoreMaxConns, cfg.StoreConnMaxAge)
+		convStore = pgStore
+	default:
+		log.Fatalf("invalid store %q: want memory, sqlite, bolt, or postgres", cfg.Store)
+	}
+	var allowedHosts []string
+	for _, host := range strings.Split(cfg.AllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	httpClient, err := codex.NewHTTPClient(cfg.ModelProxy)
+	if err != nil {
+		log.Fatalf("invalid model proxy: %v", err)
+	}
+	// Execution and verification share one bound on codex processes.
+	codexSlots := codex.NewProcessSlots(cfg.CodexConcurrency)
+	var model codex.Client
+	switch cfg.ModelBackend {
+	case "codex":
+		cli := codex.NewCLIClient()
+		cli.MaxConcurrent = cfg.CodexConcurrency
+		cli.Slots = codexSlots
+		cli.WorkDir = cfg.WorkDir
+		cli.MaxAttempts = cfg.CodexAttempts
+		cli.RetryDelay = cfg.CodexRetryDelay
+		model = cli
+	case "openai":
+		client := codex.NewOpenAIClient(cfg.OpenAIModel)
+		client.AllowedHosts = allowedHosts
+		client.HTTPClient = httpClient
+		model = client
+	case "anthropic":
+		client := codex.NewAnthropicClient(cfg.AnthropicModel)
+		client.AllowedHosts = allowedHosts
+		client.HTTPClient = httpClient
+		model = client
+	default:
+		log.Fatalf("invalid model backend %q: want codex, openai, or anthropic", cfg.ModelBackend)
+	}
 	broker := obs.NewBroker()
+	broker.BufferSize = cfg.ObsBufferSize
+	broker.HistorySize = cfg.ObsHistorySize
+	broker.HeartbeatInterval = cfg.ObsHeartbeat
+	broker.ReplaySize = cfg.ObsReplaySize
+	broker.DedupWindow = cfg.ObsDedupWindow
 	prompts, err := service.LoadPrompts("prompts")
 	if err != nil {
 		log.Fatalf("failed to load prompts: %v", err)
 	}
-	svc := service.New(store, model, broker)
-	svc.Prompts = prompts
+	runner, err := service.ParseShellRunner(cfg.CommandShell)
+	if err != nil {
+		log.Fatalf("invalid command shell: %v", err)
+	}
+	runner.Dir = cfg.WorkDir
+	opts := []service.Option{
+		service.WithPrompts(prompts),
+		service.WithRunner(runner),
+		service.WithMaxSteps(cfg.MaxPlanSteps),
+		service.WithEmitTruncation(cfg.EmitTruncation),
+		service.WithMaxExecuting(cfg.MaxExecuting),
+		service.WithWorkQueue(cfg.WorkQueueSize, cfg.EnqueueWait),
+		service.WithPlanConcurrency(cfg.PlanConcurrency),
+		service.WithDedupSteps(cfg.DedupSteps),
+		service.WithContextMessages(cfg.ContextMessages),
+		service.WithMaxHumanWait(cfg.MaxHumanWait),
+		service.WithPlanExpiry(cfg.PlanExpiry),
+		service.WithStepCriteria(cfg.StepCriteria),
+		service.WithRawDisplay(!cfg.SanitizeDisplay),
+		service.WithMaxPlanText(cfg.MaxPlanText),
+		service.WithMaxArtifactBytes(cfg.MaxArtifactBytes),
+		service.WithRequireCompletionReview(cfg.RequireReview),
+		service.WithStepArtifacts(cfg.StepArtifacts),
+		service.WithExactCriteria(cfg.ExactCriteria),
+		service.WithVerifyRemainingOnly(cfg.VerifyRemaining),
+		service.WithSaveRetries(cfg.SaveRetries, cfg.SaveBackoff),
+		service.WithStrictDirectives(cfg.StrictDirectives),
+		service.WithInboxDebounce(cfg.InboxDebounce),
+		service.WithJSONPlans(cfg.JSONPlans),
+		service.WithPlanCacheTTL(cfg.PlanCacheTTL),
+		service.WithMaxModelCalls(cfg.MaxModelCalls),
+		service.WithMaxDiscoveryDepth(cfg.DiscoveryDepth),
+		service.WithMaxVerifyReplans(cfg.MaxVerifyReplans),
+		service.WithMaxAttempts(cfg.MaxAttempts),
+	}
+	if cfg.CommandDenylist != "" {
+		policy, err := service.NewCommandPolicy(strings.Split(cfg.CommandDenylist, ","))
+		if err != nil {
+			log.Fatalf("invalid command denylist: %v", err)
+		}
+		opts = append(opts, service.WithCommandPolicy(policy))
+	}
+	if cfg.GitContext {
+		var commands []string
+		for _, command := range strings.Split(cfg.GitContextCmds, ",") {
+			command = strings.TrimSpace(command)
+			if command == "" {
+				continue
+			}
+			if !strings.HasPrefix(command, "git ") {
+				log.Fatalf("invalid git context command %q: want a git command", command)
+			}
+			commands = append(commands, command)
+		}
+		opts = append(opts, service.WithGitContext(commands))
+	}
+	if cfg.VerifyModel != "" {
+		switch cfg.ModelBackend {
+		case "openai":
+			verifier := codex.NewOpenAIClient(cfg.VerifyModel)
+			verifier.AllowedHosts = allowedHosts
+			verifier.HTTPClient = httpClient
+			opts = append(opts, service.WithVerifyModel(verifier))
+		case "anthropic":
+			verifier := codex.NewAnthropicClient(cfg.VerifyModel)
+			verifier.AllowedHosts = allowedHosts
+			verifier.HTTPClient = httpClient
+			opts = append(opts, service.WithVerifyModel(verifier))
+		default:
+			verifier := codex.NewCLIClient()
+			verifier.Model = cfg.VerifyModel
+			verifier.MaxConcurrent = cfg.CodexConcurrency
+			verifier.Slots = codexSlots
+			verifier.WorkDir = cfg.WorkDir
+			verifier.MaxAttempts = cfg.CodexAttempts
+			verifier.RetryDelay = cfg.CodexRetryDelay
+			opts = append(opts, service.WithVerifyModel(verifier))
+		}
+	}
+	switch cfg.BlockEscalation {
+	case "replan", "human":
+		opts = append(opts, service.WithBlockEscalation(cfg.BlockEscalation))
+	default:
+		log.Fatalf("invalid block escalation %q: want replan or human", cfg.BlockEscalation)
+	}
+	switch cfg.CommandArtifacts {
+	case "always", "only-on-failure", "never":
+		opts = append(opts, service.WithCommandArtifacts(cfg.CommandArtifacts))
+	default:
+		log.Fatalf("invalid command artifacts %q: want always, only-on-failure, or never", cfg.CommandArtifacts)
+	}
+	switch cfg.ConcurrentSends {
+	case "queue", "reject":
+		opts = append(opts, service.WithConcurrentSends(cfg.ConcurrentSends))
+	default:
+		log.Fatalf("invalid concurrent sends %q: want queue or reject", cfg.ConcurrentSends)
+	}
+	switch cfg.PromptStorage {
+	case "full", "hash":
+		opts = append(opts, service.WithPromptStorage(cfg.PromptStorage))
+	default:
+		log.Fatalf("invalid prompt storage %q: want full or hash", cfg.PromptStorage)
+	}
+	switch cfg.CallLog {
+	case "":
+	case "stdout":
+		opts = append(opts, service.WithCallLog(os.Stdout))
+	default:
+		f, err := os.OpenFile(cfg.CallLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("failed to open call log: %v", err)
+		}
+		opts = append(opts, service.WithCallLog(f))
+	}
+	svc := service.New(convStore, model, broker, opts...)
+	if errs := svc.ValidatePrompts(); len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("prompt template %s: %s", e.Template, e.Error)
+		}
+		log.Fatalf("invalid prompt templates in prompts/")
+	}
 	srv := server.New(svc)
+	srv.Pretty = cfg.PrettyJSON
+	srv.AdminToken = cfg.AdminToken
+	srv.Config = &cfg
+
+	svc.StartWorker(context.Background())
+	if cfg.RequeueStranded {
+		if n, err := svc.RequeueStranded(context.Background()); err != nil {
+			log.Printf("failed to requeue stranded conversations: %v", err)
+		} else if n > 0 {
+			log.Printf("Requeued %d conversations left queued or executing", n)
+		}
+	}
+	if cfg.MaxHumanWait > 0 || cfg.PlanExpiry > 0 {
+		go svc.RunSweeper(context.Background(), cfg.SweepInterval)
+	}
 
 	mux := http.NewServeMux()
 	srv.RegisterMux(mux)
@@ -52,6 +260,9 @@ func main() {
 
 	obsMux := http.NewServeMux()
 	obsMux.Handle("/events", http.HandlerFunc(broker.SSEHandler))
+	obsMux.Handle("/obs/event-counts", http.HandlerFunc(broker.EventCountsHandler))
+	obsMux.Handle("/obs/stats", http.HandlerFunc(broker.StatsHandler))
+	obsMux.Handle("/obs/events", http.HandlerFunc(broker.EventsHandler))
 	obsSub, err := fs.Sub(uiFS, "obsui")
 	if err != nil {
 		log.Fatalf("embed obs fs error: %v", err)
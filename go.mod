@@ -2,4 +2,13 @@ module trill
 
 go 1.22
 
-require github.com/google/uuid v1.6.0 // indirect
+require (
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	go.etcd.io/bbolt v1.3.10
+)
+
+require (
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+)
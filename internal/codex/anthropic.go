@@ -0,0 +1,107 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAnthropicBaseURL   = "https://api.anthropic.com"
+	defaultAnthropicMaxTokens = 4096
+	anthropicVersion          = "2023-06-01"
+)
+
+// AnthropicClient sends prompts to the Anthropic messages API. Like
+// OpenAIClient it keeps each session's history in memory and replays it on
+// every call; sessions do not survive a restart.
+type AnthropicClient struct {
+	// BaseURL is the API root; defaults to https://api.anthropic.com.
+	BaseURL string
+	// APIKey is sent as the x-api-key header.
+	APIKey string
+	// Model is the model to call, e.g. "claude-3-5-sonnet-latest".
+	Model string
+	// MaxTokens caps each reply; defaults to 4096.
+	MaxTokens int
+	// Timeout bounds each call. A sooner deadline on the caller's context wins.
+	Timeout time.Duration
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// AllowedHosts, when set, limits the hosts BaseURL and any redirects may
+	// point at; requests elsewhere fail before they are sent.
+	AllowedHosts []string
+
+	history sessionHistory
+}
+
+// NewAnthropicClient returns a client for model, reading the API key from
+// ANTHROPIC_API_KEY and an optional base URL from ANTHROPIC_BASE_URL.
+func NewAnthropicClient(model string) *AnthropicClient {
+	return &AnthropicClient{
+		BaseURL: os.Getenv("ANTHROPIC_BASE_URL"),
+		APIKey:  os.Getenv("ANTHROPIC_API_KEY"),
+		Model:   model,
+		Timeout: 60 * time.Second,
+	}
+}
+
+func (c *AnthropicClient) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	maxTokens := c.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultAnthropicMaxTokens
+	}
+	header := http.Header{}
+	header.Set("anthropic-version", anthropicVersion)
+	if c.APIKey != "" {
+		header.Set("x-api-key", c.APIKey)
+	}
+	return chatCall{
+		name:    "anthropic",
+		url:     strings.TrimSuffix(baseURL, "/") + "/v1/messages",
+		header:  header,
+		timeout: c.Timeout,
+		client:  c.HTTPClient,
+		allowed: c.AllowedHosts,
+		history: &c.history,
+		body: func(messages []chatMessage) any {
+			return struct {
+				Model     string        `json:"model"`
+				MaxTokens int           `json:"max_tokens"`
+				Messages  []chatMessage `json:"messages"`
+			}{c.Model, maxTokens, messages}
+		},
+		parse: parseAnthropicMessage,
+	}.send(ctx, sessionID, prompt)
+}
+
+// parseAnthropicMessage joins the text blocks of a messages API response.
+func parseAnthropicMessage(out []byte) (string, error) {
+	var resp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, block := range resp.Content {
+		if block.Type == "text" && block.Text != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("no assistant reply found in anthropic output")
+	}
+	return strings.Join(parts, "\n"), nil
+}
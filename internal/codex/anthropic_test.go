@@ -0,0 +1,87 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnthropicClientThreadsSessionHistory(t *testing.T) {
+	var seen [][]chatMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "ak-test" || r.Header.Get("anthropic-version") == "" {
+			t.Errorf("missing auth headers: %v", r.Header)
+		}
+		var req struct {
+			Model     string        `json:"model"`
+			MaxTokens int           `json:"max_tokens"`
+			Messages  []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		if req.Model != "claude-test" || req.MaxTokens != defaultAnthropicMaxTokens {
+			t.Errorf("model=%q max_tokens=%d", req.Model, req.MaxTokens)
+		}
+		seen = append(seen, req.Messages)
+		last := req.Messages[len(req.Messages)-1].Content
+		json.NewEncoder(w).Encode(map[string]any{
+			"content": []map[string]string{{"type": "text", "text": "re: " + last}},
+			"usage":   map[string]int{"input_tokens": 12, "output_tokens": 3},
+		})
+	}))
+	defer srv.Close()
+
+	client := &AnthropicClient{BaseURL: srv.URL, APIKey: "ak-test", Model: "claude-test"}
+	ctx := context.Background()
+	reply, raw, session, _, err := client.Send(ctx, "", "plan it")
+	if err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if reply != "re: plan it" || session == "" {
+		t.Fatalf("unexpected first call: reply=%q session=%q", reply, session)
+	}
+	if usage := ParseUsage(raw); usage.TotalTokens != 15 {
+		t.Fatalf("usage from raw output = %+v, want 15 total tokens", usage)
+	}
+	reply, _, again, _, err := client.Send(ctx, session, "do step 1")
+	if err != nil {
+		t.Fatalf("second send: %v", err)
+	}
+	if reply != "re: do step 1" || again != session {
+		t.Fatalf("unexpected second call: reply=%q session=%q", reply, again)
+	}
+	if len(seen[1]) != 3 || seen[1][1].Role != "assistant" || seen[1][1].Content != "re: plan it" {
+		t.Fatalf("second request should replay the session history, got %+v", seen[1])
+	}
+}
+
+func TestAnthropicUsageIsReadFromPrettyPrintedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+  "content": [
+    {"type": "text", "text": "done"}
+  ],
+  "usage": {
+    "input_tokens": 30,
+    "output_tokens": 7
+  }
+}`))
+	}))
+	defer srv.Close()
+
+	client := &AnthropicClient{BaseURL: srv.URL, Model: "claude-test"}
+	_, raw, _, _, err := client.Send(context.Background(), "", "hello")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	want := Usage{PromptTokens: 30, CompletionTokens: 7, TotalTokens: 37}
+	if got := ParseUsage(raw); got != want {
+		t.Fatalf("usage = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package codex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// chatCall is one round trip to a stateless chat API. The OpenAI and
+// Anthropic clients differ only in the request body, headers and reply
+// format; everything else goes through send.
+type chatCall struct {
+	// name prefixes synthetic session ids and error messages, e.g. "openai".
+	name    string
+	url     string
+	header  http.Header
+	timeout time.Duration
+	client  *http.Client
+	allowed []string
+	history *sessionHistory
+	// body builds the request payload from the full message history.
+	body func(messages []chatMessage) any
+	// parse extracts the assistant reply from a 200 response body.
+	parse func(out []byte) (string, error)
+}
+
+// send posts prompt, appended to sessionID's history, and records the reply
+// in the history on success. An empty sessionID starts a new session.
+func (c chatCall) send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if sessionID == "" {
+		sessionID = newSessionID(c.name)
+	}
+	messages := append(c.history.get(sessionID), chatMessage{Role: "user", Content: prompt})
+
+	body, err := json.Marshal(c.body(messages))
+	if err != nil {
+		return "", "", sessionID, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", "", sessionID, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if err := checkHost(req.URL, c.allowed); err != nil {
+		return "", "", sessionID, 0, fmt.Errorf("%s error: %w", c.name, err)
+	}
+	httpClient := restrictedClient(c.client, c.allowed)
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		duration := time.Since(start).Milliseconds()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", "", sessionID, duration, fmt.Errorf("%s canceled after %dms: %w", c.name, duration, ctxErr)
+		}
+		return "", "", sessionID, duration, fmt.Errorf("%s error: %w", c.name, err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	duration := time.Since(start).Milliseconds()
+	raw := string(out)
+	if err != nil {
+		return "", raw, sessionID, duration, fmt.Errorf("%s error: %w", c.name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", raw, sessionID, duration, fmt.Errorf("%s error: %s, output: %s", c.name, resp.Status, raw)
+	}
+	reply, err := c.parse(out)
+	if err != nil {
+		return "", raw, sessionID, duration, fmt.Errorf("failed to parse %s output: %w, output: %s", c.name, err, raw)
+	}
+
+	c.history.set(sessionID, append(messages, chatMessage{Role: "assistant", Content: reply}))
+	return reply, raw, sessionID, duration, nil
+}
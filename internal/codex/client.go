@@ -5,8 +5,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os/exec"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -15,50 +19,301 @@ type Client interface {
 	Send(ctx context.Context, sessionID, prompt string) (reply string, raw string, newSessionID string, durationMS int64, err error)
 }
 
+// StreamingClient is a Client that can also hand over output while a call
+// is still running. onChunk receives each piece of text as it arrives, on the
+// calling goroutine's behalf but possibly from another goroutine.
+type StreamingClient interface {
+	Client
+	SendStream(ctx context.Context, sessionID, prompt string, onChunk func(chunk string)) (reply string, raw string, newSessionID string, durationMS int64, err error)
+}
+
 type CLIClient struct {
+	// Binary is the codex executable to run; defaults to "codex" on PATH.
+	Binary string
+	// Timeout bounds each call. A sooner deadline on the caller's context wins.
 	Timeout time.Duration
+	// Model, when set, is passed as --model; otherwise codex uses its default.
+	Model string
+	// WorkDir is where codex runs, so its file references and suggested
+	// commands resolve there; empty means the server's directory. A context
+	// from WithWorkDir overrides it per call.
+	WorkDir string
+	// MaxConcurrent bounds how many codex processes run at once; further
+	// calls wait for a slot. Zero means unlimited. Set it before the first Send.
+	MaxConcurrent int
+	// Slots, when set, replaces MaxConcurrent with a bound shared by every
+	// client given the same ProcessSlots, e.g. execution and verification.
+	Slots ProcessSlots
+	// MaxAttempts is how many times Send runs codex before giving up on a
+	// transient failure: a non-zero exit or unreadable output. Zero or one
+	// means no retries. Deterministic failures are never retried.
+	MaxAttempts int
+	// RetryDelay is the wait before the first retry; it doubles each time.
+	RetryDelay time.Duration
+	// RetryJitter adds up to this fraction of the delay at random, e.g. 0.2,
+	// so conversations that failed together don't retry in lockstep.
+	RetryJitter float64
+
+	slotsOnce sync.Once
+	slots     chan struct{}
 }
 
 func NewCLIClient() *CLIClient {
-	return &CLIClient{Timeout: 60 * time.Second}
+	return &CLIClient{
+		Binary:        "codex",
+		Timeout:       60 * time.Second,
+		MaxConcurrent: runtime.NumCPU(),
+		MaxAttempts:   3,
+		RetryDelay:    2 * time.Second,
+		RetryJitter:   0.2,
+	}
+}
+
+// errNoReply means codex ran cleanly but said nothing; rerunning the same
+// prompt is not expected to help.
+var errNoReply = errors.New("no agent reply found in codex output")
+
+// ProcessSlots bounds how many codex processes the CLIClients sharing it run
+// at once, machine-wide rather than per client.
+type ProcessSlots chan struct{}
+
+// NewProcessSlots returns a bound of n processes, or nil (unlimited) when n
+// is not positive.
+func NewProcessSlots(n int) ProcessSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(ProcessSlots, n)
+}
+
+// acquire waits for a free process slot, returning a func that frees it.
+func (c *CLIClient) acquire(ctx context.Context) (func(), error) {
+	c.slotsOnce.Do(func() {
+		if c.Slots != nil {
+			c.slots = c.Slots
+		} else if c.MaxConcurrent > 0 {
+			c.slots = make(chan struct{}, c.MaxConcurrent)
+		}
+	})
+	if c.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return func() { <-c.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
+// Send runs codex, retrying transient failures per MaxAttempts with
+// exponential backoff. The reported duration covers every attempt.
 func (c *CLIClient) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	return c.SendStream(ctx, sessionID, prompt, nil)
+}
+
+// SendStream is Send, also passing onChunk the text of each codex event line
+// (messages, reasoning, command output) as codex prints it. A retried call
+// streams every attempt.
+func (c *CLIClient) SendStream(ctx context.Context, sessionID, prompt string, onChunk func(chunk string)) (string, string, string, int64, error) {
+	delay := c.RetryDelay
+	var total int64
+	for attempt := 1; ; attempt++ {
+		reply, raw, threadID, duration, retry, err := c.sendOnce(ctx, sessionID, prompt, onChunk)
+		total += duration
+		if err == nil || !retry || attempt >= c.MaxAttempts {
+			return reply, raw, threadID, total, err
+		}
+		wait := delay
+		if c.RetryJitter > 0 {
+			wait += time.Duration(rand.Float64() * c.RetryJitter * float64(delay))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return reply, raw, threadID, total, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// sendOnce runs codex a single time, reporting whether a failure is worth
+// retrying.
+func (c *CLIClient) sendOnce(ctx context.Context, sessionID, prompt string, onChunk func(string)) (reply, raw, threadID string, durationMS int64, retry bool, err error) {
+	// Waiting for a slot counts against the caller's deadline but not Timeout,
+	// which bounds the codex process itself.
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return "", "", sessionID, 0, false, fmt.Errorf("codex canceled waiting for a free slot: %w", err)
+	}
+	defer release()
+	// context.WithTimeout keeps the parent's deadline when it is earlier, so a
+	// request deadline bounds the call even when Timeout is longer.
 	if c.Timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
 		defer cancel()
 	}
 	args := []string{"exec", "--json", "--skip-git-repo-check"}
+	if c.Model != "" {
+		args = append(args, "--model", c.Model)
+	}
 	if sessionID != "" {
 		args = append(args, "resume", sessionID, prompt)
 	} else {
 		args = append(args, prompt)
 	}
-	cmd := exec.CommandContext(ctx, "codex", args...)
+	binary := c.Binary
+	if binary == "" {
+		binary = "codex"
+	}
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Dir = WorkDir(ctx, c.WorkDir)
+	// Don't wait on grandchildren holding stdout open after codex is killed.
+	cmd.WaitDelay = time.Second
 	start := time.Now()
-	out, err := cmd.CombinedOutput()
+	// One writer for both streams, as CombinedOutput does, so exec copies
+	// them from a single goroutine.
+	output := &lineWriter{onLine: func(line []byte) {
+		if onChunk == nil {
+			return
+		}
+		if chunk := eventText(line); chunk != "" {
+			onChunk(chunk)
+		}
+	}}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+	output.flush()
+	out := output.buf.Bytes()
 	duration := time.Since(start).Milliseconds()
-	raw := string(out)
+	raw = string(out)
 	if err != nil {
-		return "", raw, sessionID, duration, fmt.Errorf("codex error: %w, output: %s", err, raw)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", raw, sessionID, duration, false, fmt.Errorf("codex canceled after %dms: %w", duration, ctxErr)
+		}
+		return "", raw, sessionID, duration, true, fmt.Errorf("codex error: %w, output: %s", err, raw)
 	}
-	threadID, reply, parseErr := parseCodexJSON(out)
+	threadID, reply, _, parseErr := parseCodexJSON(out)
 	if parseErr != nil {
-		return "", raw, sessionID, duration, fmt.Errorf("failed to parse codex output: %w, output: %s", parseErr, raw)
+		return "", raw, sessionID, duration, !errors.Is(parseErr, errNoReply), fmt.Errorf("failed to parse codex output: %w, output: %s", parseErr, raw)
 	}
 	if threadID == "" {
 		threadID = sessionID
 	}
 	if threadID == "" {
-		return "", raw, sessionID, duration, fmt.Errorf("missing session id from codex output")
+		return "", raw, sessionID, duration, false, fmt.Errorf("missing session id from codex output")
+	}
+	return reply, raw, threadID, duration, false, nil
+}
+
+// lineWriter keeps everything written to it and calls onLine for each
+// complete line as it arrives.
+type lineWriter struct {
+	buf     bytes.Buffer
+	pending []byte
+	onLine  func(line []byte)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.onLine(w.pending[:i])
+		w.pending = w.pending[i+1:]
 	}
-	return reply, raw, threadID, duration, nil
 }
 
-func parseCodexJSON(out []byte) (string, string, error) {
+// flush hands over a final line that had no trailing newline.
+func (w *lineWriter) flush() {
+	if len(w.pending) > 0 {
+		w.onLine(w.pending)
+		w.pending = nil
+	}
+}
+
+// eventText is the human-readable text of one codex --json event line, or ""
+// for events without any, such as thread and turn bookkeeping.
+func eventText(line []byte) string {
+	var evt struct {
+		Item struct {
+			Text             string `json:"text"`
+			Command          string `json:"command"`
+			AggregatedOutput string `json:"aggregated_output"`
+		} `json:"item"`
+	}
+	if err := json.Unmarshal(line, &evt); err != nil {
+		return ""
+	}
+	switch {
+	case evt.Item.Text != "":
+		return evt.Item.Text
+	case evt.Item.AggregatedOutput != "":
+		return evt.Item.AggregatedOutput
+	case evt.Item.Command != "":
+		return "$ " + evt.Item.Command
+	}
+	return ""
+}
+
+// Usage is the token count Codex reports for a call. Models that don't
+// report usage leave it zero.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// ParseUsage reads the token usage from a call's raw output: the "usage"
+// object of an HTTP backend's JSON response body, however it is formatted,
+// or else the sum of the usage events in codex --json output.
+func ParseUsage(raw string) Usage {
+	var body struct {
+		Usage *tokenCounts `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(raw), &body); err == nil && body.Usage != nil {
+		var usage Usage
+		usage.add(*body.Usage)
+		return usage
+	}
+	_, _, usage, _ := parseCodexJSON([]byte(raw))
+	return usage
+}
+
+// tokenCounts is the shape of a turn's "usage" object, a standalone
+// "token_count" event, and the usage of the Anthropic (input/output) and
+// OpenAI (prompt/completion) APIs.
+type tokenCounts struct {
+	InputTokens      int `json:"input_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *Usage) add(c tokenCounts) {
+	prompt := c.InputTokens + c.PromptTokens
+	completion := c.OutputTokens + c.CompletionTokens
+	total := c.TotalTokens
+	if total == 0 {
+		total = prompt + completion
+	}
+	u.PromptTokens += prompt
+	u.CompletionTokens += completion
+	u.TotalTokens += total
+}
+
+func parseCodexJSON(out []byte) (string, string, Usage, error) {
 	var sessionID string
 	var reply string
+	var usage Usage
 	scanner := bufio.NewScanner(bytes.NewReader(out))
 	for scanner.Scan() {
 		line := scanner.Bytes()
@@ -69,6 +324,8 @@ func parseCodexJSON(out []byte) (string, string, error) {
 				Type string `json:"type"`
 				Text string `json:"text"`
 			} `json:"item"`
+			Usage *tokenCounts `json:"usage"`
+			tokenCounts
 		}
 		if err := json.Unmarshal(line, &evt); err != nil {
 			continue
@@ -79,12 +336,20 @@ func parseCodexJSON(out []byte) (string, string, error) {
 		if evt.Type == "item.completed" && evt.Item.Type == "agent_message" && evt.Item.Text != "" {
 			reply = evt.Item.Text
 		}
+		// Each completed turn reports its own usage; a resumed session can
+		// run several turns in one call. Older codex builds emit the counts
+		// as a separate token_count event instead.
+		if evt.Usage != nil {
+			usage.add(*evt.Usage)
+		} else if evt.Type == "token_count" {
+			usage.add(evt.tokenCounts)
+		}
 	}
 	if err := scanner.Err(); err != nil {
-		return sessionID, reply, err
+		return sessionID, reply, usage, err
 	}
 	if reply == "" {
-		return sessionID, reply, fmt.Errorf("no agent reply found in codex output")
+		return sessionID, reply, usage, errNoReply
 	}
-	return sessionID, reply, nil
+	return sessionID, reply, usage, nil
 }
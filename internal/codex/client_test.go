@@ -1,14 +1,21 @@
 package codex
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseCodexJSON(t *testing.T) {
 	logs := []byte(`{"type":"thread.started","thread_id":"abc"}
 {"type":"item.completed","item":{"id":"item_0","type":"agent_message","text":"hello"}}`)
 
-	session, reply, err := parseCodexJSON(logs)
+	session, reply, _, err := parseCodexJSON(logs)
 	if err != nil {
 		t.Fatalf("parse failed: %v", err)
 	}
@@ -19,3 +26,220 @@ func TestParseCodexJSON(t *testing.T) {
 		t.Fatalf("expected reply hello, got %s", reply)
 	}
 }
+
+func TestParseUsageSumsTurnEvents(t *testing.T) {
+	raw := `{"type":"thread.started","thread_id":"abc"}
+{"type":"turn.completed","usage":{"input_tokens":120,"cached_input_tokens":40,"output_tokens":30}}
+{"type":"item.completed","item":{"id":"item_0","type":"agent_message","text":"hello"}}
+{"type":"turn.completed","usage":{"input_tokens":10,"output_tokens":5}}`
+
+	got := ParseUsage(raw)
+	want := Usage{PromptTokens: 130, CompletionTokens: 35, TotalTokens: 165}
+	if got != want {
+		t.Fatalf("usage = %+v, want %+v", got, want)
+	}
+	if got := ParseUsage("plain text reply"); got != (Usage{}) {
+		t.Fatalf("expected zero usage without usage events, got %+v", got)
+	}
+}
+
+func TestParseCodexJSONReadsTokenCountEvents(t *testing.T) {
+	logs := []byte(`{"type":"thread.started","thread_id":"abc"}
+{"type":"token_count","input_tokens":200,"output_tokens":50,"total_tokens":250}
+{"type":"item.completed","item":{"id":"item_0","type":"agent_message","text":"hello"}}`)
+
+	session, reply, usage, err := parseCodexJSON(logs)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if session != "abc" || reply != "hello" {
+		t.Fatalf("unexpected session %q reply %q", session, reply)
+	}
+	if want := (Usage{PromptTokens: 200, CompletionTokens: 50, TotalTokens: 250}); usage != want {
+		t.Fatalf("usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestCLIClientRespectsContextDeadline(t *testing.T) {
+	stub := filepath.Join(t.TempDir(), "codex")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\nsleep 5\n"), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	client := &CLIClient{Binary: stub, Timeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, _, _, err := client.Send(ctx, "", "hello")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("call ran %s past a 100ms deadline", elapsed)
+	}
+}
+
+func TestCLIClientWaitsForAFreeSlot(t *testing.T) {
+	shared := NewProcessSlots(1)
+	for name, clients := range map[string]func(stub string) (first, second *CLIClient){
+		"own limit": func(stub string) (*CLIClient, *CLIClient) {
+			client := &CLIClient{Binary: stub, Timeout: time.Minute, MaxConcurrent: 1}
+			return client, client
+		},
+		"shared slots": func(stub string) (*CLIClient, *CLIClient) {
+			return &CLIClient{Binary: stub, Timeout: time.Minute, Slots: shared, MaxConcurrent: 4},
+				&CLIClient{Binary: stub, Timeout: time.Minute, Slots: shared, MaxConcurrent: 4}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			started := filepath.Join(dir, "started")
+			stub := filepath.Join(dir, "codex")
+			script := "#!/bin/sh\ntouch " + started + "\nsleep 1\n" +
+				`echo '{"type":"item.completed","item":{"type":"agent_message","text":"done"}}'` + "\n"
+			if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+				t.Fatalf("write stub: %v", err)
+			}
+			client, other := clients(stub)
+
+			first := make(chan error, 1)
+			go func() {
+				_, _, _, _, err := client.Send(context.Background(), "sess-1", "hello")
+				first <- err
+			}()
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if _, err := os.Stat(started); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("first call never started")
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, _, _, _, err := other.Send(ctx, "sess-2", "hello")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected the second call to give up waiting, got %v", err)
+			}
+			if err := <-first; err != nil {
+				t.Fatalf("first call: %v", err)
+			}
+		})
+	}
+}
+
+// flakyStub writes a codex stand-in that exits non-zero for its first
+// failures runs, then prints reply (or nothing when reply is empty).
+func flakyStub(t *testing.T, failures int, reply string) (binary, countFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	countFile = filepath.Join(dir, "count")
+	binary = filepath.Join(dir, "codex")
+	out := `{"type":"thread.started","thread_id":"abc"}`
+	if reply != "" {
+		out += "\n" + `{"type":"item.completed","item":{"type":"agent_message","text":"` + reply + `"}}`
+	}
+	script := "#!/bin/sh\n" +
+		"n=$(cat " + countFile + " 2>/dev/null || echo 0)\n" +
+		"n=$((n+1))\necho $n > " + countFile + "\n" +
+		"if [ $n -le " + strconv.Itoa(failures) + " ]; then echo 'rate limited' >&2; exit 1; fi\n" +
+		"cat <<'EOF'\n" + out + "\nEOF\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	return binary, countFile
+}
+
+func runCount(t *testing.T, countFile string) string {
+	t.Helper()
+	data, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatalf("read count: %v", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestCLIClientRetriesTransientFailures(t *testing.T) {
+	binary, countFile := flakyStub(t, 2, "hello")
+	client := &CLIClient{Binary: binary, MaxAttempts: 3, RetryDelay: time.Millisecond, RetryJitter: 0.5}
+
+	reply, _, session, _, err := client.Send(context.Background(), "", "hi")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if reply != "hello" || session != "abc" {
+		t.Fatalf("unexpected reply %q session %q", reply, session)
+	}
+	if got := runCount(t, countFile); got != "3" {
+		t.Fatalf("codex ran %s times, want 3", got)
+	}
+
+	binary, countFile = flakyStub(t, 5, "hello")
+	client = &CLIClient{Binary: binary, MaxAttempts: 2, RetryDelay: time.Millisecond}
+	if _, _, _, _, err := client.Send(context.Background(), "", "hi"); err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("expected the last failure after exhausting attempts, got %v", err)
+	}
+	if got := runCount(t, countFile); got != "2" {
+		t.Fatalf("codex ran %s times, want 2", got)
+	}
+}
+
+func TestCLIClientDoesNotRetryMissingReply(t *testing.T) {
+	binary, countFile := flakyStub(t, 0, "")
+	client := &CLIClient{Binary: binary, MaxAttempts: 3, RetryDelay: time.Millisecond}
+
+	_, _, _, _, err := client.Send(context.Background(), "", "hi")
+	if !errors.Is(err, errNoReply) {
+		t.Fatalf("expected errNoReply, got %v", err)
+	}
+	if got := runCount(t, countFile); got != "1" {
+		t.Fatalf("codex ran %s times, want 1", got)
+	}
+}
+
+func TestCLIClientRunsInWorkDir(t *testing.T) {
+	stub := filepath.Join(t.TempDir(), "codex")
+	script := "#!/bin/sh\n" +
+		`printf '{"type":"thread.started","thread_id":"abc"}\n{"type":"item.completed","item":{"type":"agent_message","text":"%s"}}\n' "$(pwd -P)"` + "\n"
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	configured, _ := filepath.EvalSymlinks(t.TempDir())
+	override, _ := filepath.EvalSymlinks(t.TempDir())
+	client := &CLIClient{Binary: stub, WorkDir: configured}
+
+	reply, _, _, _, err := client.Send(context.Background(), "", "where")
+	if err != nil || reply != configured {
+		t.Fatalf("reply = %q (%v), want %q", reply, err, configured)
+	}
+	reply, _, _, _, err = client.Send(WithWorkDir(context.Background(), override), "", "where")
+	if err != nil || reply != override {
+		t.Fatalf("per-call override: reply = %q (%v), want %q", reply, err, override)
+	}
+}
+
+func TestCLIClientStreamsEventText(t *testing.T) {
+	stub := filepath.Join(t.TempDir(), "codex")
+	script := "#!/bin/sh\ncat <<'EOF'\n" +
+		`{"type":"thread.started","thread_id":"abc"}` + "\n" +
+		`{"type":"item.completed","item":{"type":"reasoning","text":"thinking"}}` + "\n" +
+		`{"type":"item.completed","item":{"type":"command_execution","command":"ls","aggregated_output":"a.go"}}` + "\n" +
+		`{"type":"item.completed","item":{"type":"agent_message","text":"done"}}` + "\n" +
+		"EOF\n"
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	client := &CLIClient{Binary: stub}
+
+	var chunks []string
+	reply, _, session, _, err := client.SendStream(context.Background(), "", "go", func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil || reply != "done" || session != "abc" {
+		t.Fatalf("reply=%q session=%q err=%v", reply, session, err)
+	}
+	if got := strings.Join(chunks, "|"); got != "thinking|a.go|done" {
+		t.Fatalf("chunks = %q, want event text in order", got)
+	}
+}
@@ -0,0 +1,76 @@
+package codex
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// chatMessage is one turn of a stateless chat API conversation.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// maxHistorySessions bounds sessionHistory; the least recently used session
+// is evicted beyond it, and resuming it starts over without its history.
+const maxHistorySessions = 512
+
+// sessionHistory keeps the messages of each session for HTTP backends whose
+// APIs are stateless, so a resumed session can replay them. It lives in
+// memory only.
+type sessionHistory struct {
+	mu       sync.Mutex
+	sessions map[string]*historyEntry
+	tick     uint64
+}
+
+type historyEntry struct {
+	messages []chatMessage
+	used     uint64
+}
+
+// get returns a copy of sessionID's messages.
+func (h *sessionHistory) get(sessionID string) []chatMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+	h.tick++
+	entry.used = h.tick
+	return append([]chatMessage(nil), entry.messages...)
+}
+
+func (h *sessionHistory) set(sessionID string, messages []chatMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*historyEntry)
+	}
+	if _, ok := h.sessions[sessionID]; !ok {
+		for len(h.sessions) >= maxHistorySessions {
+			oldest := ""
+			for id, entry := range h.sessions {
+				if oldest == "" || entry.used < h.sessions[oldest].used {
+					oldest = id
+				}
+			}
+			delete(h.sessions, oldest)
+		}
+	}
+	h.tick++
+	h.sessions[sessionID] = &historyEntry{messages: messages, used: h.tick}
+}
+
+// newSessionID returns a synthetic session id such as "openai-1f2e3d4c5b6a7988".
+func newSessionID(prefix string) string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + "-" + hex.EncodeToString(b[:])
+}
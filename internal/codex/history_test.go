@@ -0,0 +1,29 @@
+package codex
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionHistoryEvictsLeastRecentlyUsed(t *testing.T) {
+	var h sessionHistory
+	msgs := []chatMessage{{Role: "user", Content: "hi"}}
+	for i := 0; i < maxHistorySessions; i++ {
+		h.set(fmt.Sprintf("s%d", i), msgs)
+	}
+	// Touch the oldest session so the next insert evicts s1 instead.
+	if got := h.get("s0"); len(got) != 1 {
+		t.Fatalf("s0 history = %+v", got)
+	}
+	h.set("new", msgs)
+
+	if len(h.sessions) != maxHistorySessions {
+		t.Fatalf("kept %d sessions, want %d", len(h.sessions), maxHistorySessions)
+	}
+	if got := h.get("s1"); got != nil {
+		t.Fatalf("least recently used session should be evicted, got %+v", got)
+	}
+	if h.get("s0") == nil || h.get("new") == nil {
+		t.Fatal("recently used sessions should be kept")
+	}
+}
@@ -0,0 +1,58 @@
+package codex
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hostAllowed reports whether u may be contacted under allowed. Entries are
+// a host name, matched case-insensitively on any port, or an exact
+// host:port. An empty list allows every host.
+func hostAllowed(u *url.URL, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, entry := range allowed {
+		entry = strings.TrimSpace(entry)
+		if strings.EqualFold(entry, u.Hostname()) || strings.EqualFold(entry, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkHost(u *url.URL, allowed []string) error {
+	if !hostAllowed(u, allowed) {
+		return fmt.Errorf("host %q is not in the allowed hosts", u.Host)
+	}
+	return nil
+}
+
+// restrictedClient returns client (http.DefaultClient when nil) with
+// redirects to hosts outside allowed refused. client itself is not modified.
+func restrictedClient(client *http.Client, allowed []string) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if len(allowed) == 0 {
+		return client
+	}
+	restricted := *client
+	next := client.CheckRedirect
+	restricted.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := checkHost(req.URL, allowed); err != nil {
+			return fmt.Errorf("redirect refused: %w", err)
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &restricted
+}
@@ -0,0 +1,87 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAIClient sends prompts to the OpenAI chat completions API. The API is
+// stateless, so the client keeps each session's message history in memory
+// and replays it on every call; sessions do not survive a restart.
+type OpenAIClient struct {
+	// BaseURL is the API root; defaults to https://api.openai.com/v1.
+	BaseURL string
+	// APIKey is sent as a bearer token.
+	APIKey string
+	// Model is the chat model to call, e.g. "gpt-4o-mini".
+	Model string
+	// Timeout bounds each call. A sooner deadline on the caller's context wins.
+	Timeout time.Duration
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// AllowedHosts, when set, limits the hosts BaseURL and any redirects may
+	// point at; requests elsewhere fail before they are sent.
+	AllowedHosts []string
+
+	history sessionHistory
+}
+
+// NewOpenAIClient returns a client for model, reading the API key from
+// OPENAI_API_KEY and an optional base URL from OPENAI_BASE_URL.
+func NewOpenAIClient(model string) *OpenAIClient {
+	return &OpenAIClient{
+		BaseURL: os.Getenv("OPENAI_BASE_URL"),
+		APIKey:  os.Getenv("OPENAI_API_KEY"),
+		Model:   model,
+		Timeout: 60 * time.Second,
+	}
+}
+
+func (c *OpenAIClient) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	header := http.Header{}
+	if c.APIKey != "" {
+		header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return chatCall{
+		name:    "openai",
+		url:     strings.TrimSuffix(baseURL, "/") + "/chat/completions",
+		header:  header,
+		timeout: c.Timeout,
+		client:  c.HTTPClient,
+		allowed: c.AllowedHosts,
+		history: &c.history,
+		body: func(messages []chatMessage) any {
+			return struct {
+				Model    string        `json:"model"`
+				Messages []chatMessage `json:"messages"`
+			}{c.Model, messages}
+		},
+		parse: parseChatCompletion,
+	}.send(ctx, sessionID, prompt)
+}
+
+func parseChatCompletion(out []byte) (string, error) {
+	var resp struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("no assistant reply found in openai output")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
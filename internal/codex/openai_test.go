@@ -0,0 +1,125 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIClientReplaysSessionHistory(t *testing.T) {
+	var seen [][]chatMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-test" {
+			t.Errorf("authorization = %q", got)
+		}
+		var req struct {
+			Model    string        `json:"model"`
+			Messages []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		if req.Model != "gpt-test" {
+			t.Errorf("model = %q", req.Model)
+		}
+		seen = append(seen, req.Messages)
+		last := req.Messages[len(req.Messages)-1].Content
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": "re: " + last}}},
+		})
+	}))
+	defer srv.Close()
+
+	client := &OpenAIClient{BaseURL: srv.URL, APIKey: "sk-test", Model: "gpt-test"}
+	ctx := context.Background()
+	reply, raw, session, _, err := client.Send(ctx, "", "plan it")
+	if err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if reply != "re: plan it" || !strings.Contains(raw, "choices") || !strings.HasPrefix(session, "openai-") {
+		t.Fatalf("unexpected first call: reply=%q raw=%q session=%q", reply, raw, session)
+	}
+	reply, _, again, _, err := client.Send(ctx, session, "do step 1")
+	if err != nil {
+		t.Fatalf("second send: %v", err)
+	}
+	if reply != "re: do step 1" || again != session {
+		t.Fatalf("unexpected second call: reply=%q session=%q", reply, again)
+	}
+	if len(seen[1]) != 3 || seen[1][0].Content != "plan it" || seen[1][1].Role != "assistant" {
+		t.Fatalf("second request should replay the session history, got %+v", seen[1])
+	}
+}
+
+func TestOpenAIClientReportsHTTPErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client := &OpenAIClient{BaseURL: srv.URL, Model: "gpt-test"}
+	_, raw, _, _, err := client.Send(context.Background(), "", "hello")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected a 401 error, got %v", err)
+	}
+	if !strings.Contains(raw, "bad key") {
+		t.Fatalf("raw output should keep the error body, got %q", raw)
+	}
+}
+
+func TestOpenAIClientRefusesHostsOutsideAllowlist(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer srv.Close()
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer redirector.Close()
+	redirectHost := strings.TrimPrefix(redirector.URL, "http://")
+
+	client := &OpenAIClient{BaseURL: srv.URL, AllowedHosts: []string{"api.openai.com"}}
+	if _, _, _, _, err := client.Send(context.Background(), "", "hi"); err == nil || !strings.Contains(err.Error(), "not in the allowed hosts") {
+		t.Fatalf("send to a non-allowlisted host: err = %v", err)
+	}
+	client = &OpenAIClient{BaseURL: redirector.URL, AllowedHosts: []string{redirectHost}}
+	if _, _, _, _, err := client.Send(context.Background(), "", "hi"); err == nil || !strings.Contains(err.Error(), "redirect refused") {
+		t.Fatalf("redirect to a non-allowlisted host: err = %v", err)
+	}
+	if hits != 0 {
+		t.Fatalf("non-allowlisted server received %d requests", hits)
+	}
+}
+
+func TestOpenAIUsageIsReadFromPrettyPrintedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+  "choices": [
+    {"message": {"role": "assistant", "content": "done"}}
+  ],
+  "usage": {
+    "prompt_tokens": 21,
+    "completion_tokens": 4,
+    "total_tokens": 25
+  }
+}`))
+	}))
+	defer srv.Close()
+
+	client := &OpenAIClient{BaseURL: srv.URL, Model: "gpt-test"}
+	_, raw, _, _, err := client.Send(context.Background(), "", "hello")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	want := Usage{PromptTokens: 21, CompletionTokens: 4, TotalTokens: 25}
+	if got := ParseUsage(raw); got != want {
+		t.Fatalf("usage = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,26 @@
+package codex
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// NewHTTPClient returns an http.Client for the HTTP backends that sends
+// every request through proxyURL, or, when proxyURL is empty, through the
+// proxy named by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func NewHTTPClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q: want scheme://host[:port]", u.Redacted())
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,50 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPClientRoutesThroughConfiguredProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute target URL.
+		proxied = append(proxied, r.URL.String())
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": "via proxy"}}},
+		})
+	}))
+	defer proxy.Close()
+
+	httpClient, err := NewHTTPClient(proxy.URL)
+	if err != nil {
+		t.Fatalf("new http client: %v", err)
+	}
+	client := &OpenAIClient{
+		BaseURL:      "http://api.openai.invalid/v1",
+		Model:        "gpt-test",
+		HTTPClient:   httpClient,
+		AllowedHosts: []string{"api.openai.invalid"},
+	}
+	reply, _, _, _, err := client.Send(context.Background(), "", "hello")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if reply != "via proxy" {
+		t.Fatalf("reply = %q", reply)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://api.openai.invalid/v1/chat/completions" {
+		t.Fatalf("proxy saw %v, want the chat completions request", proxied)
+	}
+}
+
+func TestNewHTTPClientRejectsInvalidProxyURL(t *testing.T) {
+	for _, proxyURL := range []string{"proxy.corp:3128", "://bad"} {
+		if _, err := NewHTTPClient(proxyURL); err == nil {
+			t.Errorf("NewHTTPClient(%q) should fail", proxyURL)
+		}
+	}
+}
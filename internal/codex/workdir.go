@@ -0,0 +1,22 @@
+package codex
+
+import "context"
+
+type workDirKey struct{}
+
+// WithWorkDir returns a context asking clients and command runners to work in
+// dir instead of their configured directory. An empty dir changes nothing.
+func WithWorkDir(ctx context.Context, dir string) context.Context {
+	if dir == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, workDirKey{}, dir)
+}
+
+// WorkDir returns the directory set by WithWorkDir, or fallback when none is.
+func WorkDir(ctx context.Context, fallback string) string {
+	if dir, ok := ctx.Value(workDirKey{}).(string); ok && dir != "" {
+		return dir
+	}
+	return fallback
+}
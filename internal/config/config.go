@@ -3,20 +3,285 @@ package config
 import (
 	"flag"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
 )
 
+// Config is the effective server configuration, from env vars and flags.
 type Config struct {
-	Port    string
-	ObsPort string
+	Port             string        `json:"port"`
+	ObsPort          string        `json:"obs_port"`
+	PrettyJSON       bool          `json:"pretty_json"`
+	Debug            bool          `json:"debug"`
+	EmitTruncation   bool          `json:"emit_truncation"`
+	CommandShell     string        `json:"command_shell"`
+	WorkDir          string        `json:"work_dir"`
+	CommandDenylist  string        `json:"command_denylist"`
+	MaxExecuting     int           `json:"max_executing"`
+	WorkQueueSize    int           `json:"work_queue_size"`
+	EnqueueWait      time.Duration `json:"enqueue_wait"`
+	PlanConcurrency  int           `json:"plan_concurrency"`
+	DedupSteps       bool          `json:"dedup_steps"`
+	ObsBufferSize    int           `json:"obs_buffer_size"`
+	ObsHistorySize   int           `json:"obs_history_size"`
+	ObsHeartbeat     time.Duration `json:"obs_heartbeat"`
+	ObsReplaySize    int           `json:"obs_replay_size"`
+	ObsDedupWindow   int           `json:"obs_dedup_window"`
+	AdminToken       string        `json:"admin_token"`
+	ContextMessages  int           `json:"context_messages"`
+	MaxHumanWait     time.Duration `json:"max_human_wait"`
+	PlanExpiry       time.Duration `json:"plan_expiry"`
+	SweepInterval    time.Duration `json:"sweep_interval"`
+	StepCriteria     string        `json:"step_criteria"`
+	BlockEscalation  string        `json:"block_escalation"`
+	SanitizeDisplay  bool          `json:"sanitize_display"`
+	MaxPlanText      int           `json:"max_plan_text"`
+	RequireReview    bool          `json:"require_review"`
+	StepArtifacts    bool          `json:"step_artifacts"`
+	CommandArtifacts string        `json:"command_artifacts"`
+	ExactCriteria    bool          `json:"exact_criteria"`
+	VerifyRemaining  bool          `json:"verify_remaining_only"`
+	Store            string        `json:"store"`
+	StorePath        string        `json:"store_path"`
+	StoreDSN         string        `json:"store_dsn"`
+	StoreMaxConns    int           `json:"store_max_conns"`
+	StoreConnMaxAge  time.Duration `json:"store_conn_max_age"`
+	RequeueStranded  bool          `json:"requeue_stranded"`
+	VerifyModel      string        `json:"verify_model"`
+	ModelBackend     string        `json:"model_backend"`
+	CodexConcurrency int           `json:"codex_concurrency"`
+	CodexAttempts    int           `json:"codex_attempts"`
+	CodexRetryDelay  time.Duration `json:"codex_retry_delay"`
+	OpenAIModel      string        `json:"openai_model"`
+	AnthropicModel   string        `json:"anthropic_model"`
+	AllowedHosts     string        `json:"allowed_hosts"`
+	ModelProxy       string        `json:"model_proxy"`
+	GitContext       bool          `json:"git_context"`
+	GitContextCmds   string        `json:"git_context_commands"`
+	SaveRetries      int           `json:"save_retries"`
+	SaveBackoff      time.Duration `json:"save_backoff"`
+	StrictDirectives bool          `json:"strict_directives"`
+	MaxArtifactBytes int           `json:"max_artifact_bytes"`
+	InboxDebounce    time.Duration `json:"inbox_debounce"`
+	PromptStorage    string        `json:"prompt_storage"`
+	CallLog          string        `json:"call_log"`
+	MaxPlanSteps     int           `json:"max_plan_steps"`
+	JSONPlans        bool          `json:"json_plans"`
+	PlanCacheTTL     time.Duration `json:"plan_cache_ttl"`
+	MaxModelCalls    int           `json:"max_model_calls"`
+	DiscoveryDepth   int           `json:"discovery_depth"`
+	MaxVerifyReplans int           `json:"max_verify_replans"`
+	MaxAttempts      int           `json:"max_attempts"`
+	ConcurrentSends  string        `json:"concurrent_sends"`
 }
 
 func Load() Config {
 	port := envDefault("PORT", ":8080")
 	obsPort := envDefault("OBS_PORT", ":8081")
+	pretty := envBool("PRETTY_JSON", false)
+	debug := envBool("DEBUG", false)
+	emitTruncation := envBool("EMIT_TRUNCATION_EVENTS", false)
+	commandShell := envDefault("COMMAND_SHELL", "sh -c")
+	workDir := envDefault("WORK_DIR", "")
+	commandDenylist := envDefault("COMMAND_DENYLIST", "")
+	maxExecuting := envInt("MAX_EXECUTING", 0)
+	workQueueSize := envInt("WORK_QUEUE_SIZE", 64)
+	enqueueWait := envDuration("ENQUEUE_WAIT", time.Second)
+	planConcurrency := envInt("PLAN_CONCURRENCY", 4)
+	dedupSteps := envBool("DEDUP_STEPS", false)
+	obsBuffer := envInt("OBS_BUFFER_SIZE", 64)
+	obsHistory := envInt("OBS_HISTORY_SIZE", 1000)
+	obsHeartbeat := envDuration("OBS_HEARTBEAT", 30*time.Second)
+	obsReplay := envInt("OBS_REPLAY_SIZE", 256)
+	obsDedup := envInt("OBS_DEDUP_WINDOW", 256)
+	adminToken := envDefault("ADMIN_TOKEN", "")
+	contextMessages := envInt("CONTEXT_MESSAGES", 0)
+	maxHumanWait := envDuration("MAX_HUMAN_WAIT", 0)
+	planExpiry := envDuration("PLAN_EXPIRY", 0)
+	sweepInterval := envDuration("SWEEP_INTERVAL", time.Minute)
+	stepCriteria := envDefault("STEP_CRITERIA", "all")
+	blockEscalation := envDefault("BLOCK_ESCALATION", "replan")
+	sanitizeDisplay := envBool("SANITIZE_DISPLAY", true)
+	maxPlanText := envInt("MAX_PLAN_TEXT", 0)
+	requireReview := envBool("REQUIRE_COMPLETION_REVIEW", false)
+	stepArtifacts := envBool("STEP_ARTIFACTS", false)
+	commandArtifacts := envDefault("COMMAND_ARTIFACTS", "always")
+	exactCriteria := envBool("EXACT_CRITERIA", false)
+	verifyRemaining := envBool("VERIFY_REMAINING_ONLY", false)
+	storeKind := envDefault("STORE", "memory")
+	storePath := envDefault("STORE_PATH", "trill.db")
+	storeDSN := envDefault("STORE_DSN", "")
+	storeMaxConns := envInt("STORE_MAX_CONNS", 10)
+	storeConnMaxAge := envDuration("STORE_CONN_MAX_AGE", 30*time.Minute)
+	requeueStranded := envBool("REQUEUE_STRANDED", true)
+	_, requeueSet := os.LookupEnv("REQUEUE_STRANDED")
+	verifyModel := envDefault("VERIFY_MODEL", "")
+	modelBackend := envDefault("MODEL_BACKEND", "codex")
+	codexConcurrency := envInt("CODEX_CONCURRENCY", runtime.NumCPU())
+	codexAttempts := envInt("CODEX_ATTEMPTS", 3)
+	codexRetryDelay := envDuration("CODEX_RETRY_DELAY", 2*time.Second)
+	openAIModel := envDefault("OPENAI_MODEL", "gpt-4o-mini")
+	anthropicModel := envDefault("ANTHROPIC_MODEL", "claude-3-5-sonnet-latest")
+	allowedHosts := envDefault("MODEL_ALLOWED_HOSTS", "")
+	modelProxy := envDefault("MODEL_PROXY", "")
+	gitContext := envBool("GIT_CONTEXT", false)
+	gitContextCmds := envDefault("GIT_CONTEXT_COMMANDS", "git rev-parse --abbrev-ref HEAD,git log --oneline -5,git status --short")
+	saveRetries := envInt("SAVE_RETRIES", 3)
+	saveBackoff := envDuration("SAVE_BACKOFF", 50*time.Millisecond)
+	strictDirectives := envBool("STRICT_DIRECTIVES", false)
+	maxArtifactBytes := envInt("MAX_ARTIFACT_BYTES", 1<<20)
+	inboxDebounce := envDuration("INBOX_DEBOUNCE", 250*time.Millisecond)
+	promptStorage := envDefault("PROMPT_STORAGE", "full")
+	callLog := envDefault("CALL_LOG", "")
+	maxPlanSteps := envInt("MAX_PLAN_STEPS", 12)
+	jsonPlans := envBool("JSON_PLANS", false)
+	planCacheTTL := envDuration("PLAN_CACHE_TTL", 0)
+	maxModelCalls := envInt("MAX_MODEL_CALLS", 0)
+	discoveryDepth := envInt("DISCOVERY_DEPTH", 3)
+	maxVerifyReplans := envInt("MAX_VERIFY_REPLANS", 0)
+	maxAttempts := envInt("MAX_ATTEMPTS", 1)
+	concurrentSends := envDefault("CONCURRENT_SENDS", "queue")
 	flag.StringVar(&port, "port", port, "HTTP listen address")
 	flag.StringVar(&obsPort, "obs-port", obsPort, "Observability HTTP listen address")
+	flag.BoolVar(&pretty, "pretty", pretty, "Indent JSON API responses")
+	flag.BoolVar(&debug, "debug", debug, "Enable debug logging")
+	flag.BoolVar(&emitTruncation, "emit-truncation-events", emitTruncation, "Publish obs events when prompt context is truncated")
+	flag.StringVar(&commandShell, "command-shell", commandShell, "Shell and flag used to run approved commands (e.g. \"bash -c\")")
+	flag.StringVar(&workDir, "work-dir", workDir, "Directory codex and approved commands run in (default: the server's)")
+	flag.StringVar(&commandDenylist, "command-denylist", commandDenylist, "Comma-separated patterns that stop an approved command from running (substrings, or re:<regexp>)")
+	flag.IntVar(&maxExecuting, "max-executing", maxExecuting, "Maximum conversations executing at once (0 = unlimited)")
+	flag.IntVar(&workQueueSize, "work-queue-size", workQueueSize, "Approvals that may wait for the background worker")
+	flag.DurationVar(&enqueueWait, "enqueue-wait", enqueueWait, "How long an approval waits for room in a full work queue before a 429")
+	flag.IntVar(&planConcurrency, "plan-concurrency", planConcurrency, "New conversations planned at once across the server (0 = unlimited)")
+	flag.BoolVar(&dedupSteps, "dedup-steps", dedupSteps, "Collapse duplicate plan steps")
+	flag.IntVar(&obsBuffer, "obs-buffer-size", obsBuffer, "Events buffered per observability subscriber")
+	flag.IntVar(&obsHistory, "obs-history-size", obsHistory, "Recent events kept for /obs/events queries (negative disables)")
+	flag.DurationVar(&obsHeartbeat, "obs-heartbeat", obsHeartbeat, "Interval between SSE heartbeat comments (negative disables)")
+	flag.IntVar(&obsReplay, "obs-replay-size", obsReplay, "Most recent events replayed to a new SSE subscriber (negative disables)")
+	flag.IntVar(&obsDedup, "obs-dedup-window", obsDedup, "Recent event IDs each SSE stream remembers to skip duplicates after a replay (negative disables)")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Bearer token for /admin endpoints (empty disables them)")
+	flag.IntVar(&contextMessages, "context-messages", contextMessages, "Recent chat messages to include in step execution prompts (0 = none)")
+	flag.DurationVar(&maxHumanWait, "max-human-wait", maxHumanWait, "Abort conversations awaiting a human longer than this (0 = never)")
+	flag.DurationVar(&planExpiry, "plan-expiry", planExpiry, "Abort plans left unapproved longer than this (0 = never)")
+	flag.DurationVar(&sweepInterval, "sweep-interval", sweepInterval, "How often the background sweeper runs")
+	flag.StringVar(&stepCriteria, "step-criteria", stepCriteria, "Acceptance criteria in step prompts: all, none, or a count")
+	flag.StringVar(&blockEscalation, "block-escalation", blockEscalation, "On a blocked step: replan (automatic) or human (wait for resume)")
+	flag.BoolVar(&sanitizeDisplay, "sanitize-display", sanitizeDisplay, "Escape control characters in commands and output shown to operators")
+	flag.IntVar(&maxPlanText, "max-plan-text", maxPlanText, "Maximum bytes of plan text stored per conversation (0 = unlimited)")
+	flag.BoolVar(&requireReview, "require-completion-review", requireReview, "Hold plans without acceptance criteria for explicit human completion")
+	flag.BoolVar(&stepArtifacts, "step-artifacts", stepArtifacts, "Save each successful step's result as an artifact")
+	flag.StringVar(&commandArtifacts, "command-artifacts", commandArtifacts, "Save approved command output as artifacts: always, only-on-failure, or never")
+	flag.BoolVar(&exactCriteria, "exact-criteria", exactCriteria, "Match acceptance criteria verbatim instead of normalizing case and punctuation")
+	flag.BoolVar(&verifyRemaining, "verify-remaining-only", verifyRemaining, "Leave criteria confirmed by earlier verifications out of later verify prompts")
+	flag.StringVar(&storeKind, "store", storeKind, "Conversation store: memory, sqlite, bolt, or postgres")
+	flag.StringVar(&storePath, "store-path", storePath, "Database file for the sqlite or bolt store")
+	flag.StringVar(&storeDSN, "store-dsn", storeDSN, "Connection string for the postgres store")
+	flag.IntVar(&storeMaxConns, "store-max-conns", storeMaxConns, "Maximum open postgres connections (0 = unlimited)")
+	flag.DurationVar(&storeConnMaxAge, "store-conn-max-age", storeConnMaxAge, "Recycle postgres connections older than this (0 = never)")
+	flag.BoolVar(&requeueStranded, "requeue-stranded", requeueStranded, "Resume conversations left queued or executing at startup (default off for the shared postgres store)")
+	flag.StringVar(&verifyModel, "verify-model", verifyModel, "Codex model for acceptance verification (default: same as execution)")
+	flag.StringVar(&modelBackend, "model-backend", modelBackend, "Model backend: codex (CLI), openai (chat completions API), or anthropic (messages API)")
+	flag.IntVar(&codexConcurrency, "codex-concurrency", codexConcurrency, "Maximum codex processes running at once (0 = unlimited)")
+	flag.IntVar(&codexAttempts, "codex-attempts", codexAttempts, "Times to run codex on transient failures before giving up (1 = no retries)")
+	flag.DurationVar(&codexRetryDelay, "codex-retry-delay", codexRetryDelay, "Wait before the first codex retry; doubles per retry")
+	flag.StringVar(&openAIModel, "openai-model", openAIModel, "Chat model for the openai backend")
+	flag.StringVar(&anthropicModel, "anthropic-model", anthropicModel, "Model for the anthropic backend")
+	flag.StringVar(&allowedHosts, "model-allowed-hosts", allowedHosts, "Comma-separated hosts the openai and anthropic backends may contact (empty allows any)")
+	flag.StringVar(&modelProxy, "model-proxy", modelProxy, "Proxy URL for the openai and anthropic backends (empty uses HTTP_PROXY/HTTPS_PROXY)")
+	flag.BoolVar(&gitContext, "git-context", gitContext, "Run read-only git commands at create time and give their output to the planner")
+	flag.StringVar(&gitContextCmds, "git-context-commands", gitContextCmds, "Comma-separated git commands run when -git-context is set")
+	flag.IntVar(&saveRetries, "save-retries", saveRetries, "Retries for a failed conversation store save (0 = fail on the first error)")
+	flag.DurationVar(&saveBackoff, "save-backoff", saveBackoff, "Delay before the first store save retry; doubles on each attempt")
+	flag.BoolVar(&strictDirectives, "strict-directives", strictDirectives, "Only recognize COMMAND:/NEED:/... at the very start of a model reply, without markdown")
+	flag.IntVar(&maxArtifactBytes, "max-artifact-bytes", maxArtifactBytes, "Maximum bytes of content stored per artifact (0 = unlimited)")
+	flag.DurationVar(&inboxDebounce, "inbox-debounce", inboxDebounce, "Coalesce inbox events per conversation within this window (0 = publish every change)")
+	flag.StringVar(&promptStorage, "prompt-storage", promptStorage, "Model call prompts kept in conversations: full, or hash (fingerprint plus preview)")
+	flag.StringVar(&callLog, "call-log", callLog, "Log every model prompt and reply as JSON lines to stdout or this file (empty disables)")
+	flag.IntVar(&maxPlanSteps, "max-plan-steps", maxPlanSteps, "Maximum steps kept from a model plan (0 = unlimited)")
+	flag.BoolVar(&jsonPlans, "json-plans", jsonPlans, "Ask the model for plans as JSON ({\"steps\": [...], \"acceptance\": [...]}) instead of a numbered list")
+	flag.DurationVar(&planCacheTTL, "plan-cache-ttl", planCacheTTL, "Reuse replies to identical planning prompts within this window (0 = off)")
+	flag.IntVar(&maxModelCalls, "max-model-calls", maxModelCalls, "Model calls a conversation may make before it blocks for a resume (0 = unlimited)")
+	flag.IntVar(&discoveryDepth, "discovery-depth", discoveryDepth, "Discovery commands proposed for one step before NEED goes to a human (0 = unlimited)")
+	flag.IntVar(&maxVerifyReplans, "max-verify-replans", maxVerifyReplans, "Replans after failed verification before giving up on an attempt (0 = unlimited)")
+	flag.IntVar(&maxAttempts, "max-attempts", maxAttempts, "Fresh attempts, counting the first, once verification replans are exhausted")
+	flag.StringVar(&concurrentSends, "concurrent-sends", concurrentSends, "A /send to a conversation already answering one: queue (wait) or reject (409)")
 	flag.Parse()
-	return Config{Port: port, ObsPort: obsPort}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "requeue-stranded" {
+			requeueSet = true
+		}
+	})
+	if !requeueSet && storeKind == "postgres" {
+		// Other live instances may be running those conversations.
+		requeueStranded = false
+	}
+	return Config{
+		Port:             port,
+		ObsPort:          obsPort,
+		PrettyJSON:       pretty,
+		Debug:            debug,
+		EmitTruncation:   emitTruncation,
+		CommandShell:     commandShell,
+		WorkDir:          workDir,
+		CommandDenylist:  commandDenylist,
+		MaxExecuting:     maxExecuting,
+		WorkQueueSize:    workQueueSize,
+		EnqueueWait:      enqueueWait,
+		PlanConcurrency:  planConcurrency,
+		DedupSteps:       dedupSteps,
+		ObsBufferSize:    obsBuffer,
+		ObsHistorySize:   obsHistory,
+		ObsHeartbeat:     obsHeartbeat,
+		ObsReplaySize:    obsReplay,
+		ObsDedupWindow:   obsDedup,
+		AdminToken:       adminToken,
+		ContextMessages:  contextMessages,
+		MaxHumanWait:     maxHumanWait,
+		PlanExpiry:       planExpiry,
+		SweepInterval:    sweepInterval,
+		StepCriteria:     stepCriteria,
+		BlockEscalation:  blockEscalation,
+		SanitizeDisplay:  sanitizeDisplay,
+		MaxPlanText:      maxPlanText,
+		RequireReview:    requireReview,
+		StepArtifacts:    stepArtifacts,
+		CommandArtifacts: commandArtifacts,
+		ExactCriteria:    exactCriteria,
+		VerifyRemaining:  verifyRemaining,
+		Store:            storeKind,
+		StorePath:        storePath,
+		StoreDSN:         storeDSN,
+		StoreMaxConns:    storeMaxConns,
+		StoreConnMaxAge:  storeConnMaxAge,
+		RequeueStranded:  requeueStranded,
+		VerifyModel:      verifyModel,
+		ModelBackend:     modelBackend,
+		CodexConcurrency: codexConcurrency,
+		CodexAttempts:    codexAttempts,
+		CodexRetryDelay:  codexRetryDelay,
+		OpenAIModel:      openAIModel,
+		AnthropicModel:   anthropicModel,
+		AllowedHosts:     allowedHosts,
+		ModelProxy:       modelProxy,
+		GitContext:       gitContext,
+		GitContextCmds:   gitContextCmds,
+		SaveRetries:      saveRetries,
+		SaveBackoff:      saveBackoff,
+		StrictDirectives: strictDirectives,
+		MaxArtifactBytes: maxArtifactBytes,
+		InboxDebounce:    inboxDebounce,
+		PromptStorage:    promptStorage,
+		CallLog:          callLog,
+		MaxPlanSteps:     maxPlanSteps,
+		JSONPlans:        jsonPlans,
+		PlanCacheTTL:     planCacheTTL,
+		MaxModelCalls:    maxModelCalls,
+		DiscoveryDepth:   discoveryDepth,
+		MaxVerifyReplans: maxVerifyReplans,
+		MaxAttempts:      maxAttempts,
+		ConcurrentSends:  concurrentSends,
+	}
 }
 
 func envDefault(key, def string) string {
@@ -25,3 +290,44 @@ func envDefault(key, def string) string {
 	}
 	return def
 }
+
+func envBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// Redacted returns a copy of c that is safe to display, with secrets masked.
+func (c Config) Redacted() Config {
+	if c.AdminToken != "" {
+		c.AdminToken = "[redacted]"
+	}
+	if c.StoreDSN != "" {
+		c.StoreDSN = "[redacted]"
+	}
+	if c.ModelProxy != "" {
+		c.ModelProxy = "[redacted]"
+	}
+	return c
+}
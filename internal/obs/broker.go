@@ -2,53 +2,213 @@ package obs
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Event captures observability data for Codex interactions and execution flow.
 type Event struct {
-	Timestamp   time.Time `json:"timestamp"`
-	Type        string    `json:"type"`
-	SessionID   string    `json:"session_id"`
-	Prompt      string    `json:"prompt,omitempty"`
-	ModelPrompt string    `json:"model_prompt,omitempty"`
-	PlanText    string    `json:"plan_text,omitempty"`
-	StepID      string    `json:"step_id,omitempty"`
-	StepTitle   string    `json:"step_title,omitempty"`
-	Command     string    `json:"command,omitempty"`
-	RawOutput   string    `json:"raw_output,omitempty"`
-	Reply       string    `json:"reply,omitempty"`
-	Note        string    `json:"note,omitempty"`
-	ArtifactID  string    `json:"artifact_id,omitempty"`
+	// ID orders events in publish order. SSEHandler sends it as the frame id
+	// so reconnecting clients can resume with Last-Event-ID.
+	ID        uint64    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id"`
+	// ConversationID is the conversation's stable ID; SessionID can instead
+	// name the Codex session a model call ran in.
+	ConversationID string `json:"conversation_id,omitempty"`
+	State          string `json:"state,omitempty"`
+	Prompt         string `json:"prompt,omitempty"`
+	ModelPrompt    string `json:"model_prompt,omitempty"`
+	PlanText       string `json:"plan_text,omitempty"`
+	StepID         string `json:"step_id,omitempty"`
+	StepTitle      string `json:"step_title,omitempty"`
+	Command        string `json:"command,omitempty"`
+	RawOutput      string `json:"raw_output,omitempty"`
+	Reply          string `json:"reply,omitempty"`
+	Note           string `json:"note,omitempty"`
+	ArtifactID     string `json:"artifact_id,omitempty"`
+	Log            string `json:"log,omitempty"`
+	// Transient events, such as streamed output, go to live subscribers
+	// only. They are kept out of history and replay so their volume doesn't
+	// push out the events a late subscriber needs.
+	Transient bool `json:"-"`
 }
 
+// DefaultBufferSize is the per-subscriber channel capacity used when BufferSize is unset.
+const DefaultBufferSize = 64
+
+// DefaultHeartbeatInterval is how often SSEHandler pings an idle stream when
+// HeartbeatInterval is unset.
+const DefaultHeartbeatInterval = 30 * time.Second
+
 type Broker struct {
+	// BufferSize is the channel capacity given to each new subscriber; events
+	// are dropped for subscribers whose buffer is full.
+	BufferSize int
+	// HistorySize is how many recent events are kept for Events and
+	// EventsHandler (DefaultHistorySize when zero, none when negative).
+	HistorySize int
+	// HeartbeatInterval is how often SSEHandler writes a comment line so
+	// proxies don't drop idle streams (DefaultHeartbeatInterval when zero,
+	// none when negative).
+	HeartbeatInterval time.Duration
+	// ReplaySize caps how many remembered events SSEHandler replays to a new
+	// subscriber (DefaultReplaySize when zero, none when negative).
+	ReplaySize int
+	// DedupWindow is how many recently sent event IDs each SSE stream keeps
+	// to drop events it already sent, such as ones published while a replay
+	// was read that arrive again live (DefaultDedupWindow when zero, no
+	// dedup when negative). An event at or below the oldest ID it has
+	// forgotten counts as sent, so a larger window tolerates more events
+	// delivered out of publish order.
+	DedupWindow int
+	// Logger receives drop warnings; nil uses slog.Default().
+	Logger *slog.Logger
+
 	mu   sync.RWMutex
-	subs map[chan Event]struct{}
+	subs map[chan Event]*subscriber
+	// subSeq numbers subscribers for Stats, under mu.
+	subSeq uint64
+	// dropped counts events dropped across all subscribers, past and present.
+	dropped atomic.Int64
+	// now stamps published events; nil uses time.Now.
+	now     func() time.Time
+	histMu  sync.Mutex
+	history []Event
+	// lastID is the ID given to the most recent event, under histMu.
+	lastID uint64
+	// counts maps event type to an *atomic.Int64 of events published.
+	counts sync.Map
+	// onSubscribe, when set, runs in SSEHandler between subscribing and
+	// replaying; tests publish into that overlap with it.
+	onSubscribe func()
 }
 
 func NewBroker() *Broker {
-	return &Broker{subs: make(map[chan Event]struct{})}
+	return &Broker{BufferSize: DefaultBufferSize, subs: make(map[chan Event]*subscriber)}
+}
+
+// subscriber is the bookkeeping kept for one Subscribe channel.
+type subscriber struct {
+	id      uint64
+	since   time.Time
+	dropped atomic.Int64
+}
+
+func (b *Broker) logger() *slog.Logger {
+	if b.Logger != nil {
+		return b.Logger
+	}
+	return slog.Default()
 }
 
 func (b *Broker) Publish(ev Event) {
-	ev.Timestamp = time.Now()
+	if b.now != nil {
+		ev.Timestamp = b.now()
+	} else {
+		ev.Timestamp = time.Now()
+	}
+	ev = b.remember(ev)
+	n, ok := b.counts.Load(ev.Type)
+	if !ok {
+		n, _ = b.counts.LoadOrStore(ev.Type, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
 	b.mu.RLock()
-	for ch := range b.subs {
+	for ch, sub := range b.subs {
 		select {
 		case ch <- ev:
 		default:
+			b.dropped.Add(1)
+			// Warn once per subscriber; Stats keeps counting after that.
+			if sub.dropped.Add(1) == 1 {
+				b.logger().Warn("observability subscriber is falling behind; dropping events",
+					"subscriber", sub.id, "buffer", cap(ch), "type", ev.Type)
+			}
 		}
 	}
 	b.mu.RUnlock()
 }
 
+// SubscriberStats describes one current subscriber.
+type SubscriberStats struct {
+	ID       uint64    `json:"id"`
+	Since    time.Time `json:"since"`
+	Buffered int       `json:"buffered"`
+	Capacity int       `json:"capacity"`
+	Dropped  int64     `json:"dropped"`
+}
+
+// Stats reports event delivery: Dropped counts every event a full
+// subscriber buffer has turned away, including for subscribers since gone.
+type Stats struct {
+	Dropped     int64             `json:"dropped"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// Stats returns the current delivery counters, subscribers oldest first.
+func (b *Broker) Stats() Stats {
+	stats := Stats{Dropped: b.dropped.Load(), Subscribers: make([]SubscriberStats, 0)}
+	b.mu.RLock()
+	for ch, sub := range b.subs {
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			ID:       sub.id,
+			Since:    sub.since,
+			Buffered: len(ch),
+			Capacity: cap(ch),
+			Dropped:  sub.dropped.Load(),
+		})
+	}
+	b.mu.RUnlock()
+	sort.Slice(stats.Subscribers, func(i, j int) bool { return stats.Subscribers[i].ID < stats.Subscribers[j].ID })
+	return stats
+}
+
+// StatsHandler serves Stats as JSON.
+func (b *Broker) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b.Stats())
+}
+
+// EventCounts returns how many events of each type have been published.
+func (b *Broker) EventCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	b.counts.Range(func(k, v any) bool {
+		counts[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// EventCountsHandler serves EventCounts as JSON.
+func (b *Broker) EventCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b.EventCounts())
+}
+
 func (b *Broker) Subscribe() chan Event {
-	ch := make(chan Event, 64)
+	size := b.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	ch := make(chan Event, size)
 	b.mu.Lock()
-	b.subs[ch] = struct{}{}
+	b.subSeq++
+	b.subs[ch] = &subscriber{id: b.subSeq, since: time.Now()}
 	b.mu.Unlock()
 	return ch
 }
@@ -62,29 +222,110 @@ func (b *Broker) Unsubscribe(ch chan Event) {
 	b.mu.Unlock()
 }
 
-// SSEHandler streams events as newline-delimited JSON with SSE framing.
+// SSEHandler streams events with SSE framing. Frames carry JSON by default, or
+// base64-encoded msgpack when negotiated via NegotiateEncoder.
+//
+// Before streaming live events it replays remembered ones, up to ReplaySize:
+// those after the Last-Event-ID header when a client reconnects, or the last
+// N when the request has ?replay=N. The session and type query parameters
+// limit the stream, replay included, to matching events as EventFilter does.
+// Events already sent, e.g. replayed and then delivered live, are skipped;
+// see DedupWindow.
 func (b *Broker) SSEHandler(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
 		return
 	}
+	var (
+		replay  bool
+		afterID uint64
+		limit   = b.ReplaySize
+	)
+	if limit == 0 {
+		limit = DefaultReplaySize
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be an event id", http.StatusBadRequest)
+			return
+		}
+		replay, afterID = true, id
+	} else if v := r.URL.Query().Get("replay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "replay must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		replay, limit = true, min(n, limit)
+	}
+	filter := EventFilter{Type: r.URL.Query().Get("type"), SessionID: r.URL.Query().Get("session")}
+	enc := NegotiateEncoder(r)
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Event-Encoding", enc.Name())
 
 	ch := b.Subscribe()
 	defer b.Unsubscribe(ch)
+	if b.onSubscribe != nil {
+		b.onSubscribe()
+	}
+
+	window := b.DedupWindow
+	if window == 0 {
+		window = DefaultDedupWindow
+	}
+	seen := newSentIDs(window)
+	send := func(ev Event) {
+		if !seen.add(ev.ID) {
+			return
+		}
+		data, err := enc.Encode(ev)
+		if err != nil {
+			return
+		}
+		if ev.ID > 0 {
+			w.Write([]byte("id: " + strconv.FormatUint(ev.ID, 10) + "\n"))
+		}
+		w.Write([]byte("data: "))
+		w.Write(data)
+		w.Write([]byte("\n\n"))
+	}
+	// An opening comment tells clients the stream is up before any event.
+	w.Write([]byte(": ping\n\n"))
+	// Subscribing first means nothing published meanwhile is missed; live
+	// events already covered by the replay are skipped by send.
+	if replay && limit > 0 {
+		for _, ev := range b.replay(afterID, limit, filter) {
+			send(ev)
+		}
+	}
+	flusher.Flush()
+	var heartbeat <-chan time.Time
+	interval := b.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 
-	enc := json.NewEncoder(w)
 	for {
 		select {
 		case <-r.Context().Done():
 			return
+		case <-heartbeat:
+			w.Write([]byte(": ping\n\n"))
+			flusher.Flush()
 		case ev := <-ch:
-			w.Write([]byte("data: "))
-			_ = enc.Encode(ev)
-			w.Write([]byte("\n\n"))
+			if (replay && ev.ID <= afterID) || !filter.Match(ev) {
+				continue
+			}
+			send(ev)
 			flusher.Flush()
 		}
 	}
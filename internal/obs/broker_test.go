@@ -0,0 +1,388 @@
+package obs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveSSE runs the handler until the returned stop func is called, then returns the body.
+func serveSSE(t *testing.T, b *Broker, req *http.Request) (*httptest.ResponseRecorder, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(req.Context())
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.SSEHandler(rr, req.WithContext(ctx))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mu.RLock()
+		n := len(b.subs)
+		b.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return rr, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSSECompactEncodingRoundTrips(t *testing.T) {
+	b := NewBroker()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Accept", "application/x-msgpack")
+	rr, stop := serveSSE(t, b, req)
+
+	sent := Event{
+		Type:           "command",
+		SessionID:      "codex-1",
+		ConversationID: "sess-1",
+		State:          "awaiting_command",
+		StepID:         "step-2",
+		Command:        "printf 'a\\nb'",
+		RawOutput:      strings.Repeat("line\n", 20),
+		Note:           "SUCCESS",
+	}
+	b.Publish(sent)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	if got := rr.Header().Get("X-Event-Encoding"); got != "msgpack" {
+		t.Fatalf("encoding header = %q", got)
+	}
+	var data string
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+			break
+		}
+	}
+	if data == "" {
+		t.Fatalf("no data frame in %q", rr.Body.String())
+	}
+	got, err := DecodeCompact([]byte(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Timestamp.IsZero() {
+		t.Fatalf("timestamp not carried")
+	}
+	got.Timestamp = time.Time{}
+	// The broker numbers events from 1.
+	want := sent
+	want.ID = 1
+	if got != want {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, want)
+	}
+
+	sent = Event{ID: 1 << 40, Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Type: "reply", SessionID: "codex-1"}
+	encoded, err := CompactEncoder{}.Encode(sent)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if got, err = DecodeCompact(encoded); err != nil || !got.Timestamp.Equal(sent.Timestamp) || got.ID != sent.ID || got.Type != sent.Type {
+		t.Fatalf("direct round trip: got %+v, err %v; want %+v", got, err, sent)
+	}
+}
+
+func TestSubscribeUsesConfiguredBufferSize(t *testing.T) {
+	b := NewBroker()
+	def := b.Subscribe()
+	if cap(def) != DefaultBufferSize {
+		t.Fatalf("default buffer = %d, want %d", cap(def), DefaultBufferSize)
+	}
+	b.BufferSize = 3
+	ch := b.Subscribe()
+	if cap(ch) != 3 {
+		t.Fatalf("buffer = %d, want 3", cap(ch))
+	}
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: "step"})
+	}
+	if len(ch) != 3 {
+		t.Fatalf("expected buffer to fill at 3, got %d", len(ch))
+	}
+}
+
+func TestEventCountsByType(t *testing.T) {
+	b := NewBroker()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Publish(Event{Type: "step"})
+			b.Publish(Event{Type: "log"})
+		}()
+	}
+	wg.Wait()
+	b.Publish(Event{Type: "plan"})
+
+	counts := b.EventCounts()
+	if counts["step"] != 10 || counts["log"] != 10 || counts["plan"] != 1 || len(counts) != 3 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+
+	rr := httptest.NewRecorder()
+	b.EventCountsHandler(rr, httptest.NewRequest(http.MethodGet, "/obs/event-counts", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"step":10`) {
+		t.Fatalf("handler = %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestEventsHandlerFiltersByRangeTypeAndSession(t *testing.T) {
+	b := NewBroker()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := base
+	b.now = func() time.Time { return now }
+	for i, ev := range []Event{
+		{Type: "plan", SessionID: "a"},
+		{Type: "step", SessionID: "a"},
+		{Type: "step", SessionID: "b"},
+		{Type: "command", SessionID: "a"},
+		{Type: "step", SessionID: "a"},
+	} {
+		now = base.Add(time.Duration(i) * time.Minute)
+		b.Publish(ev)
+	}
+
+	get := func(query string) []Event {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		b.EventsHandler(rr, httptest.NewRequest(http.MethodGet, "/obs/events?"+query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var out []Event
+		dec := json.NewDecoder(rr.Body)
+		for dec.More() {
+			var ev Event
+			if err := dec.Decode(&ev); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			out = append(out, ev)
+		}
+		return out
+	}
+
+	from := base.Add(time.Minute).Format(time.RFC3339)
+	to := base.Add(4 * time.Minute).Format(time.RFC3339)
+	got := get("from=" + from + "&to=" + to)
+	if len(got) != 3 || got[0].Type != "step" || got[2].Type != "command" {
+		t.Fatalf("range query = %+v", got)
+	}
+	got = get("from=" + from + "&type=step&session=a")
+	if len(got) != 2 || !got[1].Timestamp.Equal(base.Add(4*time.Minute)) {
+		t.Fatalf("filtered query = %+v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	b.EventsHandler(rr, httptest.NewRequest(http.MethodGet, "/obs/events?from=yesterday", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad timestamp status = %d", rr.Code)
+	}
+}
+
+func TestSSEHandlerSendsHeartbeats(t *testing.T) {
+	b := NewBroker()
+	b.HeartbeatInterval = 10 * time.Millisecond
+	rr, stop := serveSSE(t, b, httptest.NewRequest(http.MethodGet, "/events", nil))
+	time.Sleep(55 * time.Millisecond)
+	stop()
+
+	body := rr.Body.String()
+	if !strings.HasPrefix(body, ": ping\n\n") {
+		t.Fatalf("stream should open with a comment, got %q", body)
+	}
+	if n := strings.Count(body, ": ping\n\n"); n < 3 {
+		t.Fatalf("got %d pings in %q, want the opening one plus heartbeats", n, body)
+	}
+}
+
+func TestSSEReplaysRecentEventsToLateSubscribers(t *testing.T) {
+	frames := func(body string) []string {
+		var types []string
+		for _, line := range strings.Split(body, "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var ev Event
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Fatalf("decode %q: %v", data, err)
+				}
+				types = append(types, ev.Type)
+			}
+		}
+		return types
+	}
+	b := NewBroker()
+	for _, typ := range []string{"plan", "approve", "step"} {
+		b.Publish(Event{Type: typ, SessionID: "sess-1"})
+	}
+
+	rr, stop := serveSSE(t, b, httptest.NewRequest(http.MethodGet, "/events?replay=2", nil))
+	time.Sleep(20 * time.Millisecond) // let the replay finish before a live event
+	b.Publish(Event{Type: "command", SessionID: "sess-1"})
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if got := strings.Join(frames(rr.Body.String()), ","); got != "approve,step,command" {
+		t.Fatalf("replay=2 frames = %s", got)
+	}
+	if !strings.Contains(rr.Body.String(), "id: 4\n") {
+		t.Fatalf("frames should carry event ids: %q", rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	rr, stop = serveSSE(t, b, req)
+	stop()
+	if got := strings.Join(frames(rr.Body.String()), ","); got != "approve,step,command" {
+		t.Fatalf("resume after id 1 frames = %s", got)
+	}
+}
+
+func TestSSEReconnectDoesNotDuplicateEventsAcrossReplayAndLive(t *testing.T) {
+	for _, window := range []int{0, 1} {
+		b := NewBroker()
+		b.DedupWindow = window
+		for i := 0; i < 5; i++ {
+			b.Publish(Event{Type: "step", SessionID: "sess-1"})
+		}
+		// Published after the stream subscribed but before its replay is
+		// read, so they reach it both ways.
+		b.onSubscribe = func() {
+			b.Publish(Event{Type: "step", SessionID: "sess-1"})
+			b.Publish(Event{Type: "step", SessionID: "sess-1"})
+		}
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		req.Header.Set("Last-Event-ID", "3")
+		rr, stop := serveSSE(t, b, req)
+		time.Sleep(20 * time.Millisecond)
+		b.Publish(Event{Type: "step", SessionID: "sess-1"})
+		time.Sleep(20 * time.Millisecond)
+		stop()
+
+		var ids []string
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, id)
+			}
+		}
+		if got := strings.Join(ids, ","); got != "4,5,6,7,8" {
+			t.Fatalf("window %d: delivered ids %s, want 4,5,6,7,8 once each", window, got)
+		}
+	}
+}
+
+func TestSSEFiltersBySessionAndType(t *testing.T) {
+	b := NewBroker()
+	b.Publish(Event{Type: "command", SessionID: "sess-1"})
+	b.Publish(Event{Type: "command", SessionID: "sess-2"})
+	b.Publish(Event{Type: "step", SessionID: "sess-1"})
+
+	rr, stop := serveSSE(t, b, httptest.NewRequest(http.MethodGet, "/events?session=sess-1&type=command&replay=1", nil))
+	time.Sleep(20 * time.Millisecond)
+	b.Publish(Event{Type: "command", SessionID: "sess-2", Command: "other"})
+	b.Publish(Event{Type: "log", SessionID: "sess-1"})
+	b.Publish(Event{Type: "command", SessionID: "sess-1", Command: "mine"})
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	var got []string
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev Event
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("decode %q: %v", data, err)
+			}
+			got = append(got, ev.SessionID+"/"+ev.Type+"/"+ev.Command)
+		}
+	}
+	if strings.Join(got, ",") != "sess-1/command/,sess-1/command/mine" {
+		t.Fatalf("filtered stream = %v", got)
+	}
+}
+
+func TestSessionFilterFollowsConversationAcrossSessionReset(t *testing.T) {
+	b := NewBroker()
+	b.Publish(Event{Type: "plan", SessionID: "conv-1", ConversationID: "conv-1"})
+	b.Publish(Event{Type: "step", SessionID: "thread-a", ConversationID: "conv-1", StepID: "s1"})
+	// After a session reset the conversation continues in a new Codex thread.
+	b.Publish(Event{Type: "step", SessionID: "thread-b", ConversationID: "conv-1", StepID: "s2"})
+	b.Publish(Event{Type: "step", SessionID: "thread-c", ConversationID: "conv-2", StepID: "other"})
+
+	var got []string
+	for _, ev := range b.Events(EventFilter{SessionID: "conv-1"}) {
+		got = append(got, ev.Type+"/"+ev.StepID)
+	}
+	if strings.Join(got, ",") != "plan/,step/s1,step/s2" {
+		t.Fatalf("conversation filter = %v", got)
+	}
+	if evs := b.Events(EventFilter{SessionID: "thread-b"}); len(evs) != 1 || evs[0].StepID != "s2" {
+		t.Fatalf("session filter = %+v", evs)
+	}
+}
+
+func TestTransientEventsSkipHistory(t *testing.T) {
+	b := NewBroker()
+	ch := b.Subscribe()
+	defer b.Unsubscribe(ch)
+	b.Publish(Event{Type: "plan", SessionID: "sess-1"})
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: "delta", SessionID: "sess-1", Transient: true})
+	}
+	if got := len(ch); got != 6 {
+		t.Fatalf("live subscriber got %d events, want 6", got)
+	}
+	if evs := b.Events(EventFilter{}); len(evs) != 1 || evs[0].Type != "plan" {
+		t.Fatalf("history = %+v, want only the plan", evs)
+	}
+	if evs := b.replay(0, 1, EventFilter{}); len(evs) != 1 || evs[0].Type != "plan" {
+		t.Fatalf("replay = %+v, want the plan despite later deltas", evs)
+	}
+}
+
+func TestStatsCountDroppedEvents(t *testing.T) {
+	var logs bytes.Buffer
+	b := NewBroker()
+	b.BufferSize = 2
+	b.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	slow := b.Subscribe()
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: "log"})
+	}
+
+	stats := b.Stats()
+	if stats.Dropped != 3 || len(stats.Subscribers) != 1 || stats.Subscribers[0].Dropped != 3 || stats.Subscribers[0].Buffered != 2 {
+		t.Fatalf("stats = %+v, want 3 dropped for the full subscriber", stats)
+	}
+	if n := strings.Count(logs.String(), "dropping events"); n != 1 {
+		t.Fatalf("got %d drop warnings, want one per subscriber:\n%s", n, logs.String())
+	}
+
+	b.Unsubscribe(slow)
+	rr := httptest.NewRecorder()
+	b.StatsHandler(rr, httptest.NewRequest(http.MethodGet, "/obs/stats", nil))
+	var served Stats
+	if err := json.NewDecoder(rr.Body).Decode(&served); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if served.Dropped != 3 || len(served.Subscribers) != 0 {
+		t.Fatalf("served stats = %+v, want the total kept after unsubscribing", served)
+	}
+}
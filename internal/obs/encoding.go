@@ -0,0 +1,243 @@
+package obs
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoder renders an event as a single-line SSE data payload.
+type Encoder interface {
+	Name() string
+	Encode(ev Event) ([]byte, error)
+}
+
+// JSONEncoder is the default encoder; each frame carries the event as JSON.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Name() string { return "json" }
+
+func (JSONEncoder) Encode(ev Event) ([]byte, error) {
+	return json.Marshal(ev)
+}
+
+// CompactEncoder packs the event as a msgpack map of strings and
+// base64-encodes it so it survives the text-only SSE framing. The ID and
+// timestamp are carried as decimal and RFC 3339 strings.
+type CompactEncoder struct{}
+
+func (CompactEncoder) Name() string { return "msgpack" }
+
+func (CompactEncoder) Encode(ev Event) ([]byte, error) {
+	pairs := [][2]string{{"timestamp", ev.Timestamp.Format(time.RFC3339Nano)}}
+	if ev.ID != 0 {
+		pairs = append(pairs, [2]string{"id", strconv.FormatUint(ev.ID, 10)})
+	}
+	for _, f := range eventFields(&ev) {
+		if *f.val != "" {
+			pairs = append(pairs, [2]string{f.key, *f.val})
+		}
+	}
+	buf := appendMapHeader(nil, len(pairs))
+	for _, kv := range pairs {
+		buf = appendString(buf, kv[0])
+		buf = appendString(buf, kv[1])
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(buf)))
+	base64.StdEncoding.Encode(out, buf)
+	return out, nil
+}
+
+// DecodeCompact reverses CompactEncoder.Encode.
+func DecodeCompact(data []byte) (Event, error) {
+	var ev Event
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(buf, data)
+	if err != nil {
+		return ev, fmt.Errorf("decode base64: %w", err)
+	}
+	d := &msgpackReader{buf: buf[:n]}
+	count, err := d.mapHeader()
+	if err != nil {
+		return ev, err
+	}
+	fields := make(map[string]*string)
+	for _, f := range eventFields(&ev) {
+		fields[f.key] = f.val
+	}
+	for i := 0; i < count; i++ {
+		key, err := d.str()
+		if err != nil {
+			return ev, err
+		}
+		val, err := d.str()
+		if err != nil {
+			return ev, err
+		}
+		if key == "id" {
+			id, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return ev, fmt.Errorf("decode id: %w", err)
+			}
+			ev.ID = id
+			continue
+		}
+		if key == "timestamp" {
+			ts, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return ev, fmt.Errorf("decode timestamp: %w", err)
+			}
+			ev.Timestamp = ts
+			continue
+		}
+		if dst, ok := fields[key]; ok {
+			*dst = val
+		}
+	}
+	return ev, nil
+}
+
+// NegotiateEncoder picks the compact encoder when the client asks for msgpack via
+// the Accept header or ?format=msgpack (EventSource cannot set headers).
+func NegotiateEncoder(r *http.Request) Encoder {
+	if r.URL.Query().Get("format") == "msgpack" {
+		return CompactEncoder{}
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/msgpack") || strings.Contains(accept, "application/x-msgpack") {
+		return CompactEncoder{}
+	}
+	return JSONEncoder{}
+}
+
+type eventField struct {
+	key string
+	val *string
+}
+
+// eventFields lists the string fields of ev keyed by their JSON names.
+func eventFields(ev *Event) []eventField {
+	return []eventField{
+		{"type", &ev.Type},
+		{"session_id", &ev.SessionID},
+		{"conversation_id", &ev.ConversationID},
+		{"state", &ev.State},
+		{"prompt", &ev.Prompt},
+		{"model_prompt", &ev.ModelPrompt},
+		{"plan_text", &ev.PlanText},
+		{"step_id", &ev.StepID},
+		{"step_title", &ev.StepTitle},
+		{"command", &ev.Command},
+		{"raw_output", &ev.RawOutput},
+		{"reply", &ev.Reply},
+		{"note", &ev.Note},
+		{"artifact_id", &ev.ArtifactID},
+		{"log", &ev.Log},
+	}
+}
+
+func appendMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, 0xdf), uint32(n))
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= 0xff:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= 0xffff:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+type msgpackReader struct {
+	buf []byte
+	pos int
+}
+
+func (d *msgpackReader) next(n int) ([]byte, error) {
+	if d.pos+n > len(d.buf) {
+		return nil, fmt.Errorf("msgpack: unexpected end of data")
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackReader) mapHeader() (int, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b[0]&0xf0 == 0x80:
+		return int(b[0] & 0x0f), nil
+	case b[0] == 0xde:
+		n, err := d.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint16(n)), nil
+	case b[0] == 0xdf:
+		n, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(n)), nil
+	}
+	return 0, fmt.Errorf("msgpack: expected map, got 0x%02x", b[0])
+}
+
+func (d *msgpackReader) str() (string, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case b[0]&0xe0 == 0xa0:
+		n = int(b[0] & 0x1f)
+	case b[0] == 0xd9:
+		l, err := d.next(1)
+		if err != nil {
+			return "", err
+		}
+		n = int(l[0])
+	case b[0] == 0xda:
+		l, err := d.next(2)
+		if err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint16(l))
+	case b[0] == 0xdb:
+		l, err := d.next(4)
+		if err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint32(l))
+	default:
+		return "", fmt.Errorf("msgpack: expected string, got 0x%02x", b[0])
+	}
+	s, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,164 @@
+package obs
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// DefaultHistorySize is how many recent events a Broker keeps for queries
+// when HistorySize is unset.
+const DefaultHistorySize = 1000
+
+// DefaultReplaySize is how many remembered events SSEHandler replays at most
+// when ReplaySize is unset.
+const DefaultReplaySize = 256
+
+// EventFilter selects events from a Broker's history. Zero fields match
+// everything; From is inclusive and To exclusive. SessionID matches either an
+// event's SessionID or its ConversationID, so filtering by a conversation's
+// ID keeps its step events after the Codex session behind it changes.
+type EventFilter struct {
+	From      time.Time
+	To        time.Time
+	Type      string
+	SessionID string
+}
+
+// Match reports whether ev passes the filter.
+func (f EventFilter) Match(ev Event) bool {
+	if !f.From.IsZero() && ev.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !ev.Timestamp.Before(f.To) {
+		return false
+	}
+	if f.Type != "" && ev.Type != f.Type {
+		return false
+	}
+	if f.SessionID != "" && ev.SessionID != f.SessionID && ev.ConversationID != f.SessionID {
+		return false
+	}
+	return true
+}
+
+// remember gives ev the next ID and, unless it is transient, appends it to
+// the history, dropping the oldest events beyond HistorySize.
+func (b *Broker) remember(ev Event) Event {
+	size := b.HistorySize
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+	b.histMu.Lock()
+	defer b.histMu.Unlock()
+	b.lastID++
+	ev.ID = b.lastID
+	if size < 0 || ev.Transient {
+		return ev
+	}
+	b.history = append(b.history, ev)
+	if over := len(b.history) - size; over > 0 {
+		b.history = append(b.history[:0], b.history[over:]...)
+	}
+	return ev
+}
+
+// replay returns up to limit of the latest remembered events matching f
+// with IDs after afterID, oldest first.
+func (b *Broker) replay(afterID uint64, limit int, f EventFilter) []Event {
+	b.histMu.Lock()
+	defer b.histMu.Unlock()
+	var out []Event
+	for i := len(b.history) - 1; i >= 0 && len(out) < limit && b.history[i].ID > afterID; i-- {
+		if f.Match(b.history[i]) {
+			out = append(out, b.history[i])
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// Events returns the remembered events matching f, oldest first.
+func (b *Broker) Events(f EventFilter) []Event {
+	b.histMu.Lock()
+	defer b.histMu.Unlock()
+	out := make([]Event, 0)
+	for _, ev := range b.history {
+		if f.Match(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// EventsHandler serves remembered events as NDJSON, filtered by the from and
+// to (RFC 3339), type, and session query parameters.
+func (b *Broker) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f := EventFilter{Type: q.Get("type"), SessionID: q.Get("session")}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, p.name+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		*p.dst = t
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, ev := range b.Events(f) {
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+	}
+}
+
+// DefaultDedupWindow is how many sent event IDs an SSE stream remembers when
+// DedupWindow is unset.
+const DefaultDedupWindow = 256
+
+// sentIDs remembers the last size event IDs a stream sent. IDs older than
+// the window are assumed sent; a negative size remembers nothing.
+type sentIDs struct {
+	size  int
+	ids   map[uint64]bool
+	order []uint64
+	// floor is the highest ID dropped from the window.
+	floor uint64
+}
+
+func newSentIDs(size int) *sentIDs {
+	return &sentIDs{size: size, ids: make(map[uint64]bool)}
+}
+
+// add records id and reports whether it is new to the stream. Events
+// without an ID are always new.
+func (s *sentIDs) add(id uint64) bool {
+	if s.size < 0 || id == 0 {
+		return true
+	}
+	if id <= s.floor || s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > s.size {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		delete(s.ids, oldest)
+		s.floor = max(s.floor, oldest)
+	}
+	return true
+}
@@ -1,14 +1,29 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"trill/internal/config"
 	"trill/internal/service"
+	"trill/internal/store"
+	"trill/internal/types"
 )
 
 type Server struct {
 	svc *service.Service
+	// Pretty indents every JSON response; clients can also opt in per request with ?pretty=1.
+	Pretty bool
+	// AdminToken guards /admin/ routes via "Authorization: Bearer <token>"; empty disables them.
+	AdminToken string
+	// Config is reported, redacted, by /admin/config; nil reports 404.
+	Config *config.Config
 }
 
 func New(svc *service.Service) *Server {
@@ -21,12 +36,56 @@ func (s *Server) RegisterMux(mux *http.ServeMux) {
 	mux.HandleFunc("/send", s.handleSend)
 	mux.HandleFunc("/close", s.handleClose)
 	mux.HandleFunc("/conversation", s.handleConversation)
+	mux.HandleFunc("/conversation/status", s.handleConversationStatus)
 	mux.HandleFunc("/conversation/create", s.handleCreateConversation)
+	mux.HandleFunc("/plan", s.handlePlan)
+	mux.HandleFunc("/conversations/bulk-create", s.handleBulkCreate)
 	mux.HandleFunc("/conversation/approve-plan", s.handleApprovePlan)
+	mux.HandleFunc("/conversation/reject-plan", s.handleRejectPlan)
+	mux.HandleFunc("/conversation/update-plan", s.handleUpdatePlan)
 	mux.HandleFunc("/conversation/resume", s.handleResume)
+	mux.HandleFunc("/conversation/abort", s.handleAbort)
 	mux.HandleFunc("/conversation/approve-command", s.handleApproveCommand)
+	mux.HandleFunc("/command/approve", s.handleApproveCommand)
+	mux.HandleFunc("/command/deny", s.handleDenyCommand)
+	mux.HandleFunc("/conversation/cancel-command", s.handleCancelCommand)
+	mux.HandleFunc("/conversation/complete", s.handleComplete)
+	mux.HandleFunc("/conversation/verify-now", s.handleVerifyNow)
+	mux.HandleFunc("/conversation/continue", s.handleContinue)
+	mux.HandleFunc("/conversation/edit-step", s.handleEditStep)
+	mux.HandleFunc("/conversation/restart-from-step", s.handleRestartFromStep)
+	mux.HandleFunc("/conversation/step-timeout", s.handleStepTimeout)
+	mux.HandleFunc("/conversation/priority", s.handlePriority)
+	mux.HandleFunc("/conversation/reset-session", s.handleResetSession)
+	mux.HandleFunc("/conversation/step-prompt", s.handleStepPrompt)
+	mux.HandleFunc("/conversation/step-logs", s.handleStepLogs)
+	mux.HandleFunc("/conversation/chat", s.handleChatMessages)
+	mux.HandleFunc("/conversation/by-codex", s.handleByCodexSession)
 	mux.HandleFunc("/inbox", s.handleInbox)
+	mux.HandleFunc("/inbox/counts", s.handleInboxCounts)
+	mux.HandleFunc("/artifacts", s.handleArtifacts)
+	mux.HandleFunc("/needs-info", s.handleNeedsInfo)
+	mux.HandleFunc("/stuck", s.handleStuck)
 	mux.HandleFunc("/run", s.handleRun)
+	mux.HandleFunc("/admin/prompts/validate", s.requireAdmin(s.handleValidatePrompts))
+	mux.HandleFunc("/admin/config", s.requireAdmin(s.handleConfig))
+	mux.HandleFunc("/conversation/set-state", s.requireAdmin(s.handleSetState))
+}
+
+// requireAdmin rejects requests that don't carry the configured admin token.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
 }
 
 func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
@@ -39,7 +98,7 @@ func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, map[string]string{"id": id})
+	s.writeJSON(w, r, map[string]string{"id": id})
 }
 
 func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
@@ -47,12 +106,38 @@ func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	ids, err := s.svc.List(r.Context())
+	q := r.URL.Query()
+	if !q.Has("limit") && !q.Has("offset") {
+		ids, err := s.svc.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, r, ids)
+		return
+	}
+	var limit, offset int
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &limit}, {"offset", &offset}} {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, p.name+" must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		*p.dst = n
+	}
+	page, err := s.svc.ListPage(r.Context(), limit, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, ids)
+	s.writeJSON(w, r, page)
 }
 
 func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
@@ -69,11 +154,15 @@ func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	call, err := s.svc.Send(r.Context(), payload.ID, payload.Message)
+	if errors.Is(err, service.ErrSendInProgress) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	writeJSON(w, call)
+	s.writeJSON(w, r, call)
 }
 
 func (s *Server) handleClose(w http.ResponseWriter, r *http.Request) {
@@ -114,27 +203,134 @@ func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	writeJSON(w, conv)
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleConversationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	status, err := s.svc.Status(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	s.writeJSON(w, r, status)
 }
 
 func (s *Server) handleCreateConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload createRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.CreateConversationWith(r.Context(), payload.prompt(), payload.Settings)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+// handlePlan creates a conversation and guarantees it stops at
+// awaiting_plan_approval, so someone else can approve it later. Unknown
+// fields such as "auto_approve" are rejected rather than ignored.
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload createRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&payload); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.CreateConversationWith(r.Context(), payload.prompt(), payload.Settings)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if conv.State != types.StateAwaitingPlanApproval {
+		http.Error(w, "plan did not stop at awaiting_plan_approval: "+string(conv.State), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+// maxBulkPrompts caps the goals one bulk create request may carry.
+const maxBulkPrompts = 100
+
+// bulkPrompt is one entry of a bulk create request: either a bare prompt
+// string or an object with a label, auto_approve, and settings.
+type bulkPrompt types.BulkCreateItem
+
+func (p *bulkPrompt) UnmarshalJSON(data []byte) error {
+	var prompt string
+	if err := json.Unmarshal(data, &prompt); err == nil {
+		*p = bulkPrompt{Prompt: prompt}
+		return nil
+	}
+	return json.Unmarshal(data, (*types.BulkCreateItem)(p))
+}
+
+// handleBulkCreate plans a conversation per prompt and reports each one's
+// outcome; individual failures don't fail the request.
+func (s *Server) handleBulkCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	var payload struct {
-		Prompt string `json:"prompt"`
+		Prompts []bulkPrompt `json:"prompts"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	conv, err := s.svc.CreateConversation(r.Context(), payload.Prompt)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if len(payload.Prompts) == 0 {
+		http.Error(w, "prompts is required", http.StatusBadRequest)
 		return
 	}
-	writeJSON(w, conv)
+	if len(payload.Prompts) > maxBulkPrompts {
+		http.Error(w, "at most "+strconv.Itoa(maxBulkPrompts)+" prompts per request", http.StatusBadRequest)
+		return
+	}
+	items := make([]types.BulkCreateItem, len(payload.Prompts))
+	for i, p := range payload.Prompts {
+		items[i] = types.BulkCreateItem(p)
+	}
+	s.writeJSON(w, r, map[string][]types.BulkCreateResult{"results": s.svc.CreateConversations(r.Context(), items)})
+}
+
+// createRequest is the body of /conversation/create and /plan.
+type createRequest struct {
+	Prompt string `json:"prompt"`
+	// Goal is the older name for Prompt; Prompt wins when both are set.
+	Goal     string                     `json:"goal"`
+	Settings types.ConversationSettings `json:"settings"`
+}
+
+func (p createRequest) prompt() string {
+	if strings.TrimSpace(p.Prompt) == "" {
+		return p.Goal
+	}
+	return p.Prompt
 }
 
 func (s *Server) handleApprovePlan(w http.ResponseWriter, r *http.Request) {
@@ -151,13 +347,109 @@ func (s *Server) handleApprovePlan(w http.ResponseWriter, r *http.Request) {
 	}
 	conv, err := s.svc.ApprovePlan(r.Context(), payload.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleUpdatePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID       string `json:"id"`
+		PlanText string `json:"plan_text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.UpdatePlan(r.Context(), payload.ID, payload.PlanText)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
 		return
 	}
-	writeJSON(w, conv)
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleRejectPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID       string `json:"id"`
+		Feedback string `json:"feedback"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.RejectPlan(r.Context(), payload.ID, payload.Feedback)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
 }
 
 func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID              string `json:"id"`
+		ExtraModelCalls int    `json:"extra_model_calls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if payload.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.ResumeWithBudget(r.Context(), payload.ID, payload.ExtraModelCalls)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleAbort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.Abort(r.Context(), payload.ID, payload.Reason)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleCancelCommand(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -169,12 +461,73 @@ func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	conv, err := s.svc.Resume(r.Context(), payload.ID)
+	conv, err := s.svc.CancelRunningCommand(r.Context(), payload.ID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusConflict))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.Complete(r.Context(), payload.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	writeJSON(w, conv)
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleVerifyNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.VerifyNow(r.Context(), payload.ID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleContinue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string `json:"id"`
+		Prompt string `json:"prompt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.Continue(r.Context(), payload.ID, payload.Prompt)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
 }
 
 func (s *Server) handleApproveCommand(w http.ResponseWriter, r *http.Request) {
@@ -190,12 +543,274 @@ func (s *Server) handleApproveCommand(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
+	if payload.ID == "" || payload.StepID == "" {
+		http.Error(w, "id and step_id are required", http.StatusBadRequest)
+		return
+	}
 	conv, err := s.svc.ApproveCommand(r.Context(), payload.ID, payload.StepID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	writeJSON(w, conv)
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleDenyCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string `json:"id"`
+		StepID string `json:"step_id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if payload.ID == "" || payload.StepID == "" {
+		http.Error(w, "id and step_id are required", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.DenyCommand(r.Context(), payload.ID, payload.StepID, payload.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleEditStep(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string `json:"id"`
+		StepID string `json:"step_id"`
+		Title  string `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.EditAndRetryStep(r.Context(), payload.ID, payload.StepID, payload.Title)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleStepTimeout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID             string `json:"id"`
+		StepID         string `json:"step_id"`
+		TimeoutSeconds int    `json:"timeout_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.SetStepTimeout(r.Context(), payload.ID, payload.StepID, payload.TimeoutSeconds)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handlePriority(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		conv, err := s.svc.Get(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, r, map[string]int{"priority": conv.Priority})
+	case http.MethodPost:
+		var payload struct {
+			ID       string `json:"id"`
+			Priority int    `json:"priority"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if payload.ID == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		conv, err := s.svc.SetPriority(r.Context(), payload.ID, payload.Priority)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+			return
+		}
+		s.writeJSON(w, r, conv)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleResetSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if payload.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.ResetSession(r.Context(), payload.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusConflict))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleRestartFromStep(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string `json:"id"`
+		StepID string `json:"step_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.RestartFromStep(r.Context(), payload.ID, payload.StepID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleStepPrompt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	stepID := r.URL.Query().Get("step_id")
+	if id == "" || stepID == "" {
+		http.Error(w, "id and step_id are required", http.StatusBadRequest)
+		return
+	}
+	prompt, err := s.svc.PreviewStepPrompt(r.Context(), id, stepID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, r, map[string]string{"prompt": prompt})
+}
+
+func (s *Server) handleChatMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	msgs, err := s.svc.ChatMessages(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, r, msgs)
+}
+
+func (s *Server) handleStepLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	stepID := r.URL.Query().Get("step_id")
+	if id == "" || stepID == "" {
+		http.Error(w, "id and step_id are required", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("follow") != "1" {
+		conv, err := s.svc.Get(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, step := range s.svc.ForDisplay(conv).Steps {
+			if step.ID == stepID {
+				logs := step.Logs
+				if logs == nil {
+					logs = []string{}
+				}
+				s.writeJSON(w, r, logs)
+				return
+			}
+		}
+		http.Error(w, "step "+stepID+" not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	current, lines, err := s.svc.WatchStepLogs(r.Context(), id, stepID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	writeLine := func(line string) {
+		data, _ := json.Marshal(line)
+		w.Write([]byte("data: "))
+		w.Write(data)
+		w.Write([]byte("\n\n"))
+	}
+	for _, line := range current {
+		writeLine(line)
+	}
+	flusher.Flush()
+	for line := range lines {
+		writeLine(line)
+		flusher.Flush()
+	}
 }
 
 func (s *Server) handleInbox(w http.ResponseWriter, r *http.Request) {
@@ -203,12 +818,155 @@ func (s *Server) handleInbox(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	items, err := s.svc.ListInbox(r.Context())
+	var states map[types.ConversationState]bool
+	for _, raw := range r.URL.Query()["state"] {
+		for _, name := range strings.Split(raw, ",") {
+			state := types.ConversationState(strings.TrimSpace(name))
+			if !state.Valid() {
+				http.Error(w, "unknown state "+string(state), http.StatusBadRequest)
+				return
+			}
+			if states == nil {
+				states = make(map[types.ConversationState]bool)
+			}
+			states[state] = true
+		}
+	}
+	items, err := s.svc.ListInboxStates(r.Context(), states)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, r, items)
+}
+
+func (s *Server) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refs, err := s.svc.AllArtifacts(r.Context(), r.URL.Query().Get("q"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, items)
+	s.writeJSON(w, r, refs)
+}
+
+func (s *Server) handleByCodexSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		http.Error(w, "session is required", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.GetByCodexSession(r.Context(), session)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleNeedsInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	questions, err := s.svc.OutstandingQuestions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, r, questions)
+}
+
+func (s *Server) handleInboxCounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	counts, err := s.svc.InboxCounts(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, r, counts)
+}
+
+func (s *Server) handleStuck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	idle := 300
+	if raw := r.URL.Query().Get("idle_seconds"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "idle_seconds must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		idle = n
+	}
+	convs, err := s.svc.StuckConversations(r.Context(), time.Duration(idle)*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(w, r, convs)
+}
+
+func (s *Server) handleSetState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload struct {
+		ID     string                  `json:"id"`
+		State  types.ConversationState `json:"state"`
+		Reason string                  `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	conv, err := s.svc.SetState(r.Context(), payload.ID, payload.State, payload.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeJSON(w, r, conv)
+}
+
+func (s *Server) handleValidatePrompts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	errs := s.svc.ValidatePrompts()
+	if errs == nil {
+		errs = []service.PromptError{}
+	}
+	s.writeJSON(w, r, map[string]any{"valid": len(errs) == 0, "errors": errs})
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Config == nil {
+		http.Error(w, "configuration not available", http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, r, s.Config.Redacted())
 }
 
 func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
@@ -217,21 +975,77 @@ func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var payload struct {
-		Prompt string `json:"prompt"`
+		Prompt         string `json:"prompt"`
+		TimeoutSeconds int    `json:"timeout_seconds"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	result, err := s.svc.PlanAndExecute(r.Context(), payload.Prompt)
+	ctx := r.Context()
+	if payload.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(payload.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	result, err := s.svc.PlanAndExecute(ctx, payload.Prompt)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 		return
 	}
-	writeJSON(w, map[string]string{"result": result})
+	s.writeJSON(w, r, map[string]string{"result": result})
 }
 
-func writeJSON(w http.ResponseWriter, v interface{}) {
+// errorStatus maps context cancellation to 504, a full work queue to 429, a
+// concurrent abort to 409, and everything else to fallback.
+func errorStatus(err error, fallback int) int {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, service.ErrWorkQueueFull) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, service.ErrAborted) {
+		return http.StatusConflict
+	}
+	return fallback
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	// Conversations and messages carry model-authored text; show it sanitized.
+	switch x := v.(type) {
+	case *types.Conversation:
+		v = s.svc.ForDisplay(x)
+	case []*types.Conversation:
+		out := make([]*types.Conversation, len(x))
+		for i, conv := range x {
+			out[i] = s.svc.ForDisplay(conv)
+		}
+		v = out
+	case []types.Message:
+		v = s.svc.DisplayMessages(x)
+	}
 	w.Header().Set("Content-Type", "application/json")
+	if s.Pretty || wantsPretty(r) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(append(data, '\n'))
+		return
+	}
 	_ = json.NewEncoder(w).Encode(v)
 }
+
+// wantsPretty reports whether the client asked for indented JSON via ?pretty=1.
+func wantsPretty(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	switch r.URL.Query().Get("pretty") {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"trill/internal/config"
+	"trill/internal/obs"
 	"trill/internal/service"
 	"trill/internal/store"
 	"trill/internal/types"
@@ -21,6 +28,8 @@ type scriptedResponse struct {
 	sessionID string
 	duration  int64
 	err       error
+	// gate, when set, holds the reply until it is closed.
+	gate chan struct{}
 }
 
 // scriptedModel is a deterministic codex.Client double that returns queued replies.
@@ -32,13 +41,17 @@ type scriptedModel struct {
 
 func (m *scriptedModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	if len(m.responses) == 0 {
+		m.mu.Unlock()
 		return "", "", sessionID, 0, context.DeadlineExceeded
 	}
 	resp := m.responses[0]
 	m.responses = m.responses[1:]
 	m.prompts = append(m.prompts, prompt)
+	m.mu.Unlock()
+	if resp.gate != nil {
+		<-resp.gate
+	}
 	if resp.sessionID == "" {
 		if sessionID != "" {
 			resp.sessionID = sessionID
@@ -51,13 +64,15 @@ func (m *scriptedModel) Send(ctx context.Context, sessionID, prompt string) (str
 
 type apiHarness struct {
 	handler http.Handler
+	broker  *obs.Broker
 }
 
-func newAPIHarness(model *scriptedModel) *apiHarness {
+func newAPIHarness(model *scriptedModel, opts ...service.Option) *apiHarness {
 	mux := http.NewServeMux()
-	svc := service.New(store.NewMemoryStore(), model, nil)
+	broker := obs.NewBroker()
+	svc := service.New(store.NewMemoryStore(), model, broker, opts...)
 	New(svc).RegisterMux(mux)
-	return &apiHarness{handler: mux}
+	return &apiHarness{handler: mux, broker: broker}
 }
 
 func (a *apiHarness) postJSON(t *testing.T, path string, body any) *http.Response {
@@ -196,6 +211,127 @@ func TestApprovePlanCompletesExecution(t *testing.T) {
 	}
 }
 
+func TestApprovePlanReturnsWhileWorkerExecutes(t *testing.T) {
+	gate := make(chan struct{})
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) verify", raw: "raw-plan", sessionID: "sess-async"},
+			{reply: "SUCCESS: done", raw: "raw-exec", sessionID: "sess-async", gate: gate},
+		},
+	}
+	mux := http.NewServeMux()
+	svc := service.New(store.NewMemoryStore(), model, nil)
+	ctx, stop := context.WithCancel(context.Background())
+	wait := svc.StartWorker(ctx)
+	defer func() {
+		stop()
+		wait()
+	}()
+	New(svc).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	createResp := api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Finish milestone"})
+	var created types.Conversation
+	if err := json.NewDecoder(createResp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create: %v", err)
+	}
+
+	// Execution is gated, so the handler only returns if it didn't wait on it.
+	approveResp := api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": created.SessionID})
+	if approveResp.StatusCode != http.StatusOK {
+		t.Fatalf("approve status = %d", approveResp.StatusCode)
+	}
+	var approved types.Conversation
+	if err := json.NewDecoder(approveResp.Body).Decode(&approved); err != nil {
+		t.Fatalf("decode approve: %v", err)
+	}
+	if approved.State != types.StateExecuting {
+		t.Fatalf("state = %s, want executing", approved.State)
+	}
+
+	close(gate)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conv, err := svc.Get(context.Background(), created.SessionID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if conv.State == types.StateCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("execution never completed in the background, state %s", conv.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunBlocksUntilFinishedWithWorkerRunning(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) verify", raw: "raw-plan", sessionID: "sess-run"},
+			{reply: "SUCCESS: done", raw: "raw-exec", sessionID: "sess-run"},
+		},
+	}
+	mux := http.NewServeMux()
+	svc := service.New(store.NewMemoryStore(), model, nil)
+	ctx, stop := context.WithCancel(context.Background())
+	wait := svc.StartWorker(ctx)
+	defer func() {
+		stop()
+		wait()
+	}()
+	New(svc).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	resp := api.postJSON(t, "/run", map[string]string{"prompt": "Finish milestone"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("run status = %d", resp.StatusCode)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode run: %v", err)
+	}
+	if !strings.HasSuffix(body["result"], "with state "+string(types.StateCompleted)) {
+		t.Fatalf("run should return the finished state, got %q", body["result"])
+	}
+}
+
+func TestContinueCompletedConversation(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) write docs", sessionID: "sess-cont"},
+			{reply: "SUCCESS: docs written"},
+			{reply: "1) publish docs"},
+		},
+	}
+	api := newAPIHarness(model)
+	api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Document the API"})
+	api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": "sess-cont"})
+
+	resp := api.postJSON(t, "/conversation/continue", map[string]string{"id": "sess-cont", "prompt": "Now publish them"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("continue status = %d", resp.StatusCode)
+	}
+	var conv types.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&conv); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if conv.SessionID != "sess-cont" || conv.PlanVersion != 2 || conv.State != types.StateAwaitingPlanApproval {
+		t.Fatalf("unexpected continued conversation: id=%s version=%d state=%s", conv.SessionID, conv.PlanVersion, conv.State)
+	}
+	if len(conv.Steps) != 1 || conv.Steps[0].Title != "1) publish docs" || conv.CompletedMessage != "" {
+		t.Fatalf("follow-up plan not applied: %+v", conv)
+	}
+	if !strings.Contains(model.prompts[2], "Now publish them") {
+		t.Fatalf("follow-up prompt not sent to the model: %q", model.prompts[2])
+	}
+
+	if resp := api.postJSON(t, "/conversation/continue", map[string]string{"id": "sess-cont", "prompt": "again"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("continuing an open conversation status = %d", resp.StatusCode)
+	}
+}
+
 func TestSendCreatesChatConversation(t *testing.T) {
 	model := &scriptedModel{
 		responses: []scriptedResponse{
@@ -244,3 +380,607 @@ func TestSendCreatesChatConversation(t *testing.T) {
 		t.Fatalf("unexpected prompts sent: %v", model.prompts)
 	}
 }
+
+func TestConversationPrettyJSON(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{{reply: "1) plan step", sessionID: "sess-pretty"}},
+	}
+	api := newAPIHarness(model)
+	if resp := api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Pretty please"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("create status = %d", resp.StatusCode)
+	}
+
+	compact := api.get(t, "/conversation?id=sess-pretty")
+	var compactBody bytes.Buffer
+	compactBody.ReadFrom(compact.Body)
+	if strings.Contains(compactBody.String(), "\n  ") {
+		t.Fatalf("default output should be compact, got %q", compactBody.String())
+	}
+
+	pretty := api.get(t, "/conversation?id=sess-pretty&pretty=1")
+	var prettyBody bytes.Buffer
+	prettyBody.ReadFrom(pretty.Body)
+	if !strings.Contains(prettyBody.String(), "\n  \"session_id\": \"sess-pretty\"") {
+		t.Fatalf("expected indented output, got %q", prettyBody.String())
+	}
+	var conv types.Conversation
+	if err := json.Unmarshal(prettyBody.Bytes(), &conv); err != nil {
+		t.Fatalf("pretty output should still decode: %v", err)
+	}
+}
+
+func TestStepPromptPreview(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{{reply: "1) Write the changelog\n2) Tag the release", sessionID: "sess-preview"}},
+	}
+	api := newAPIHarness(model)
+	if resp := api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Cut a release"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("create status = %d", resp.StatusCode)
+	}
+
+	resp := api.get(t, "/conversation/step-prompt?id=sess-preview&step_id=step-2")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("preview status = %d", resp.StatusCode)
+	}
+	var body struct {
+		Prompt string `json:"prompt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !strings.Contains(body.Prompt, "Step: 2) Tag the release") || !strings.Contains(body.Prompt, "1) Write the changelog\n2) Tag the release") {
+		t.Fatalf("preview missing step title or plan: %q", body.Prompt)
+	}
+	if len(model.prompts) != 1 {
+		t.Fatalf("preview must not call the model, prompts sent: %d", len(model.prompts))
+	}
+
+	if resp := api.get(t, "/conversation/step-prompt?id=sess-preview&step_id=step-9"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown step status = %d", resp.StatusCode)
+	}
+}
+
+func TestConversationChatExport(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) Write the changelog\n2) Tag the release", sessionID: "sess-chat"},
+			{reply: "SUCCESS: changelog written"},
+			{reply: "SUCCESS: tagged v1.2.0"},
+		},
+	}
+	api := newAPIHarness(model)
+	api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Cut a release"})
+	if resp := api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": "sess-chat"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve status = %d", resp.StatusCode)
+	}
+
+	resp := api.get(t, "/conversation/chat?id=sess-chat")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat status = %d", resp.StatusCode)
+	}
+	var msgs []types.Message
+	if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(msgs) != 7 || msgs[0].Role != "system" || !strings.Contains(msgs[0].Content, "Cut a release") {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	for i := 1; i < len(msgs); i++ {
+		want := "user"
+		if i%2 == 0 {
+			want = "assistant"
+		}
+		if msgs[i].Role != want {
+			t.Fatalf("message %d role = %s, want %s: %+v", i, msgs[i].Role, want, msgs)
+		}
+	}
+	if !strings.Contains(msgs[2].Content, "2) Tag the release") {
+		t.Fatalf("plan missing from assistant turn: %q", msgs[2].Content)
+	}
+	if !strings.Contains(msgs[6].Content, "tagged v1.2.0") {
+		t.Fatalf("step reply missing: %q", msgs[6].Content)
+	}
+
+	if resp := api.get(t, "/conversation/chat?id=missing"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing conversation status = %d", resp.StatusCode)
+	}
+}
+
+func TestEmptyListsEncodeAsArrays(t *testing.T) {
+	api := newAPIHarness(&scriptedModel{})
+	for _, path := range []string{"/inbox", "/list", "/stuck"} {
+		resp := api.get(t, path)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s status = %d", path, resp.StatusCode)
+		}
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		if got := strings.TrimSpace(body.String()); got != "[]" {
+			t.Fatalf("%s body = %q, want []", path, got)
+		}
+	}
+}
+
+func TestStepLogsFollowStreamsNewLines(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) build the binary", sessionID: "sess-logs"},
+			{reply: "SUCCESS: built ./trill"},
+		},
+	}
+	api := newAPIHarness(model)
+	srv := httptest.NewServer(api.handler)
+	defer srv.Close()
+	if resp := api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Build"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("create status = %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/conversation/step-logs?id=sess-logs&step_id=step-1&follow=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("follow status = %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if approve := api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": "sess-logs"}); approve.StatusCode != http.StatusOK {
+		t.Fatalf("approve status = %d", approve.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var logLine string
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &logLine); err != nil {
+			t.Fatalf("decode frame %q: %v", line, err)
+		}
+		if logLine == "SUCCESS: built ./trill" {
+			return
+		}
+	}
+	t.Fatalf("log line never streamed: %v", scanner.Err())
+}
+
+func TestValidatePromptsRequiresAdminToken(t *testing.T) {
+	mux := http.NewServeMux()
+	svc := service.New(store.NewMemoryStore(), &scriptedModel{}, nil)
+	srv := New(svc)
+	srv.AdminToken = "s3cret"
+	srv.RegisterMux(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/prompts/validate", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("missing token status = %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/prompts/validate", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("validate status = %d", rr.Code)
+	}
+	var body struct {
+		Valid  bool                  `json:"valid"`
+		Errors []service.PromptError `json:"errors"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !body.Valid || len(body.Errors) != 0 {
+		t.Fatalf("unexpected validation result: %+v", body)
+	}
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+	mux := http.NewServeMux()
+	svc := service.New(store.NewMemoryStore(), &scriptedModel{}, nil)
+	srv := New(svc)
+	srv.AdminToken = "s3cret"
+	srv.Config = &config.Config{Port: ":8080", ObsPort: ":9090", AdminToken: "s3cret"}
+	srv.RegisterMux(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("config status = %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "s3cret") {
+		t.Fatalf("admin token leaked: %s", rr.Body.String())
+	}
+	var body config.Config
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body.Port != ":8080" || body.ObsPort != ":9090" {
+		t.Fatalf("ports = %q, %q", body.Port, body.ObsPort)
+	}
+	if body.AdminToken != "[redacted]" {
+		t.Fatalf("admin token = %q, want redacted", body.AdminToken)
+	}
+}
+
+func TestCommandApproveRoute(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) print a greeting", raw: "raw-plan", sessionID: "sess-cmd"},
+			{reply: "COMMAND: echo hi", raw: "raw-exec", sessionID: "sess-cmd"},
+			{reply: "SUCCESS: printed", raw: "raw-exec-2", sessionID: "sess-cmd"},
+		},
+	}
+	api := newAPIHarness(model)
+
+	api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Greet"})
+	approveResp := api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": "sess-cmd"})
+	var waiting types.Conversation
+	if err := json.NewDecoder(approveResp.Body).Decode(&waiting); err != nil {
+		t.Fatalf("decode approve plan: %v", err)
+	}
+	if waiting.State != types.StateAwaitingCommand || len(waiting.Steps) == 0 {
+		t.Fatalf("state = %s, want awaiting_command", waiting.State)
+	}
+
+	missing := api.postJSON(t, "/command/approve", map[string]string{"id": "sess-cmd"})
+	if missing.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing step_id status = %d, want 400", missing.StatusCode)
+	}
+
+	resp := api.postJSON(t, "/command/approve", map[string]string{"id": "sess-cmd", "step_id": waiting.Steps[0].ID})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve command status = %d", resp.StatusCode)
+	}
+	var updated types.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil {
+		t.Fatalf("decode approve command: %v", err)
+	}
+	if updated.State != types.StateCompleted {
+		t.Fatalf("state = %s, want completed", updated.State)
+	}
+}
+
+func TestResumeDistinguishesUnknownAndNotResumable(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{{reply: "1) verify", raw: "raw-plan", sessionID: "sess-resume"}},
+	}
+	api := newAPIHarness(model)
+	api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Verify"})
+
+	resp := api.postJSON(t, "/conversation/resume", map[string]string{"id": "missing"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown id status = %d, want 404", resp.StatusCode)
+	}
+	// Waiting for plan approval isn't a paused execution, so it can't be resumed.
+	resp = api.postJSON(t, "/conversation/resume", map[string]string{"id": "sess-resume"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("not resumable status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestCreateConversationAcceptsGoalOrPrompt(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) plan step", sessionID: "sess-goal"},
+			{reply: "1) plan step", sessionID: "sess-both"},
+		},
+	}
+	api := newAPIHarness(model)
+
+	resp := api.postJSON(t, "/conversation/create", map[string]string{"goal": "Legacy goal"})
+	var created types.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if created.Prompt != "Legacy goal" {
+		t.Fatalf("prompt = %q, want the goal field", created.Prompt)
+	}
+
+	resp = api.postJSON(t, "/conversation/create", map[string]string{"goal": "Old", "prompt": "New"})
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if created.Prompt != "New" {
+		t.Fatalf("prompt = %q, want prompt to win over goal", created.Prompt)
+	}
+
+	resp = api.postJSON(t, "/conversation/create", map[string]string{})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("empty create status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestPlanStopsAtAwaitingApproval(t *testing.T) {
+	model := &scriptedModel{
+		responses: []scriptedResponse{
+			{reply: "1) verify", sessionID: "sess-plan"},
+			{reply: "SUCCESS: should never run", sessionID: "sess-plan"},
+		},
+	}
+	mux := http.NewServeMux()
+	svc := service.New(store.NewMemoryStore(), model, nil, service.WithStepArtifacts(true))
+	ctx, stop := context.WithCancel(context.Background())
+	wait := svc.StartWorker(ctx)
+	defer func() {
+		stop()
+		wait()
+	}()
+	New(svc).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	resp := api.postJSON(t, "/plan", map[string]any{"prompt": "Ship it", "auto_approve": true})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("auto_approve status = %d, want 400", resp.StatusCode)
+	}
+
+	resp = api.postJSON(t, "/plan", map[string]string{"prompt": "Ship it"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("plan status = %d", resp.StatusCode)
+	}
+	var planned types.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&planned); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if planned.State != types.StateAwaitingPlanApproval {
+		t.Fatalf("state = %s, want awaiting_plan_approval", planned.State)
+	}
+	conv, err := svc.Get(context.Background(), "sess-plan")
+	if err != nil {
+		t.Fatalf("plan not persisted: %v", err)
+	}
+	if conv.State != types.StateAwaitingPlanApproval || len(conv.ModelCalls) != 1 {
+		t.Fatalf("stored state = %s with %d model calls; want only the planning call", conv.State, len(conv.ModelCalls))
+	}
+}
+
+func TestListPaginatesSortedIDs(t *testing.T) {
+	st := store.NewMemoryStore()
+	for _, id := range []string{"sess-c", "sess-a", "sess-e", "sess-b", "sess-d"} {
+		if err := st.Save(context.Background(), &types.Conversation{SessionID: id}); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+	mux := http.NewServeMux()
+	New(service.New(st, &scriptedModel{}, nil)).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	var all []string
+	if err := json.NewDecoder(api.get(t, "/list").Body).Decode(&all); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if strings.Join(all, ",") != "sess-a,sess-b,sess-c,sess-d,sess-e" {
+		t.Fatalf("unpaged list = %v", all)
+	}
+
+	var page types.ListPage
+	if err := json.NewDecoder(api.get(t, "/list?limit=2&offset=2").Body).Decode(&page); err != nil {
+		t.Fatalf("decode page: %v", err)
+	}
+	if strings.Join(page.IDs, ",") != "sess-c,sess-d" || page.Total != 5 || page.NextOffset != 4 {
+		t.Fatalf("page = %+v", page)
+	}
+	page = types.ListPage{}
+	if err := json.NewDecoder(api.get(t, "/list?limit=2&offset=4").Body).Decode(&page); err != nil {
+		t.Fatalf("decode last page: %v", err)
+	}
+	if strings.Join(page.IDs, ",") != "sess-e" || page.NextOffset != 0 {
+		t.Fatalf("last page = %+v", page)
+	}
+	if resp := api.get(t, "/list?limit=-1"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative limit status = %d", resp.StatusCode)
+	}
+}
+
+func TestInboxFiltersByState(t *testing.T) {
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	for _, conv := range []*types.Conversation{
+		{SessionID: "sess-plan", State: types.StateAwaitingPlanApproval},
+		{SessionID: "sess-cmd", State: types.StateAwaitingCommand, Steps: []types.Step{{ID: "step-1", PendingCommand: "make"}}},
+		{SessionID: "sess-step", State: types.StateAwaitingStepApproval},
+	} {
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+	mux := http.NewServeMux()
+	New(service.New(st, &scriptedModel{}, nil)).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	sessions := func(path string) []string {
+		t.Helper()
+		resp := api.get(t, path)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s status = %d", path, resp.StatusCode)
+		}
+		var items []types.InboxItem
+		if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		ids := make([]string, len(items))
+		for i, item := range items {
+			ids[i] = item.SessionID
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if got := sessions("/inbox"); len(got) != 3 {
+		t.Fatalf("unfiltered inbox = %v", got)
+	}
+	if got := sessions("/inbox?state=awaiting_command"); strings.Join(got, ",") != "sess-cmd" {
+		t.Fatalf("filtered inbox = %v", got)
+	}
+	if got := sessions("/inbox?state=awaiting_command&state=awaiting_plan_approval"); strings.Join(got, ",") != "sess-cmd,sess-plan" {
+		t.Fatalf("multi-state inbox = %v", got)
+	}
+	if resp := api.get(t, "/inbox?state=bogus"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown state status = %d", resp.StatusCode)
+	}
+}
+
+func TestConversationStatusIsMinimalAndTracksState(t *testing.T) {
+	api := newAPIHarness(&scriptedModel{responses: []scriptedResponse{
+		{reply: "1) build it", sessionID: "sess-status"},
+		{reply: "COMMAND: make", sessionID: "sess-status"},
+	}})
+	resp := api.postJSON(t, "/conversation/create", map[string]string{"prompt": "Build the project"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create status = %d", resp.StatusCode)
+	}
+	var conv types.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&conv); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	status := func() map[string]any {
+		t.Helper()
+		resp := api.get(t, "/conversation/status?id="+conv.SessionID)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code = %d", resp.StatusCode)
+		}
+		var fields map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return fields
+	}
+	fields := status()
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "awaiting_reason,plan_version,state,updated_at" {
+		t.Fatalf("status fields = %s", got)
+	}
+	if fields["state"] != string(types.StateAwaitingPlanApproval) {
+		t.Fatalf("state = %v", fields["state"])
+	}
+
+	if resp := api.postJSON(t, "/conversation/approve-plan", map[string]string{"id": conv.SessionID}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve status = %d", resp.StatusCode)
+	}
+	fields = status()
+	if fields["state"] != string(types.StateAwaitingCommand) || fields["pending_command"] != "make" {
+		t.Fatalf("status after approval = %v", fields)
+	}
+	if resp := api.get(t, "/conversation/status?id=missing"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown id status = %d", resp.StatusCode)
+	}
+
+	// A store outage is not a missing conversation.
+	mux := http.NewServeMux()
+	New(service.New(unavailableStore{store.NewMemoryStore()}, &scriptedModel{}, nil)).RegisterMux(mux)
+	down := &apiHarness{handler: mux}
+	if resp := down.get(t, "/conversation/status?id="+conv.SessionID); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("store outage status = %d, want 500", resp.StatusCode)
+	}
+}
+
+// unavailableStore fails every read, like a database that is down.
+type unavailableStore struct {
+	*store.MemoryStore
+}
+
+func (unavailableStore) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestInboxOrdersByPriorityThenAge(t *testing.T) {
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	old := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, conv := range []*types.Conversation{
+		{SessionID: "sess-old", State: types.StateAwaitingPlanApproval, LastActivityAt: old},
+		{SessionID: "sess-new", State: types.StateAwaitingPlanApproval, LastActivityAt: old.Add(time.Hour)},
+		{SessionID: "sess-newest", State: types.StateAwaitingPlanApproval, LastActivityAt: old.Add(2 * time.Hour)},
+	} {
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+	mux := http.NewServeMux()
+	New(service.New(st, &scriptedModel{}, nil)).RegisterMux(mux)
+	api := &apiHarness{handler: mux}
+
+	order := func() string {
+		t.Helper()
+		var items []types.InboxItem
+		if err := json.NewDecoder(api.get(t, "/inbox").Body).Decode(&items); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		ids := make([]string, len(items))
+		for i, item := range items {
+			ids[i] = item.SessionID
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := order(); got != "sess-old,sess-new,sess-newest" {
+		t.Fatalf("equal priorities should list the longest waiting first, got %s", got)
+	}
+
+	for id, priority := range map[string]int{"sess-newest": 5, "sess-new": 1} {
+		resp := api.postJSON(t, "/conversation/priority", map[string]any{"id": id, "priority": priority})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("set priority %s: status %d", id, resp.StatusCode)
+		}
+	}
+	if got := order(); got != "sess-newest,sess-new,sess-old" {
+		t.Fatalf("inbox should order by priority first, got %s", got)
+	}
+	var got struct{ Priority int }
+	if err := json.NewDecoder(api.get(t, "/conversation/priority?id=sess-newest").Body).Decode(&got); err != nil || got.Priority != 5 {
+		t.Fatalf("priority read back = %d (%v), want 5", got.Priority, err)
+	}
+	if resp := api.postJSON(t, "/conversation/priority", map[string]any{"id": "missing", "priority": 1}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown id status = %d", resp.StatusCode)
+	}
+}
+
+func TestBulkCreatePlansEachPromptAndReportsResults(t *testing.T) {
+	api := newAPIHarness(&scriptedModel{responses: []scriptedResponse{
+		{reply: "1) build it", sessionID: "sess-build"},
+		{reply: "1) test it", sessionID: "sess-test"},
+		{reply: "1) deploy it", sessionID: "sess-deploy"},
+		{reply: "SUCCESS: deployed"},
+	}}, service.WithPlanConcurrency(1))
+	resp := api.postJSON(t, "/conversations/bulk-create", map[string]any{"prompts": []any{
+		"Build the project",
+		map[string]any{"prompt": "Run the tests", "label": "tests"},
+		map[string]any{"prompt": "Deploy", "label": "deploy", "auto_approve": true},
+	}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bulk create status = %d", resp.StatusCode)
+	}
+	var body struct {
+		Results []types.BulkCreateResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []types.BulkCreateResult{
+		{SessionID: "sess-build", State: types.StateAwaitingPlanApproval},
+		{Label: "tests", SessionID: "sess-test", State: types.StateAwaitingPlanApproval},
+		{Label: "deploy", SessionID: "sess-deploy", State: types.StateCompleted},
+	}
+	if !reflect.DeepEqual(body.Results, want) {
+		t.Fatalf("results = %+v, want %+v", body.Results, want)
+	}
+	for _, result := range want {
+		if resp := api.get(t, "/conversation?id="+result.SessionID); resp.StatusCode != http.StatusOK {
+			t.Fatalf("conversation %s not stored: %d", result.SessionID, resp.StatusCode)
+		}
+	}
+	if resp := api.postJSON(t, "/conversations/bulk-create", map[string]any{"prompts": []string{}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("empty bulk create status = %d, want 400", resp.StatusCode)
+	}
+}
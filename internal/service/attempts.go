@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"trill/internal/obs"
+	"trill/internal/types"
+)
+
+// attemptNumber is conv's 1-based attempt; conversations from before
+// attempts were tracked count as the first.
+func attemptNumber(conv *types.Conversation) int {
+	if conv.Attempt > 0 {
+		return conv.Attempt
+	}
+	return 1
+}
+
+// verifyReplansExhausted reports whether conv has failed verification more
+// times than WithMaxVerifyReplans allows replanning for.
+func (s *Service) verifyReplansExhausted(conv *types.Conversation) bool {
+	return s.maxVerifyReplans > 0 && conv.VerifyFailures > s.maxVerifyReplans
+}
+
+// restartAttempt gives up on conv after repeated verification failures. While
+// WithMaxAttempts allows, it plans the original prompt afresh in a new
+// conversation (and model session) and aborts conv with a link to it, so the
+// failed attempt stays readable. Otherwise conv is blocked for a human.
+func (s *Service) restartAttempt(ctx context.Context, conv *types.Conversation, reply string) (*types.Conversation, error) {
+	attempt := attemptNumber(conv)
+	if attempt >= s.maxAttempts {
+		conv.State = types.StateBlocked
+		conv.AwaitingReason = fmt.Sprintf("Verification failed %d times on attempt %d of %d: %s", conv.VerifyFailures, attempt, max(s.maxAttempts, 1), reply)
+		if err := s.save(ctx, conv); err != nil {
+			return nil, err
+		}
+		return conv, nil
+	}
+	// The cached plan for this prompt may be the one that just failed.
+	next, err := s.createConversation(ctx, conv.Prompt, conv.Settings, false)
+	if err != nil {
+		return nil, fmt.Errorf("restart attempt %d: %w", attempt+1, err)
+	}
+	next.Attempt = attempt + 1
+	next.PriorAttempts = append(append([]string(nil), conv.PriorAttempts...), conv.SessionID)
+	if err := s.save(ctx, next); err != nil {
+		return nil, err
+	}
+	conv.RestartedAs = next.SessionID
+	reason := fmt.Sprintf("Verification failed %d times; restarted from the original prompt as attempt %d (%s)", conv.VerifyFailures, next.Attempt, next.SessionID)
+	if err := s.abort(ctx, conv, reason); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:      "attempt",
+		SessionID: next.SessionID,
+		Prompt:    next.Prompt,
+		Note:      fmt.Sprintf("Attempt %d, restarted from %s", next.Attempt, conv.SessionID),
+	})
+	return conv, nil
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"trill/internal/obs"
+	"trill/internal/types"
+)
+
+// ErrModelCallBudget is returned when a user-initiated request would need a
+// model call that the conversation's budget no longer allows.
+var ErrModelCallBudget = errors.New("model-call budget exhausted")
+
+// modelCallLimit is the number of model calls conv may make in total: its own
+// raised budget if it has one, otherwise WithMaxModelCalls. Zero means unlimited.
+func (s *Service) modelCallLimit(conv *types.Conversation) int {
+	if conv.ModelCallBudget > 0 {
+		return conv.ModelCallBudget
+	}
+	return s.maxModelCalls
+}
+
+// checkModelCallBudget reports ErrModelCallBudget once conv has used its budget.
+func (s *Service) checkModelCallBudget(conv *types.Conversation) error {
+	limit := s.modelCallLimit(conv)
+	if limit <= 0 || len(conv.ModelCalls) < limit {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d calls used", ErrModelCallBudget, len(conv.ModelCalls), limit)
+}
+
+// blockOnBudget parks conv in StateBlocked until someone resumes it, usually
+// with extra calls. The caller has already found the budget exhausted.
+func (s *Service) blockOnBudget(ctx context.Context, conv *types.Conversation, budgetErr error) (*types.Conversation, error) {
+	conv.State = types.StateBlocked
+	conv.AwaitingReason = fmt.Sprintf("Execution blocked: %v; resume with extra_model_calls to continue", budgetErr)
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	ev := obs.Event{
+		Type:      "budget",
+		SessionID: conv.SessionID,
+		Prompt:    conv.Prompt,
+		Note:      conv.AwaitingReason,
+	}
+	if step := currentStep(conv); step != nil {
+		ev.StepID = step.ID
+		ev.StepTitle = step.Title
+	}
+	s.emit(ev)
+	return conv, nil
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"trill/internal/types"
+)
+
+// CreateConversations plans a conversation for each item, approving the plans
+// of items that ask for it. Planning shares the service-wide bound set by
+// WithPlanConcurrency with every other create; items are handed out in order
+// to that many workers so a large batch doesn't park a goroutine per item.
+// Results line up with items; one item failing does not stop the rest.
+func (s *Service) CreateConversations(ctx context.Context, items []types.BulkCreateItem) []types.BulkCreateResult {
+	results := make([]types.BulkCreateResult, len(items))
+	workers := s.planConcurrency
+	if workers <= 0 {
+		workers = len(items)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(items); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = s.createOne(ctx, items[i])
+			}
+		}()
+	}
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// createOne plans item, approving the plan when it asks for that.
+func (s *Service) createOne(ctx context.Context, item types.BulkCreateItem) types.BulkCreateResult {
+	result := types.BulkCreateResult{Label: item.Label}
+	conv, err := s.CreateConversationWith(ctx, item.Prompt, item.Settings)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.SessionID = conv.SessionID
+	result.State = conv.State
+	if !item.AutoApprove {
+		return result
+	}
+	approved, err := s.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		result.Error = "approve: " + err.Error()
+		return result
+	}
+	result.State = approved.State
+	return result
+}
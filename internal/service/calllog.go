@@ -0,0 +1,47 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"trill/internal/types"
+)
+
+// callRecord is one call log line.
+type callRecord struct {
+	Time           time.Time `json:"time"`
+	ConversationID string    `json:"conversation_id"`
+	SessionID      string    `json:"session_id"`
+	Phase          string    `json:"phase"`
+	DurationMS     int64     `json:"duration_ms"`
+	TotalTokens    int       `json:"total_tokens,omitempty"`
+	Prompt         string    `json:"prompt"`
+	Reply          string    `json:"reply"`
+}
+
+// logCall writes call to the call log as one JSON line. It runs before
+// WithPromptStorage and LogVerbosity trim the stored call, so the log keeps the
+// full prompt and reply; write failures are logged and otherwise ignored.
+func (s *Service) logCall(conv *types.Conversation, call types.ModelCall) {
+	if s.callLog == nil {
+		return
+	}
+	line, err := json.Marshal(callRecord{
+		Time:           call.Timestamp,
+		ConversationID: conv.SessionID,
+		SessionID:      call.SessionID,
+		Phase:          call.Phase,
+		DurationMS:     call.DurationMS,
+		TotalTokens:    call.TotalTokens,
+		Prompt:         call.Prompt,
+		Reply:          call.Reply,
+	})
+	if err != nil {
+		return
+	}
+	s.callLogMu.Lock()
+	defer s.callLogMu.Unlock()
+	if _, err := s.callLog.Write(append(line, '\n')); err != nil {
+		s.logger().Warn("model call log write failed", "error", err)
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"trill/internal/codex"
+	"trill/internal/types"
+)
+
+// CommandRunner executes an approved command and returns its combined output.
+type CommandRunner interface {
+	Run(ctx context.Context, command string) ([]byte, error)
+}
+
+// ShellRunner hands commands to a shell, e.g. `sh -c`, `bash -c`, or `powershell -Command`.
+type ShellRunner struct {
+	Shell string
+	Args  []string
+	// Dir is where commands run; empty means the server's directory. A
+	// conversation's WorkDir setting overrides it.
+	Dir string
+}
+
+// DefaultShellRunner runs commands with `sh -c`.
+func DefaultShellRunner() *ShellRunner {
+	return &ShellRunner{Shell: "sh", Args: []string{"-c"}}
+}
+
+// ParseShellRunner builds a runner from a spec such as "bash -c" or "powershell -Command".
+func ParseShellRunner(spec string) (*ShellRunner, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("shell spec is empty")
+	}
+	return &ShellRunner{Shell: fields[0], Args: fields[1:]}, nil
+}
+
+func (r *ShellRunner) Run(ctx context.Context, command string) ([]byte, error) {
+	args := append(append([]string{}, r.Args...), command)
+	cmd := exec.CommandContext(ctx, r.Shell, args...)
+	cmd.Dir = codex.WorkDir(ctx, r.Dir)
+	// Background children can hold the output pipe open after the shell is
+	// killed; don't wait on them forever.
+	cmd.WaitDelay = time.Second
+	return cmd.CombinedOutput()
+}
+
+// CommandPolicy refuses approved commands that match a deny pattern, before
+// they reach the runner.
+type CommandPolicy struct {
+	patterns []string
+	deny     []*regexp.Regexp
+}
+
+// NewCommandPolicy compiles deny patterns once. A pattern matches as a plain
+// substring, e.g. "rm -rf" or ":(){"; prefix it with "re:" for a regular
+// expression such as `re:\bdd\s+if=`. Surrounding whitespace is trimmed, so
+// a list split from "rm -rf, mkfs" works as written; use a regular
+// expression when the whitespace matters, e.g. `re:\bdd\s`.
+func NewCommandPolicy(patterns []string) (*CommandPolicy, error) {
+	p := &CommandPolicy{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(pattern)
+		if raw, ok := strings.CutPrefix(pattern, "re:"); ok {
+			expr = raw
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("deny pattern %q: %w", pattern, err)
+		}
+		p.patterns = append(p.patterns, pattern)
+		p.deny = append(p.deny, re)
+	}
+	return p, nil
+}
+
+// Check returns an error naming the first deny pattern command matches. A nil
+// policy allows everything.
+func (p *CommandPolicy) Check(command string) error {
+	if p == nil {
+		return nil
+	}
+	for i, re := range p.deny {
+		if re.MatchString(command) {
+			return fmt.Errorf("command matches deny pattern %q", p.patterns[i])
+		}
+	}
+	return nil
+}
+
+// errCommandCanceled is the cancel cause recorded when a user stops a running command.
+var errCommandCanceled = errors.New("command canceled by user")
+
+// ErrAborted is returned by operations whose conversation was aborted while
+// they ran, and is the cancel cause of its running command.
+var ErrAborted = errors.New("conversation aborted")
+
+// runningCommand tracks an approved command while it executes.
+type runningCommand struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// trackCommand registers a cancelable context for the command running in sessionID.
+// The returned func, safe to call more than once, must be called once the
+// command's result has been saved.
+func (s *Service) trackCommand(ctx context.Context, sessionID string) (context.Context, func()) {
+	cmdCtx, cancel := context.WithCancelCause(ctx)
+	rc := &runningCommand{cancel: cancel, done: make(chan struct{})}
+	s.mu.Lock()
+	if s.commands == nil {
+		s.commands = make(map[string]*runningCommand)
+	}
+	s.commands[sessionID] = rc
+	s.mu.Unlock()
+	var once sync.Once
+	return cmdCtx, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if s.commands[sessionID] == rc {
+				delete(s.commands, sessionID)
+			}
+			s.mu.Unlock()
+			cancel(nil)
+			close(rc.done)
+		})
+	}
+}
+
+// CancelRunningCommand stops the approved command currently executing for
+// sessionID. The step is left blocked with whatever output the command
+// produced before it was stopped.
+func (s *Service) CancelRunningCommand(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	s.mu.Lock()
+	rc := s.commands[sessionID]
+	s.mu.Unlock()
+	if rc == nil {
+		return nil, fmt.Errorf("no command running for %s", sessionID)
+	}
+	rc.cancel(errCommandCanceled)
+	select {
+	case <-rc.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.store.Get(ctx, sessionID)
+}
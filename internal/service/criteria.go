@@ -0,0 +1,112 @@
+package service
+
+import (
+	"strings"
+
+	"trill/internal/types"
+)
+
+// normalizeCriterion reduces a criterion to a matching key: list markers,
+// case, repeated whitespace, and trailing punctuation are ignored, so
+// "Code compiles." and "- code compiles" compare equal.
+func normalizeCriterion(c string) string {
+	c = strings.TrimSpace(c)
+	c = strings.TrimLeft(c, "-*• ")
+	c = strings.ToLower(strings.Join(strings.Fields(c), " "))
+	return strings.TrimRight(c, ".!?;:, ")
+}
+
+// criterionKey is the key criteria are stored and compared by. WithExactCriteria
+// turns normalization off.
+func (s *Service) criterionKey(c string) string {
+	if s.exactCriteria {
+		return c
+	}
+	return normalizeCriterion(c)
+}
+
+// dedupCriteria drops criteria whose key repeats an earlier one, keeping the
+// first phrasing for display.
+func (s *Service) dedupCriteria(criteria []string) []string {
+	seen := make(map[string]bool, len(criteria))
+	out := make([]string, 0, len(criteria))
+	for _, c := range criteria {
+		key := s.criterionKey(c)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// criterionMet reports whether an earlier verification already confirmed c,
+// however it was phrased then.
+func (s *Service) criterionMet(conv *types.Conversation, c string) bool {
+	key := s.criterionKey(c)
+	for _, met := range conv.MetCriteria {
+		if s.criterionKey(met) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyChecklist lists conv's criteria for the verify prompt, marking the
+// ones a previous verification confirmed, or leaving them out entirely under
+// WithVerifyRemainingOnly.
+func (s *Service) verifyChecklist(conv *types.Conversation) string {
+	if len(conv.AcceptanceCriteria) == 0 {
+		return "-"
+	}
+	lines := make([]string, 0, len(conv.AcceptanceCriteria))
+	for _, c := range conv.AcceptanceCriteria {
+		line := "- " + c
+		if s.criterionMet(conv, c) {
+			if s.verifyRemainingOnly {
+				continue
+			}
+			line += " (previously verified)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// allCriteriaMet reports whether every one of conv's criteria has already
+// been confirmed by an earlier verification.
+func (s *Service) allCriteriaMet(conv *types.Conversation) bool {
+	if len(conv.AcceptanceCriteria) == 0 {
+		return false
+	}
+	for _, c := range conv.AcceptanceCriteria {
+		if !s.criterionMet(conv, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordVerification updates conv.MetCriteria from a verify reply. A pass
+// confirms every criterion; a failure confirms only those the reply lists on
+// a "MET: <criterion>" line.
+func (s *Service) recordVerification(conv *types.Conversation, passed bool, reply string) {
+	confirmed := make(map[string]bool)
+	if !passed {
+		for _, line := range strings.Split(reply, "\n") {
+			line = strings.TrimLeft(strings.TrimSpace(line), "-*• ")
+			if len(line) > 4 && strings.EqualFold(line[:4], "MET:") {
+				confirmed[s.criterionKey(strings.TrimSpace(line[4:]))] = true
+			}
+		}
+	}
+	for _, c := range conv.AcceptanceCriteria {
+		if s.criterionMet(conv, c) {
+			continue
+		}
+		if passed || confirmed[s.criterionKey(c)] {
+			conv.MetCriteria = append(conv.MetCriteria, c)
+		}
+	}
+}
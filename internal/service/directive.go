@@ -0,0 +1,75 @@
+package service
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// directiveKeywords are the reply prefixes the model uses to steer execution
+// and verification. COMMAND, NEED, and DEPENDENCY only count with a colon;
+// the others need a colon or a non-word character after them, so
+// "Successfully deployed" is not a SUCCESS.
+var directiveKeywords = []struct {
+	name       string
+	needsColon bool
+}{
+	{"COMMAND", true},
+	{"NEED", true},
+	{"DEPENDENCY", true},
+	{"SUCCESS", false},
+	{"BLOCKED", false},
+	{"ERROR", false},
+	{"PASS", false},
+	{"FAIL", false},
+}
+
+// directiveDecoration is markdown models wrap directives in: bullets, quotes,
+// headings, and emphasis.
+const directiveDecoration = " \t-*+>#_`•"
+
+// directive splits a model reply into its directive keyword (upper case, or
+// "" when there is none) and the payload after it. Unless WithStrictDirectives is
+// set, markdown such as "**COMMAND:** ls", "- NEED: x", or "> BLOCKED: y" is
+// tolerated. Replies without a directive return the trimmed reply as payload.
+func (s *Service) directive(reply string) (string, string) {
+	return parseDirective(reply, !s.strictDirectives)
+}
+
+func parseDirective(reply string, tolerant bool) (string, string) {
+	text := strings.TrimSpace(reply)
+	lead := ""
+	if tolerant {
+		trimmed := strings.TrimLeft(text, directiveDecoration)
+		lead = text[:len(text)-len(trimmed)]
+		text = trimmed
+	}
+	for _, kw := range directiveKeywords {
+		if len(text) < len(kw.name) || !strings.EqualFold(text[:len(kw.name)], kw.name) {
+			continue
+		}
+		rest := text[len(kw.name):]
+		if tolerant {
+			rest = strings.TrimLeft(rest, "*_")
+		}
+		if strings.HasPrefix(rest, ":") {
+			rest = rest[1:]
+		} else if kw.needsColon {
+			continue
+		} else if r, _ := utf8.DecodeRuneInString(rest); rest != "" && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			continue
+		}
+		payload := strings.TrimSpace(rest)
+		if tolerant {
+			payload = strings.TrimSpace(strings.TrimLeft(payload, "*_"))
+			if strings.Contains(lead, "**") {
+				payload = strings.TrimSpace(strings.TrimSuffix(payload, "**"))
+			}
+			if len(payload) > 1 && strings.HasPrefix(payload, "`") && strings.HasSuffix(payload, "`") && !strings.Contains(payload[1:len(payload)-1], "`") {
+				payload = payload[1 : len(payload)-1]
+			}
+		}
+		return kw.name, payload
+	}
+	return "", strings.TrimSpace(reply)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"trill/internal/types"
+)
+
+// gitOutput is one git context command and what it printed.
+type gitOutput struct {
+	command string
+	output  string
+}
+
+// gatherGitContext runs each WithGitContext command through the runner, skipping
+// commands the command policy refuses and commands that fail (e.g. outside a
+// repository), so missing context never blocks planning.
+func (s *Service) gatherGitContext(ctx context.Context) []gitOutput {
+	var outputs []gitOutput
+	for _, command := range s.gitContext {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+		if err := s.commandPolicy.Check(command); err != nil {
+			s.logger().Warn("git context command refused", "command", command, "error", err)
+			continue
+		}
+		timeout := s.commandTimeout
+		if timeout <= 0 {
+			timeout = defaultCommandTimeout
+		}
+		cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+		out, err := s.runner.Run(cmdCtx, command)
+		cancel()
+		if err != nil {
+			s.logger().Debug("git context command failed", "command", command, "error", err)
+			continue
+		}
+		outputs = append(outputs, gitOutput{command: command, output: strings.TrimSpace(string(out))})
+	}
+	return outputs
+}
+
+// withGitContext appends outputs to the goal so the plan prompt sees them
+// right after it.
+func withGitContext(prompt string, outputs []gitOutput) string {
+	if len(outputs) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\nRepository context:")
+	for _, out := range outputs {
+		fmt.Fprintf(&b, "\n$ %s\n%s", out.command, out.output)
+	}
+	return b.String()
+}
+
+// addGitArtifacts stores each output as an artifact on conv.
+func (s *Service) addGitArtifacts(conv *types.Conversation, outputs []gitOutput) {
+	for _, out := range outputs {
+		s.addArtifact(conv, "Git context", fmt.Sprintf("Output for `%s` at create time", out.command), out.output, out.command)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"time"
+
+	"trill/internal/obs"
+	"trill/internal/types"
+)
+
+// notifyInbox publishes an "inbox" event with conv's current state. With
+// WithInboxDebounce set, updates for a conversation within the window are
+// coalesced and only the latest state is published when it ends.
+func (s *Service) notifyInbox(conv *types.Conversation) {
+	if s.obs == nil {
+		return
+	}
+	ev := inboxEvent(conv)
+	if s.inboxDebounce <= 0 {
+		s.emit(ev)
+		return
+	}
+	s.mu.Lock()
+	if s.inboxPending == nil {
+		s.inboxPending = make(map[string]obs.Event)
+	}
+	_, scheduled := s.inboxPending[conv.SessionID]
+	s.inboxPending[conv.SessionID] = ev
+	s.mu.Unlock()
+	if scheduled {
+		return
+	}
+	time.AfterFunc(s.inboxDebounce, func() {
+		s.mu.Lock()
+		latest := s.inboxPending[conv.SessionID]
+		delete(s.inboxPending, conv.SessionID)
+		s.mu.Unlock()
+		s.emit(latest)
+	})
+}
+
+func inboxEvent(conv *types.Conversation) obs.Event {
+	item, _ := inboxItem(conv)
+	return obs.Event{
+		Type:      "inbox",
+		SessionID: conv.SessionID,
+		Prompt:    conv.Prompt,
+		State:     string(conv.State),
+		StepID:    item.StepID,
+		StepTitle: item.StepTitle,
+		Command:   item.PendingCommand,
+		Note:      conv.AwaitingReason,
+	}
+}
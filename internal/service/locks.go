@@ -0,0 +1,62 @@
+package service
+
+import "sync"
+
+// keyedLock hands out one mutex per key, so work on a conversation is
+// serialized without holding up other conversations. The zero value is ready
+// to use; entries are dropped once no caller holds or waits for them.
+type keyedLock struct {
+	mu    sync.Mutex
+	locks map[string]*keyedEntry
+}
+
+type keyedEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock blocks until key is free and returns the func that releases it.
+func (k *keyedLock) Lock(key string) func() {
+	e := k.acquire(key)
+	e.mu.Lock()
+	return func() { k.release(key, e) }
+}
+
+// TryLock is Lock without waiting; ok is false when key is already held.
+func (k *keyedLock) TryLock(key string) (unlock func(), ok bool) {
+	e := k.acquire(key)
+	if !e.mu.TryLock() {
+		k.drop(key, e)
+		return nil, false
+	}
+	return func() { k.release(key, e) }, true
+}
+
+func (k *keyedLock) acquire(key string) *keyedEntry {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedEntry)
+	}
+	e := k.locks[key]
+	if e == nil {
+		e = &keyedEntry{}
+		k.locks[key] = e
+	}
+	e.refs++
+	return e
+}
+
+func (k *keyedLock) release(key string, e *keyedEntry) {
+	e.mu.Unlock()
+	k.drop(key, e)
+}
+
+func (k *keyedLock) drop(key string, e *keyedEntry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(k.locks, key)
+	}
+}
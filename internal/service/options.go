@@ -0,0 +1,295 @@
+package service
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"trill/internal/codex"
+)
+
+// defaultCommandTimeout bounds an approved command when no WithCommandTimeout is given.
+const defaultCommandTimeout = 60 * time.Second
+
+// defaultMaxSteps caps parsed plans when no WithMaxSteps is given.
+const defaultMaxSteps = 12
+
+// Option configures a Service at construction; see New.
+type Option func(*Service)
+
+// WithClock replaces time.Now for timestamps and artifact IDs, so tests can
+// pin StartedAt, CompletedAt, and friends.
+func WithClock(clock func() time.Time) Option {
+	return func(s *Service) {
+		if clock != nil {
+			s.clock = clock
+		}
+	}
+}
+
+// WithCommandTimeout bounds how long an approved command may run (60s by default).
+func WithCommandTimeout(d time.Duration) Option {
+	return func(s *Service) {
+		if d > 0 {
+			s.commandTimeout = d
+		}
+	}
+}
+
+// WithMaxSteps keeps only the first n steps of each parsed plan (12 by
+// default); acceptance criteria after them are still read. Zero means unlimited.
+func WithMaxSteps(n int) Option {
+	return func(s *Service) {
+		if n >= 0 {
+			s.maxSteps = n
+		}
+	}
+}
+
+// WithPrompts overrides the built-in prompt text with templates loaded by
+// LoadPrompts. Nil keeps the built-in prompts.
+func WithPrompts(prompts *PromptSet) Option {
+	return func(s *Service) { s.prompts = prompts }
+}
+
+// WithLogger sends diagnostic output to logger instead of slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Service) { s.log = logger }
+}
+
+// WithRunner executes approved commands with runner instead of `sh -c`.
+func WithRunner(runner CommandRunner) Option {
+	return func(s *Service) {
+		if runner != nil {
+			s.runner = runner
+		}
+	}
+}
+
+// WithCommandPolicy refuses approved commands matching policy's deny patterns
+// instead of running them. Nil allows every command.
+func WithCommandPolicy(policy *CommandPolicy) Option {
+	return func(s *Service) { s.commandPolicy = policy }
+}
+
+// WithVerifyModel handles acceptance verification calls with model instead of
+// the execution model, e.g. a cheaper or stronger model for the yes/no check.
+func WithVerifyModel(model codex.Client) Option {
+	return func(s *Service) { s.verifyModel = model }
+}
+
+// WithCallLog writes every model prompt and reply to w as a JSON line with the
+// conversation, session, phase, and duration, for auditing prompts apart from
+// the event stream.
+func WithCallLog(w io.Writer) Option {
+	return func(s *Service) { s.callLog = w }
+}
+
+// WithEmitTruncation publishes a "truncation" obs event whenever prompt
+// context is trimmed.
+func WithEmitTruncation(on bool) Option {
+	return func(s *Service) { s.emitTruncation = on }
+}
+
+// WithContextMessages includes up to n recent chat messages in step execution
+// prompts so clarifications sent via Send inform execution. Zero disables it.
+func WithContextMessages(n int) Option {
+	return func(s *Service) { s.contextMessages = n }
+}
+
+// WithMaxHumanWait aborts conversations left awaiting info, a command, or step
+// approval longer than d when the sweeper runs. Zero disables it.
+func WithMaxHumanWait(d time.Duration) Option {
+	return func(s *Service) { s.maxHumanWait = d }
+}
+
+// WithPlanExpiry aborts conversations whose plan has awaited approval longer
+// than d when the sweeper runs, since the environment it was planned against
+// may have moved on. Zero disables it.
+func WithPlanExpiry(d time.Duration) Option {
+	return func(s *Service) { s.planExpiry = d }
+}
+
+// WithPlanCacheTTL reuses the reply to an identical planning prompt made
+// within d instead of calling the model again. Only the session-less call at
+// create time is cached. Zero disables it.
+func WithPlanCacheTTL(d time.Duration) Option {
+	return func(s *Service) { s.planCacheTTL = d }
+}
+
+// WithGitContext runs read-only commands, such as `git status --short`,
+// through the runner at create time. Their output is stored as artifacts and
+// shown to the planner; the command policy applies.
+func WithGitContext(commands []string) Option {
+	return func(s *Service) { s.gitContext = commands }
+}
+
+// WithStepCriteria controls acceptance criteria in step prompts: "all" (the
+// default), "none", or a count such as "3" to include only the first few.
+func WithStepCriteria(mode string) Option {
+	return func(s *Service) { s.stepCriteriaMode = mode }
+}
+
+// WithBlockEscalation decides what happens when a step is blocked or errors:
+// "replan" (the default) spends a model call on a new plan, "human" parks the
+// conversation in StateBlocked until someone resumes it.
+func WithBlockEscalation(mode string) Option {
+	return func(s *Service) { s.blockEscalation = mode }
+}
+
+// WithMaxPlanText caps the bytes of plan reply stored in PlanText; longer
+// plans are truncated with a marker. Zero means unlimited.
+func WithMaxPlanText(n int) Option {
+	return func(s *Service) { s.maxPlanText = n }
+}
+
+// WithMaxArtifactBytes caps the content stored per artifact; longer content,
+// such as a chatty command's output, is truncated with a note. Zero means
+// unlimited.
+func WithMaxArtifactBytes(n int) Option {
+	return func(s *Service) { s.maxArtifactBytes = n }
+}
+
+// WithRequireCompletionReview stops plans without acceptance criteria from
+// completing on their own; they wait in StateAwaitingCompletion for Complete.
+func WithRequireCompletionReview(on bool) Option {
+	return func(s *Service) { s.requireCompletionReview = on }
+}
+
+// WithStepArtifacts saves each successful step's reply as an artifact.
+// Conversations can override it via Settings.StepArtifacts.
+func WithStepArtifacts(on bool) Option {
+	return func(s *Service) { s.stepArtifactsDefault = on }
+}
+
+// WithCommandArtifacts chooses which approved command outputs are saved as
+// artifacts: "always" (the default), "only-on-failure", or "never".
+// Conversations can override it via Settings.CommandArtifacts.
+func WithCommandArtifacts(mode string) Option {
+	return func(s *Service) { s.commandArtifacts = mode }
+}
+
+// WithExactCriteria compares acceptance criteria verbatim instead of ignoring
+// case, list markers, and trailing punctuation.
+func WithExactCriteria(on bool) Option {
+	return func(s *Service) { s.exactCriteria = on }
+}
+
+// WithVerifyRemainingOnly leaves criteria an earlier verification confirmed,
+// including before a replan, out of later verify prompts so only the remaining
+// gaps are checked. When none remain the conversation completes without
+// another verify call.
+func WithVerifyRemainingOnly(on bool) Option {
+	return func(s *Service) { s.verifyRemainingOnly = on }
+}
+
+// WithRawDisplay turns off sanitizing of commands and output shown to
+// operators (events, inbox, conversation views). Execution always uses the
+// exact command text.
+func WithRawDisplay(on bool) Option {
+	return func(s *Service) { s.rawDisplay = on }
+}
+
+// WithSaveRetries retries a failed store save up to retries times, with
+// doubling backoff from backoff (50ms when zero), before giving up.
+func WithSaveRetries(retries int, backoff time.Duration) Option {
+	return func(s *Service) {
+		s.saveRetries = retries
+		s.saveBackoff = backoff
+	}
+}
+
+// WithStrictDirectives only recognizes directives (COMMAND:, NEED:, ...) at
+// the very start of a reply, instead of tolerating markdown bullets, quotes,
+// and emphasis around them.
+func WithStrictDirectives(on bool) Option {
+	return func(s *Service) { s.strictDirectives = on }
+}
+
+// WithPromptStorage is "full" (the default) to keep each ModelCall's complete
+// prompt, or "hash" to keep only a fingerprint and a short preview so growing
+// context and sensitive input stay out of stored conversations.
+func WithPromptStorage(mode string) Option {
+	return func(s *Service) { s.promptStorage = mode }
+}
+
+// WithInboxDebounce coalesces "inbox" events for a conversation saved
+// repeatedly within d into one carrying the latest state. Zero publishes
+// every save.
+func WithInboxDebounce(d time.Duration) Option {
+	return func(s *Service) { s.inboxDebounce = d }
+}
+
+// WithJSONPlans asks the model for plans as a JSON object of steps and
+// acceptance criteria instead of a numbered list. Replies that aren't valid
+// JSON still go through the text parser.
+func WithJSONPlans(on bool) Option {
+	return func(s *Service) { s.jsonPlans = on }
+}
+
+// WithDedupSteps collapses plan steps whose normalized titles repeat, keeping
+// the first.
+func WithDedupSteps(on bool) Option {
+	return func(s *Service) { s.dedupSteps = on }
+}
+
+// WithConcurrentSends decides what a Send does while another Send to the same
+// conversation is still running: "queue" (the default) waits its turn so both
+// exchanges are kept in order, "reject" fails with ErrSendInProgress.
+func WithConcurrentSends(mode string) Option {
+	return func(s *Service) { s.concurrentSends = mode }
+}
+
+// WithMaxModelCalls caps the model calls a conversation makes in total, across
+// planning, execution, discovery, replanning, and verification. Reaching it
+// blocks the conversation until it is resumed with extra calls. Zero means
+// unlimited.
+func WithMaxModelCalls(n int) Option {
+	return func(s *Service) { s.maxModelCalls = n }
+}
+
+// WithMaxDiscoveryDepth caps the discovery commands proposed in a row for one
+// step. Once reached, a further NEED or DEPENDENCY goes to a human instead.
+// Zero means unlimited.
+func WithMaxDiscoveryDepth(n int) Option {
+	return func(s *Service) { s.maxDiscoveryDepth = n }
+}
+
+// WithMaxVerifyReplans caps how many times a conversation replans after failed
+// acceptance verification. The next failure gives up on the attempt; see
+// WithMaxAttempts. Zero means unlimited.
+func WithMaxVerifyReplans(n int) Option {
+	return func(s *Service) { s.maxVerifyReplans = n }
+}
+
+// WithMaxAttempts is how many attempts, counting the first, a prompt gets once
+// the verify replans are exhausted. Each retry plans the original prompt in a
+// new conversation; the failed one is aborted with a link to it. At the last
+// attempt the conversation is blocked instead.
+func WithMaxAttempts(n int) Option {
+	return func(s *Service) { s.maxAttempts = n }
+}
+
+// WithMaxExecuting caps how many conversations execute at once; extra
+// approvals wait in StateQueued. Zero means unlimited.
+func WithMaxExecuting(n int) Option {
+	return func(s *Service) { s.maxExecuting = n }
+}
+
+// WithWorkQueue bounds how many approvals may wait for the background worker
+// to pick them up (64 when size is zero), and how long an approval waits for
+// room in a full queue before failing with ErrWorkQueueFull (at once when
+// wait is zero). It takes effect when StartWorker is called.
+func WithWorkQueue(size int, wait time.Duration) Option {
+	return func(s *Service) {
+		s.workQueueSize = size
+		s.enqueueWait = wait
+	}
+}
+
+// WithPlanConcurrency bounds how many new conversations are planned at once
+// across the service, whether from CreateConversation or CreateConversations.
+// Further creates wait for a slot. Zero means unlimited.
+func WithPlanConcurrency(n int) Option {
+	return func(s *Service) { s.planConcurrency = n }
+}
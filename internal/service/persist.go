@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"trill/internal/store"
+	"trill/internal/types"
+)
+
+// defaultSaveBackoff is the first retry delay when WithSaveRetries is given no backoff.
+const defaultSaveBackoff = 50 * time.Millisecond
+
+// save persists conv, retrying up to WithSaveRetries times with doubling backoff
+// so a transient store error doesn't throw away model calls already recorded
+// on conv. It gives up early if ctx is done, and at once on store.ErrInvalid,
+// which no retry can fix. Every save stamps UpdatedAt, and
+// StateEnteredAt when State has changed; successful ones are published as
+// inbox updates.
+//
+// A conversation aborted since conv was loaded stays aborted: save returns
+// ErrAborted instead of overwriting it, so work that finishes after an Abort
+// cannot revive the conversation. Reviving an aborted conversation on purpose
+// starts from a copy loaded in that state and is saved as usual.
+func (s *Service) save(ctx context.Context, conv *types.Conversation) error {
+	defer s.writes.Lock(conv.SessionID)()
+	if conv.State != types.StateAborted && conv.EnteredState != types.StateAborted {
+		if _, aborted := s.abortedMeanwhile(ctx, conv.SessionID); aborted {
+			return ErrAborted
+		}
+	}
+	conv.UpdatedAt = s.clock()
+	if conv.EnteredState != conv.State {
+		conv.EnteredState = conv.State
+		conv.StateEnteredAt = conv.UpdatedAt
+	}
+	backoff := s.saveBackoff
+	if backoff <= 0 {
+		backoff = defaultSaveBackoff
+	}
+	err := s.store.Save(ctx, conv)
+	for attempt := 1; err != nil && !errors.Is(err, store.ErrInvalid) && attempt <= s.saveRetries; attempt++ {
+		s.logger().Warn("store save failed; retrying", "session_id", conv.SessionID, "attempt", attempt, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		err = s.store.Save(ctx, conv)
+	}
+	if err == nil {
+		s.notifyInbox(conv)
+	}
+	return err
+}
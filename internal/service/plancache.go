@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"trill/internal/types"
+)
+
+// maxPlanCacheEntries bounds the plan cache; the oldest entries are evicted
+// beyond it.
+const maxPlanCacheEntries = 256
+
+// cachedPlan is a planning reply kept for WithPlanCacheTTL.
+type cachedPlan struct {
+	reply    string
+	storedAt time.Time
+}
+
+// planCacheKey addresses a planning call by its prompt and working directory.
+func planCacheKey(settings types.ConversationSettings, planPrompt string) string {
+	sum := sha256.Sum256([]byte(settings.WorkDir + "\x00" + planPrompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// planCall makes the session-less planning call for a new conversation, or
+// serves it from the plan cache. Only these calls are cached: every later
+// call continues a session whose context a cached reply would not reflect.
+// A cache hit gets a fresh conversation id and no Codex session; the first
+// execution call starts one. Without fromCache the model is always called,
+// and its reply replaces any cached one.
+func (s *Service) planCall(ctx context.Context, settings types.ConversationSettings, planPrompt string, fromCache bool) (reply, raw, sessionID string, durationMS int64, cached bool, err error) {
+	if s.planCacheTTL <= 0 {
+		reply, raw, sessionID, durationMS, err = s.sendPlan(ctx, settings, planPrompt)
+		return reply, raw, sessionID, durationMS, false, err
+	}
+	key := planCacheKey(settings, planPrompt)
+	now := s.clock()
+	s.mu.Lock()
+	hit, ok := s.planCache[key]
+	if ok && now.Sub(hit.storedAt) >= s.planCacheTTL {
+		delete(s.planCache, key)
+		ok = false
+	}
+	s.mu.Unlock()
+	ok = ok && fromCache
+	if ok {
+		sessionID = fmt.Sprintf("plan-cache-%d-%d", now.UnixNano(), atomic.AddUint64(&s.cacheSeq, 1))
+		return hit.reply, "", sessionID, 0, true, nil
+	}
+	reply, raw, sessionID, durationMS, err = s.sendPlan(ctx, settings, planPrompt)
+	if err != nil {
+		return reply, raw, sessionID, durationMS, false, err
+	}
+	s.mu.Lock()
+	s.cachePlanLocked(key, cachedPlan{reply: reply, storedAt: now})
+	s.mu.Unlock()
+	return reply, raw, sessionID, durationMS, false, nil
+}
+
+// sendPlan makes a planning call once one of the WithPlanConcurrency slots
+// is free, giving up if ctx ends first.
+func (s *Service) sendPlan(ctx context.Context, settings types.ConversationSettings, planPrompt string) (string, string, string, int64, error) {
+	if s.planSlots != nil {
+		select {
+		case s.planSlots <- struct{}{}:
+			defer func() { <-s.planSlots }()
+		case <-ctx.Done():
+			return "", "", "", 0, ctx.Err()
+		}
+	}
+	return s.model.Send(withWorkDir(ctx, settings), "", planPrompt)
+}
+
+// cachePlanLocked stores plan under key, first dropping expired entries and,
+// if the cache is still full, the oldest ones. The caller holds s.mu.
+func (s *Service) cachePlanLocked(key string, plan cachedPlan) {
+	if s.planCache == nil {
+		s.planCache = make(map[string]cachedPlan)
+	}
+	delete(s.planCache, key)
+	for k, entry := range s.planCache {
+		if plan.storedAt.Sub(entry.storedAt) >= s.planCacheTTL {
+			delete(s.planCache, k)
+		}
+	}
+	for len(s.planCache) >= maxPlanCacheEntries {
+		oldest := ""
+		for k, entry := range s.planCache {
+			if oldest == "" || entry.storedAt.Before(s.planCache[oldest].storedAt) {
+				oldest = k
+			}
+		}
+		delete(s.planCache, oldest)
+	}
+	s.planCache[key] = plan
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"trill/internal/types"
+)
+
+// jsonPlan is the structured plan requested when WithJSONPlans is set:
+// {"steps": [...], "acceptance": [...]}.
+type jsonPlan struct {
+	Steps      []jsonPlanStep `json:"steps"`
+	Acceptance []string       `json:"acceptance"`
+}
+
+// jsonPlanStep accepts either a bare title string or an object such as
+// {"title": "Deploy", "timeout_seconds": 300}.
+type jsonPlanStep struct {
+	Title          string `json:"title"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+func (p *jsonPlanStep) UnmarshalJSON(data []byte) error {
+	var title string
+	if err := json.Unmarshal(data, &title); err == nil {
+		p.Title = title
+		return nil
+	}
+	type plain jsonPlanStep
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// parseJSONPlan decodes a structured plan reply, tolerating a surrounding
+// ```json fence. ok is false when the reply isn't a usable JSON plan, so the
+// caller can fall back to the text parser.
+func parseJSONPlan(plan string, maxSteps int) (steps []types.Step, acceptance []string, ok bool) {
+	text := strings.TrimSpace(plan)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimPrefix(text, "json")
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+	}
+	if !strings.HasPrefix(text, "{") {
+		return nil, nil, false
+	}
+	var parsed jsonPlan
+	if err := json.Unmarshal([]byte(text), &parsed); err != nil {
+		return nil, nil, false
+	}
+	steps = make([]types.Step, 0, len(parsed.Steps))
+	for _, s := range parsed.Steps {
+		title := strings.TrimSpace(s.Title)
+		if title == "" {
+			continue
+		}
+		if maxSteps > 0 && len(steps) >= maxSteps {
+			break
+		}
+		timeout := s.TimeoutSeconds
+		if timeout < 0 {
+			timeout = 0
+		}
+		steps = append(steps, types.Step{
+			ID:             fmt.Sprintf("step-%d", len(steps)+1),
+			Title:          title,
+			Status:         types.StepPending,
+			TimeoutSeconds: timeout,
+			Logs:           []string{},
+		})
+	}
+	if len(steps) == 0 {
+		return nil, nil, false
+	}
+	acceptance = make([]string, 0, len(parsed.Acceptance))
+	for _, c := range parsed.Acceptance {
+		if c = strings.TrimSpace(c); c != "" {
+			acceptance = append(acceptance, c)
+		}
+	}
+	return steps, acceptance, true
+}
+
+func jsonPlanPrompt(prompt string) string {
+	return "You are an execution planner. Given a prompt, reply with only a JSON object of the form {\"steps\": [\"<step>\", ...], \"acceptance\": [\"<criterion>\", ...]}. A step may instead be an object {\"title\": \"<step>\", \"timeout_seconds\": <n>} when it needs a time budget. Keep both lists short and outcome-focused.\nPrompt: " + prompt + "\nJSON:"
+}
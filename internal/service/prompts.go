@@ -2,10 +2,13 @@ package service
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
+
+	"trill/internal/types"
 )
 
 // PromptSet holds compiled templates for the service.
@@ -15,6 +18,14 @@ type PromptSet struct {
 	ProposeCommand *template.Template
 	Unblock        *template.Template
 	Verify         *template.Template
+	// PlanJSON optionally renders the planning prompt when WithJSONPlans is set;
+	// nil uses the built-in JSON prompt.
+	PlanJSON *template.Template
+	// RejectPlan optionally renders the replanning prompt after a plan is
+	// rejected; nil uses the built-in prompt.
+	RejectPlan *template.Template
+	// Completion optionally renders CompletedMessage; nil keeps the built-in summary.
+	Completion *template.Template
 }
 
 // LoadPrompts loads templates from the prompts directory.
@@ -51,13 +62,29 @@ func LoadPrompts(dir string) (*PromptSet, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &PromptSet{
+	set := &PromptSet{
 		Plan:           plan,
 		ExecuteStep:    exec,
 		ProposeCommand: cmd,
 		Unblock:        unblock,
 		Verify:         verify,
-	}, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "plan_json.tmpl")); err == nil {
+		if set.PlanJSON, err = load("plan_json.tmpl"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "reject_plan.tmpl")); err == nil {
+		if set.RejectPlan, err = load("reject_plan.tmpl"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "completion.tmpl")); err == nil {
+		if set.Completion, err = load("completion.tmpl"); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
 }
 
 func renderPrompt(t *template.Template, data any) (string, error) {
@@ -67,3 +94,136 @@ func renderPrompt(t *template.Template, data any) (string, error) {
 	}
 	return sb.String(), nil
 }
+
+// PromptError reports a template that failed validation.
+type PromptError struct {
+	Template string `json:"template"`
+	Error    string `json:"error"`
+}
+
+// ValidatePrompts renders every configured template against sample data with
+// missing keys treated as errors, so typos surface before execution does.
+func (s *Service) ValidatePrompts() []PromptError {
+	if s.prompts == nil {
+		return nil
+	}
+	conv := &types.Conversation{
+		SessionID:          "sample-session",
+		Prompt:             "Sample goal",
+		PlanVersion:        1,
+		PlanText:           "1) Sample step\nACCEPT: sample criterion",
+		AcceptanceCriteria: []string{"sample criterion"},
+		Steps:              []types.Step{{ID: "step-1", Title: "1) Sample step", Status: types.StepPending, Logs: []string{"sample log"}}},
+	}
+	step := &conv.Steps[0]
+	checks := []struct {
+		name string
+		tmpl *template.Template
+		data any
+	}{
+		{"plan", s.prompts.Plan, s.planPromptData(conv.Prompt)},
+		{"plan_json", s.prompts.PlanJSON, s.planPromptData(conv.Prompt)},
+		{"execute_step", s.prompts.ExecuteStep, s.executePromptData(conv, step, "sample context")},
+		{"propose_command", s.prompts.ProposeCommand, s.proposeCommandPromptData(conv, "sample need", "info", "sample context")},
+		{"unblock", s.prompts.Unblock, s.unblockPromptData(conv, step.Title, "sample reason")},
+		{"verify", s.prompts.Verify, s.verifyPromptData(conv, "- sample criterion", "sample context")},
+		{"reject_plan", s.prompts.RejectPlan, s.rejectPlanPromptData(conv, "sample feedback")},
+		{"completion", s.prompts.Completion, s.completionData(conv, "SUCCESS: sample")},
+	}
+	var errs []PromptError
+	for _, c := range checks {
+		if c.tmpl == nil {
+			continue
+		}
+		strict, err := c.tmpl.Clone()
+		if err == nil {
+			err = strict.Option("missingkey=error").Execute(io.Discard, c.data)
+		}
+		if err != nil {
+			errs = append(errs, PromptError{Template: c.name, Error: err.Error()})
+		}
+	}
+	return errs
+}
+
+func (s *Service) planPromptData(prompt string) map[string]any {
+	return map[string]any{"Prompt": prompt}
+}
+
+func (s *Service) executePromptData(conv *types.Conversation, step *types.Step, contextLogs string) map[string]any {
+	criteria, include := s.stepCriteria(conv)
+	return map[string]any{
+		"Goal":            conv.Prompt,
+		"Plan":            s.planContext(conv),
+		"Criteria":        criteria,
+		"IncludeCriteria": include,
+		"Context":         contextLogs,
+		"StepTitle":       step.Title,
+		"StepID":          step.ID,
+		"PlanVersion":     conv.PlanVersion,
+		"Conversation":    conv,
+		"Step":            step,
+	}
+}
+
+func (s *Service) proposeCommandPromptData(conv *types.Conversation, need, kind, contextLogs string) map[string]any {
+	return map[string]any{
+		"Goal":         conv.Prompt,
+		"Need":         need,
+		"Plan":         s.planContext(conv),
+		"Context":      contextLogs,
+		"Kind":         kind,
+		"Criteria":     strings.Join(conv.AcceptanceCriteria, "; "),
+		"Conversation": conv,
+	}
+}
+
+func (s *Service) verifyPromptData(conv *types.Conversation, checklist, contextLogs string) map[string]any {
+	return map[string]any{
+		"Goal":         conv.Prompt,
+		"Checklist":    checklist,
+		"Context":      contextLogs,
+		"Conversation": conv,
+	}
+}
+
+func (s *Service) unblockPromptData(conv *types.Conversation, stepTitle, reason string) map[string]any {
+	return map[string]any{
+		"Goal":         conv.Prompt,
+		"StepTitle":    stepTitle,
+		"Reason":       reason,
+		"PlanText":     s.planContext(conv),
+		"Conversation": conv,
+	}
+}
+
+func (s *Service) rejectPlanPromptData(conv *types.Conversation, feedback string) map[string]any {
+	return map[string]any{
+		"Goal":         conv.Prompt,
+		"PlanText":     s.planContext(conv),
+		"Feedback":     feedback,
+		"Conversation": conv,
+	}
+}
+
+func (s *Service) completionData(conv *types.Conversation, finalReply string) map[string]any {
+	return map[string]any{
+		"Goal":         conv.Prompt,
+		"Plan":         s.planContext(conv),
+		"Steps":        conv.Steps,
+		"LastReply":    finalReply,
+		"LastResult":   lastResult(conv),
+		"PlanVersion":  conv.PlanVersion,
+		"Conversation": conv,
+	}
+}
+
+// lastResult is the Result of the last step that reported one.
+func lastResult(conv *types.Conversation) string {
+	for i := len(conv.Steps) - 1; i >= 0; i-- {
+		if conv.Steps[i].Result != "" {
+			return conv.Steps[i].Result
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"trill/internal/types"
+)
+
+// sanitizeDisplay makes model-authored text safe to show an operator: control
+// characters (including the ESC that starts ANSI sequences) and bidi overrides
+// are rendered as visible escapes instead of being interpreted by a terminal
+// or browser. Newlines and tabs are kept.
+func sanitizeDisplay(text string) string {
+	if strings.IndexFunc(text, unsafeRune) < 0 {
+		return text
+	}
+	var b strings.Builder
+	for _, r := range text {
+		if !unsafeRune(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if r <= 0xff {
+			fmt.Fprintf(&b, `\x%02x`, r)
+		} else {
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+func unsafeRune(r rune) bool {
+	if r == '\n' || r == '\t' {
+		return false
+	}
+	return unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r)
+}
+
+// DisplayText sanitizes text for display unless WithRawDisplay is set.
+func (s *Service) DisplayText(text string) string {
+	if s.rawDisplay {
+		return text
+	}
+	return sanitizeDisplay(text)
+}
+
+// ForDisplay returns a copy of conv with pending commands, questions and
+// dependencies, awaiting reasons, step logs, messages, model replies, and
+// artifacts sanitized for display. The stored conversation keeps the exact
+// bytes, which is what ApproveCommand executes.
+func (s *Service) ForDisplay(conv *types.Conversation) *types.Conversation {
+	if conv == nil || s.rawDisplay {
+		return conv
+	}
+	cp := *conv
+	cp.AwaitingReason = sanitizeDisplay(conv.AwaitingReason)
+	if conv.Steps != nil {
+		cp.Steps = make([]types.Step, len(conv.Steps))
+		for i, step := range conv.Steps {
+			step.PendingCommand = sanitizeDisplay(step.PendingCommand)
+			step.PendingInfo = sanitizeDisplay(step.PendingInfo)
+			step.PendingDependency = sanitizeDisplay(step.PendingDependency)
+			step.Result = sanitizeDisplay(step.Result)
+			step.Logs = s.displayLines(step.Logs)
+			cp.Steps[i] = step
+		}
+	}
+	cp.Messages = s.DisplayMessages(conv.Messages)
+	if conv.ModelCalls != nil {
+		cp.ModelCalls = make([]types.ModelCall, len(conv.ModelCalls))
+		for i, call := range conv.ModelCalls {
+			call.Reply = sanitizeDisplay(call.Reply)
+			cp.ModelCalls[i] = call
+		}
+	}
+	if conv.Artifacts != nil {
+		cp.Artifacts = make([]types.Artifact, len(conv.Artifacts))
+		for i, art := range conv.Artifacts {
+			art.Content = sanitizeDisplay(art.Content)
+			cp.Artifacts[i] = art
+		}
+	}
+	return &cp
+}
+
+// DisplayMessages returns a copy of msgs with their content sanitized for
+// display unless WithRawDisplay is set.
+func (s *Service) DisplayMessages(msgs []types.Message) []types.Message {
+	if msgs == nil || s.rawDisplay {
+		return msgs
+	}
+	out := make([]types.Message, len(msgs))
+	for i, m := range msgs {
+		m.Content = sanitizeDisplay(m.Content)
+		out[i] = m
+	}
+	return out
+}
+
+func (s *Service) displayLines(lines []string) []string {
+	if lines == nil || s.rawDisplay {
+		return lines
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = sanitizeDisplay(line)
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"trill/internal/types"
+)
+
+// startExecution hands conv to the background worker when one is running.
+// Otherwise it moves conv into execution if a slot is free, or parks it in
+// StateQueued until a running conversation finishes.
+func (s *Service) startExecution(ctx context.Context, conv *types.Conversation) (*types.Conversation, error) {
+	if queued, err := s.enqueue(ctx, conv); queued {
+		if err != nil {
+			return nil, err
+		}
+		return conv, nil
+	}
+	if !s.acquireSlot(conv.SessionID) {
+		conv.State = types.StateQueued
+		conv.AwaitingReason = "Queued: waiting for an execution slot"
+		if err := s.save(ctx, conv); err != nil {
+			return nil, err
+		}
+		return conv, nil
+	}
+	defer s.releaseSlot()
+	conv.State = types.StateExecuting
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return s.advanceExecution(ctx, conv)
+}
+
+// resumeExecution is startExecution for a conversation whose progress can't
+// be repeated, such as an approved command's result or a user's answer, and
+// has already been saved. Rather than fail on a full work queue, it parks
+// conv in StateQueued for the next slot releaseSlot hands out.
+func (s *Service) resumeExecution(ctx context.Context, conv *types.Conversation) (*types.Conversation, error) {
+	updated, err := s.startExecution(ctx, conv)
+	if !errors.Is(err, ErrWorkQueueFull) {
+		return updated, err
+	}
+	s.mu.Lock()
+	s.queued = append(s.queued, conv.SessionID)
+	s.mu.Unlock()
+	conv.State = types.StateQueued
+	conv.AwaitingReason = "Queued: waiting for an execution slot"
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// acquireSlot reserves an execution slot, or records sessionID as queued when none is free.
+func (s *Service) acquireSlot(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxExecuting > 0 && s.running >= s.maxExecuting {
+		s.queued = append(s.queued, sessionID)
+		return false
+	}
+	s.running++
+	return true
+}
+
+// releaseSlot frees a slot and hands it straight to the oldest queued
+// conversation. Once the worker has stopped, queued conversations stay put
+// for RequeueStranded at the next start.
+func (s *Service) releaseSlot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queued) == 0 || s.stopped {
+		s.running--
+		return
+	}
+	next := s.queued[0]
+	s.queued = s.queued[1:]
+	s.dispatchLocked(next)
+}
+
+// dispatchLocked runs promote for sessionID on a slot already reserved for
+// it. While a worker runs, the promotion joins its in-flight WaitGroup and
+// context so shutdown waits for it. The caller holds s.mu.
+func (s *Service) dispatchLocked(sessionID string) {
+	if s.inflight == nil {
+		go s.promote(context.Background(), sessionID)
+		return
+	}
+	inflight, ctx := s.inflight, s.runCtx
+	inflight.Add(1)
+	go func() {
+		defer inflight.Done()
+		s.promote(ctx, sessionID)
+	}()
+}
+
+// RequeueStranded puts conversations that a previous process left queued or
+// executing back in line and starts as many as MaxExecuting allows, oldest
+// first. The queue and running slots live only in memory, so without this a
+// restart would leave them waiting forever. Call it once at startup and
+// return the number requeued.
+func (s *Service) RequeueStranded(ctx context.Context) (int, error) {
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var stranded []*types.Conversation
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		if conv.State == types.StateQueued || conv.State == types.StateExecuting {
+			stranded = append(stranded, conv)
+		}
+	}
+	sort.SliceStable(stranded, func(i, j int) bool {
+		return stranded[i].LastActivityAt.Before(stranded[j].LastActivityAt)
+	})
+	for _, conv := range stranded {
+		if conv.State != types.StateQueued {
+			conv.State = types.StateQueued
+			conv.AwaitingReason = "Queued: waiting for an execution slot"
+			if err := s.save(ctx, conv); err != nil {
+				return 0, err
+			}
+		}
+		s.mu.Lock()
+		s.queued = append(s.queued, conv.SessionID)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queued) > 0 && (s.maxExecuting <= 0 || s.running < s.maxExecuting) {
+		next := s.queued[0]
+		s.queued = s.queued[1:]
+		s.running++
+		s.dispatchLocked(next)
+	}
+	return len(stranded), nil
+}
+
+// promote runs a queued conversation using a slot already reserved for it by
+// releaseSlot or the worker.
+func (s *Service) promote(ctx context.Context, sessionID string) {
+	defer s.releaseSlot()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil || (conv.State != types.StateQueued && conv.State != types.StateExecuting) {
+		return
+	}
+	conv.State = types.StateExecuting
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		s.logger().Error("promote queued conversation", "session_id", sessionID, "error", err)
+		return
+	}
+	if _, err := s.advanceExecution(ctx, conv); err != nil && !errors.Is(err, ErrAborted) {
+		s.logger().Error("execute queued conversation", "session_id", sessionID, "error", err)
+	}
+}
+
+// markQueued parks an enqueued conversation in StateQueued when the worker
+// finds no free slot; releaseSlot promotes it later.
+func (s *Service) markQueued(ctx context.Context, sessionID string) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return
+	}
+	conv.State = types.StateQueued
+	conv.AwaitingReason = "Queued: waiting for an execution slot"
+	if err := s.save(ctx, conv); err != nil {
+		s.logger().Error("queue conversation", "session_id", sessionID, "error", err)
+	}
+}
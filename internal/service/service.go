@@ -2,10 +2,20 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"trill/internal/codex"
 	"trill/internal/obs"
@@ -13,21 +23,124 @@ import (
 	"trill/internal/types"
 )
 
+// ErrNotResumable is returned by Resume for conversations that are not paused.
+var ErrNotResumable = errors.New("not resumable")
+
+// ErrSendInProgress is returned by Send when WithConcurrentSends is "reject" and
+// another message to the same conversation is still being answered.
+var ErrSendInProgress = errors.New("another message to this conversation is in progress")
+
 type Service struct {
-	store   store.ConversationStore
-	model   codex.Client
-	obs     *obs.Broker
-	clock   func() time.Time
-	Prompts *PromptSet
+	store store.ConversationStore
+	model codex.Client
+	obs   *obs.Broker
+	clock func() time.Time
+	// prompts overrides the built-in prompt text; see WithPrompts.
+	prompts *PromptSet
+	// log receives diagnostic output; nil uses slog.Default(). See WithLogger.
+	log *slog.Logger
+	// runner executes approved commands; see WithRunner.
+	runner CommandRunner
+	// verifyModel handles acceptance verification when set; see WithVerifyModel.
+	verifyModel codex.Client
+	// callLog receives every model prompt and reply; see WithCallLog.
+	callLog io.Writer
+
+	// The remaining settings are described on the options that set them.
+	emitTruncation          bool
+	commandPolicy           *CommandPolicy
+	contextMessages         int
+	maxHumanWait            time.Duration
+	planExpiry              time.Duration
+	planCacheTTL            time.Duration
+	gitContext              []string
+	stepCriteriaMode        string
+	blockEscalation         string
+	maxPlanText             int
+	maxArtifactBytes        int
+	requireCompletionReview bool
+	stepArtifactsDefault    bool
+	commandArtifacts        string
+	exactCriteria           bool
+	verifyRemainingOnly     bool
+	rawDisplay              bool
+	saveRetries             int
+	saveBackoff             time.Duration
+	strictDirectives        bool
+	promptStorage           string
+	inboxDebounce           time.Duration
+	jsonPlans               bool
+	dedupSteps              bool
+	concurrentSends         string
+	maxModelCalls           int
+	maxDiscoveryDepth       int
+	maxVerifyReplans        int
+	maxAttempts             int
+	maxExecuting            int
+	workQueueSize           int
+	enqueueWait             time.Duration
+	planConcurrency         int
+
+	// commandTimeout bounds each approved command; see WithCommandTimeout.
+	commandTimeout time.Duration
+	// maxSteps caps the steps kept from a parsed plan; see WithMaxSteps.
+	maxSteps int
+	// artifactSeq disambiguates artifact IDs created within one clock tick.
+	artifactSeq uint64
+	// cacheSeq does the same for conversations planned from the plan cache.
+	cacheSeq uint64
+
+	mu      sync.Mutex
+	running int
+	queued  []string
+	work    chan string
+	// workSlots holds one token per queued approval, reserved before the
+	// conversation is saved so a full queue never leaves it half-started.
+	workSlots chan struct{}
+	// inflight and runCtx are the worker's; promotions run under them so
+	// StartWorker's wait covers them. stopped is set once the worker shuts down.
+	inflight *sync.WaitGroup
+	runCtx   context.Context
+	stopped  bool
+	// planSlots holds one token per planning call in flight; see
+	// WithPlanConcurrency. Nil means unlimited.
+	planSlots chan struct{}
+	// planCache holds recent planning replies by planCacheKey; see WithPlanCacheTTL.
+	planCache map[string]cachedPlan
+	// commands holds the approved command running per conversation.
+	commands map[string]*runningCommand
+	// inboxPending holds the latest debounced inbox event per conversation.
+	inboxPending map[string]obs.Event
+	// sends serializes Send per conversation so concurrent messages aren't lost.
+	sends keyedLock
+	// actions serializes the human actions that move a conversation on from
+	// a waiting state, against each other and the sweeper.
+	actions keyedLock
+	// writes makes each save's check for a concurrent abort atomic with the
+	// write itself.
+	writes keyedLock
+	// callLogMu keeps concurrent call log lines whole.
+	callLogMu sync.Mutex
 }
 
-func New(store store.ConversationStore, model codex.Client, broker *obs.Broker) *Service {
-	return &Service{
-		store: store,
-		model: model,
-		obs:   broker,
-		clock: time.Now,
-	}
+// New returns a Service backed by store, model, and broker, adjusted by opts.
+func New(store store.ConversationStore, model codex.Client, broker *obs.Broker, opts ...Option) *Service {
+	s := &Service{
+		store:          store,
+		model:          model,
+		obs:            broker,
+		clock:          time.Now,
+		commandTimeout: defaultCommandTimeout,
+		maxSteps:       defaultMaxSteps,
+		runner:         DefaultShellRunner(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.planConcurrency > 0 {
+		s.planSlots = make(chan struct{}, s.planConcurrency)
+	}
+	return s
 }
 
 // Start returns an empty id for compatibility with legacy clients.
@@ -37,52 +150,89 @@ func (s *Service) Start(ctx context.Context) (string, error) {
 
 // CreateConversation seeds a plan and moves to awaiting plan approval.
 func (s *Service) CreateConversation(ctx context.Context, prompt string) (*types.Conversation, error) {
+	return s.CreateConversationWith(ctx, prompt, types.ConversationSettings{})
+}
+
+// CreateConversationWith is CreateConversation with per-conversation settings.
+func (s *Service) CreateConversationWith(ctx context.Context, prompt string, settings types.ConversationSettings) (*types.Conversation, error) {
+	return s.createConversation(ctx, prompt, settings, true)
+}
+
+// createConversation plans prompt into a new conversation. fromCache allows
+// the plan to come from the plan cache; callers that need a fresh plan pass
+// false.
+func (s *Service) createConversation(ctx context.Context, prompt string, settings types.ConversationSettings, fromCache bool) (*types.Conversation, error) {
 	prompt = strings.TrimSpace(prompt)
 	if prompt == "" {
 		return nil, fmt.Errorf("prompt is required")
 	}
-	planPrompt, err := s.renderPlanPrompt(prompt)
+	if err := validateSettings(settings); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("planning canceled: %w", err)
+	}
+	gitContext := s.gatherGitContext(withWorkDir(ctx, settings))
+	planPrompt, err := s.renderPlanPrompt(withGitContext(prompt, gitContext))
 	if err != nil {
 		return nil, err
 	}
-	reply, raw, sessionID, duration, err := s.model.Send(ctx, "", planPrompt)
+	reply, raw, sessionID, duration, cached, err := s.planCall(ctx, settings, planPrompt, fromCache)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("planning canceled: %w", ctxErr)
+		}
 		return nil, err
 	}
-	steps, acceptance := parsePlanAndCriteria(reply)
+	codexSessionID := sessionID
+	if cached {
+		codexSessionID = ""
+	}
+	steps, acceptance := s.parsePlan(reply)
 	conv := &types.Conversation{
 		SessionID:          sessionID,
+		CodexSessionID:     codexSessionID,
+		PlanCached:         cached,
 		Prompt:             prompt,
 		State:              types.StateAwaitingPlanApproval,
 		PlanVersion:        1,
-		PlanText:           reply,
+		PlanCreatedAt:      s.clock(),
+		PlanText:           s.capPlanText(reply),
 		AcceptanceCriteria: acceptance,
 		AwaitingReason:     "Awaiting plan approval",
 		Steps:              steps,
-		ModelCalls: []types.ModelCall{{
-			Prompt:     planPrompt,
-			RawOutput:  raw,
-			Reply:      reply,
-			Timestamp:  s.clock(),
-			DurationMS: duration,
-			SessionID:  sessionID,
-		}},
+		Settings:           settings,
 	}
-	if err := s.store.Save(ctx, conv); err != nil {
+	s.addGitArtifacts(conv, gitContext)
+	s.recordCall(conv, types.ModelCall{
+		Prompt:     planPrompt,
+		Phase:      types.CallPhasePlan,
+		RawOutput:  raw,
+		Reply:      reply,
+		Timestamp:  s.clock(),
+		DurationMS: duration,
+		SessionID:  codexSessionID,
+	})
+	if err := s.save(ctx, conv); err != nil {
 		return nil, err
 	}
-	s.emit(obs.Event{
+	planEvent := obs.Event{
 		Type:        "plan",
 		SessionID:   sessionID,
 		Prompt:      prompt,
 		ModelPrompt: planPrompt,
 		PlanText:    reply,
 		RawOutput:   raw,
-	})
+	}
+	if cached {
+		planEvent.Note = "Served from the plan cache"
+	}
+	s.emit(planEvent)
 	return conv, nil
 }
 
 func (s *Service) ApprovePlan(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
 	conv, err := s.store.Get(ctx, sessionID)
 	if err != nil {
 		return nil, err
@@ -90,28 +240,51 @@ func (s *Service) ApprovePlan(ctx context.Context, sessionID string) (*types.Con
 	if conv.State != types.StateAwaitingPlanApproval {
 		return nil, fmt.Errorf("conversation not awaiting plan approval")
 	}
-	conv.State = types.StateExecuting
-	conv.AwaitingReason = ""
-	if err := s.store.Save(ctx, conv); err != nil {
-		return nil, err
-	}
-	return s.advanceExecution(ctx, conv)
+	return s.startExecution(ctx, conv)
 }
 
 func (s *Service) Resume(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	return s.ResumeWithBudget(ctx, sessionID, 0)
+}
+
+// ResumeWithBudget is Resume that first grants the conversation extraCalls
+// more model calls, for one blocked on its model-call budget. A completed
+// conversation or one awaiting plan approval only gets the raise, so a
+// Continue or RejectPlan refused with ErrModelCallBudget can be retried.
+func (s *Service) ResumeWithBudget(ctx context.Context, sessionID string, extraCalls int) (*types.Conversation, error) {
+	if extraCalls < 0 {
+		return nil, fmt.Errorf("extra_model_calls must not be negative")
+	}
+	defer s.actions.Lock(sessionID)()
 	conv, err := s.store.Get(ctx, sessionID)
 	if err != nil {
 		return nil, err
 	}
-	if conv.State != types.StateBlocked && conv.State != types.StateAwaitingInfo && conv.State != types.StateAwaitingStepApproval && conv.State != types.StateAwaitingCommand && conv.State != types.StateReplanning {
-		return conv, nil
+	raiseOnly := false
+	switch conv.State {
+	case types.StateBlocked, types.StateAwaitingInfo, types.StateAwaitingStepApproval, types.StateAwaitingCommand, types.StateReplanning:
+	case types.StateCompleted, types.StateAwaitingPlanApproval:
+		if extraCalls == 0 {
+			return nil, fmt.Errorf("conversation %s is %s: %w", sessionID, conv.State, ErrNotResumable)
+		}
+		raiseOnly = true
+	default:
+		return nil, fmt.Errorf("conversation %s is %s: %w", sessionID, conv.State, ErrNotResumable)
+	}
+	if extraCalls > 0 {
+		base := s.modelCallLimit(conv)
+		if base <= 0 || base < len(conv.ModelCalls) {
+			base = len(conv.ModelCalls)
+		}
+		conv.ModelCallBudget = base + extraCalls
 	}
-	conv.State = types.StateExecuting
-	conv.AwaitingReason = ""
-	if err := s.store.Save(ctx, conv); err != nil {
-		return nil, err
+	if raiseOnly {
+		if err := s.save(ctx, conv); err != nil {
+			return nil, err
+		}
+		return conv, nil
 	}
-	return s.advanceExecution(ctx, conv)
+	return s.startExecution(ctx, conv)
 }
 
 func (s *Service) Send(ctx context.Context, sessionID, msg string) (*types.ModelCall, error) {
@@ -121,6 +294,15 @@ func (s *Service) Send(ctx context.Context, sessionID, msg string) (*types.Model
 	}
 	var conv *types.Conversation
 	if sessionID != "" {
+		if s.concurrentSends == "reject" {
+			unlock, ok := s.sends.TryLock(sessionID)
+			if !ok {
+				return nil, ErrSendInProgress
+			}
+			defer unlock()
+		} else {
+			defer s.sends.Lock(sessionID)()
+		}
 		found, err := s.store.Get(ctx, sessionID)
 		if err != nil {
 			return nil, err
@@ -135,16 +317,17 @@ func (s *Service) Send(ctx context.Context, sessionID, msg string) (*types.Model
 		for i := range conv.Steps {
 			step := &conv.Steps[i]
 			if step.PendingInfo != "" || step.PendingDependency != "" {
-				step.Logs = append(step.Logs, "USER_INFO: "+msg)
+				s.appendLog(conv, step, "USER_INFO: "+msg)
 				step.PendingInfo = ""
 				step.PendingDependency = ""
+				step.DiscoveryCommands = 0
 				step.Status = types.StepPending
 				conv.State = types.StateExecuting
 				conv.AwaitingReason = ""
-				if err := s.store.Save(ctx, conv); err != nil {
+				if err := s.save(ctx, conv); err != nil {
 					return nil, err
 				}
-				updated, err := s.advanceExecution(ctx, conv)
+				updated, err := s.resumeExecution(ctx, conv)
 				if err != nil {
 					return nil, err
 				}
@@ -160,60 +343,141 @@ func (s *Service) Send(ctx context.Context, sessionID, msg string) (*types.Model
 			}
 		}
 	}
-	reply, raw, newSessionID, duration, err := s.model.Send(ctx, conv.SessionID, msg)
+	if err := s.checkModelCallBudget(conv); err != nil {
+		return nil, err
+	}
+	reply, raw, newSessionID, duration, err := s.model.Send(withWorkDir(ctx, conv.Settings), codexSession(conv), msg)
 	if err != nil {
 		return nil, err
 	}
 	call := types.ModelCall{
 		Prompt:     msg,
+		Phase:      types.CallPhaseChat,
 		RawOutput:  raw,
 		Reply:      reply,
 		Timestamp:  s.clock(),
 		DurationMS: duration,
 		SessionID:  newSessionID,
 	}
-	conv.SessionID = newSessionID
+	if conv.SessionID == "" {
+		conv.SessionID = newSessionID
+	}
+	conv.CodexSessionID = newSessionID
 	conv.Messages = append(conv.Messages, types.Message{Role: "assistant", Content: reply})
-	conv.ModelCalls = append(conv.ModelCalls, call)
-	if err := s.store.Save(ctx, conv); err != nil {
+	s.recordCall(conv, call)
+	if err := s.save(ctx, conv); err != nil {
 		return nil, err
 	}
-	s.emit(obs.Event{
-		Type:        "chat",
-		SessionID:   newSessionID,
-		Prompt:      msg,
-		ModelPrompt: msg,
-		Reply:       reply,
-		RawOutput:   raw,
-	})
+	chatEvent := obs.Event{
+		Type:           "chat",
+		SessionID:      newSessionID,
+		ConversationID: conv.SessionID,
+		Prompt:         msg,
+		ModelPrompt:    msg,
+		Reply:          reply,
+		RawOutput:      raw,
+	}
+	if step := currentStep(conv); step != nil {
+		chatEvent.StepID = step.ID
+		chatEvent.StepTitle = step.Title
+	}
+	s.emit(chatEvent)
 	return &call, nil
 }
 
+// List returns every conversation id, sorted so repeated calls and pages agree.
 func (s *Service) List(ctx context.Context) ([]string, error) {
-	return s.store.ListIDs(ctx)
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ListPage returns up to limit ids of the sorted list starting at offset.
+// A limit of zero returns everything from offset on.
+func (s *Service) ListPage(ctx context.Context, limit, offset int) (*types.ListPage, error) {
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("limit and offset must not be negative")
+	}
+	ids, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	page := &types.ListPage{Total: len(ids), IDs: []string{}}
+	if offset >= len(ids) {
+		return page, nil
+	}
+	end := len(ids)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+		page.NextOffset = end
+	}
+	page.IDs = ids[offset:end]
+	return page, nil
 }
 
 func (s *Service) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
 	return s.store.Get(ctx, sessionID)
 }
 
+// Status returns the polling subset of a conversation, with the awaiting
+// reason and any pending command sanitized for display.
+func (s *Service) Status(ctx context.Context, sessionID string) (*types.ConversationStatus, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	status := &types.ConversationStatus{
+		State:          conv.State,
+		AwaitingReason: s.DisplayText(conv.AwaitingReason),
+		PlanVersion:    conv.PlanVersion,
+		UpdatedAt:      conv.UpdatedAt,
+	}
+	for _, step := range conv.Steps {
+		if step.PendingCommand != "" {
+			status.PendingCommand = s.DisplayText(step.PendingCommand)
+			break
+		}
+	}
+	return status, nil
+}
+
+// GetByCodexSession finds the conversation continuing the given Codex
+// session, for matching Codex's own logs to a conversation.
+func (s *Service) GetByCodexSession(ctx context.Context, codexSessionID string) (*types.Conversation, error) {
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		if codexSession(conv) == codexSessionID {
+			return conv, nil
+		}
+	}
+	return nil, fmt.Errorf("codex session %s %w", codexSessionID, store.ErrNotFound)
+}
+
 func (s *Service) Close(ctx context.Context, sessionID string) error {
 	return s.store.Delete(ctx, sessionID)
 }
 
 // ApproveCommand executes a pending command for a blocked step.
 func (s *Service) ApproveCommand(ctx context.Context, sessionID, stepID string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
 	conv, err := s.store.Get(ctx, sessionID)
 	if err != nil {
 		return nil, err
 	}
-	var target *types.Step
-	for i := range conv.Steps {
-		if conv.Steps[i].ID == stepID {
-			target = &conv.Steps[i]
-			break
-		}
-	}
+	target := findStep(conv, stepID)
 	if target == nil {
 		return nil, fmt.Errorf("step %s not found", stepID)
 	}
@@ -221,19 +485,61 @@ func (s *Service) ApproveCommand(ctx context.Context, sessionID, stepID string)
 		return nil, fmt.Errorf("no pending command for step %s", stepID)
 	}
 	pending := target.PendingCommand
-	cmdCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	if err := s.commandPolicy.Check(pending); err != nil {
+		target.PendingCommand = ""
+		target.CommandProvenance = nil
+		target.Status = types.StepBlocked
+		s.appendLog(conv, target, "REFUSED: "+pending, err.Error())
+		conv.State = types.StateBlocked
+		conv.AwaitingReason = "Command refused by policy: " + err.Error()
+		conv.LastActivityAt = s.clock()
+		if err := s.save(ctx, conv); err != nil {
+			return nil, err
+		}
+		s.emit(obs.Event{
+			Type:      "command",
+			SessionID: conv.SessionID,
+			StepID:    target.ID,
+			StepTitle: target.Title,
+			Command:   pending,
+			Note:      "REFUSED: " + err.Error(),
+		})
+		return conv, nil
+	}
+	trackedCtx, untrack := s.trackCommand(ctx, sessionID)
+	defer untrack()
+	timeout := s.commandTimeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	if d := stepTimeout(target); d > 0 {
+		timeout = d
+	}
+	cmdCtx, cancel := context.WithTimeout(trackedCtx, timeout)
 	defer cancel()
-	cmd := exec.CommandContext(cmdCtx, "sh", "-c", pending)
-	out, err := cmd.CombinedOutput()
+	out, err := s.runner.Run(withWorkDir(cmdCtx, conv.Settings), pending)
+	if stored, aborted := s.abortedMeanwhile(ctx, sessionID); aborted {
+		return stored, nil
+	}
 	output := string(out)
-	target.Logs = append(target.Logs, "EXEC: "+pending, output)
+	s.appendLog(conv, target, "EXEC: "+pending, output)
 	target.PendingCommand = ""
-	artifact := s.addArtifact(conv, "Command output", fmt.Sprintf("Output for `%s`", pending), output, pending)
+	target.CommandProvenance = nil
+	conv.LastActivityAt = s.clock()
+	var artifactID string
+	if s.commandArtifact(conv, err != nil) {
+		artifactID = s.addArtifact(conv, "Command output", fmt.Sprintf("Output for `%s`", pending), output, pending).ID
+	}
 	if err != nil {
 		target.Status = types.StepBlocked
 		conv.State = types.StateBlocked
 		conv.AwaitingReason = fmt.Sprintf("Command failed: %v", err)
-		_ = s.store.Save(ctx, conv)
+		note := "ERROR: " + err.Error()
+		if errors.Is(context.Cause(trackedCtx), errCommandCanceled) {
+			conv.AwaitingReason = "Command canceled by user"
+			note = "CANCELED"
+		}
+		_ = s.save(ctx, conv)
 		s.emit(obs.Event{
 			Type:       "command",
 			SessionID:  conv.SessionID,
@@ -241,106 +547,791 @@ func (s *Service) ApproveCommand(ctx context.Context, sessionID, stepID string)
 			StepTitle:  target.Title,
 			Command:    pending,
 			RawOutput:  output,
-			Note:       "ERROR: " + err.Error(),
-			ArtifactID: artifact.ID,
+			Note:       note,
+			ArtifactID: artifactID,
 		})
 		return conv, nil
 	}
-	target.Status = types.StepDone
-	target.CompletedAt = s.clock()
-	conv.State = types.StateExecuting
-	conv.AwaitingReason = ""
-	if err := s.store.Save(ctx, conv); err != nil {
+	target.Status = types.StepDone
+	target.CompletedAt = s.clock()
+	conv.State = types.StateExecuting
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	untrack()
+	s.emit(obs.Event{
+		Type:       "command",
+		SessionID:  conv.SessionID,
+		StepID:     target.ID,
+		StepTitle:  target.Title,
+		Command:    pending,
+		RawOutput:  output,
+		Note:       "SUCCESS",
+		ArtifactID: artifactID,
+	})
+	return s.resumeExecution(ctx, conv)
+}
+
+// EditAndRetryStep retitles a failed or blocked step, resets it to pending, and re-runs execution from it.
+func (s *Service) EditAndRetryStep(ctx context.Context, sessionID, stepID, newTitle string) (*types.Conversation, error) {
+	newTitle = strings.TrimSpace(newTitle)
+	if newTitle == "" {
+		return nil, fmt.Errorf("title is required")
+	}
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	target := findStep(conv, stepID)
+	if target == nil {
+		return nil, fmt.Errorf("step %s not found", stepID)
+	}
+	if target.Status != types.StepBlocked && target.Status != types.StepFailed {
+		return nil, fmt.Errorf("step %s has not failed (status %s)", stepID, target.Status)
+	}
+	s.appendLog(conv, target, fmt.Sprintf("EDITED: %q -> %q", target.Title, newTitle))
+	target.Title = newTitle
+	target.Status = types.StepPending
+	target.DiscoveryCommands = 0
+	clearPending(target)
+	return s.startExecution(ctx, conv)
+}
+
+// SetStepTimeout gives a step that has not run yet its own time budget, which
+// bounds its model call and any command it requests regardless of the global
+// command timeout. A step that runs out is marked blocked. Zero clears it.
+func (s *Service) SetStepTimeout(ctx context.Context, sessionID, stepID string, seconds int) (*types.Conversation, error) {
+	if seconds < 0 {
+		return nil, fmt.Errorf("timeout_seconds must not be negative")
+	}
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	target := findStep(conv, stepID)
+	if target == nil {
+		return nil, fmt.Errorf("step %s not found", stepID)
+	}
+	if target.Status == types.StepDone || target.Status == types.StepInProgress {
+		return nil, fmt.Errorf("step %s is %s; its timeout can no longer change", stepID, target.Status)
+	}
+	target.TimeoutSeconds = seconds
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// SetPriority sets the inbox priority of a conversation in any state.
+func (s *Service) SetPriority(ctx context.Context, sessionID string, priority int) (*types.Conversation, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	conv.Priority = priority
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// ResetSession drops conv's Codex session so its next model call starts a
+// fresh one, keeping the plan, steps, and progress. It is refused while a
+// model call may be in flight, since that call would bring the old session back.
+func (s *Service) ResetSession(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State == types.StateExecuting || conv.State == types.StateVerifying {
+		return nil, fmt.Errorf("conversation is %s; wait for it to stop before resetting its session", conv.State)
+	}
+	previous := codexSession(conv)
+	conv.CodexSessionID = ""
+	conv.VerifySessionID = ""
+	conv.SessionReset = true
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:      "session_reset",
+		SessionID: conv.SessionID,
+		State:     string(conv.State),
+		Note:      fmt.Sprintf("Codex session %s cleared", previous),
+	})
+	return conv, nil
+}
+
+// stepTimeout is step's own execution budget, or zero when it has none.
+func stepTimeout(step *types.Step) time.Duration {
+	if step == nil || step.TimeoutSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(step.TimeoutSeconds) * time.Second
+}
+
+// RestartFromStep resets stepID and every later step to pending and re-runs execution from there.
+func (s *Service) RestartFromStep(ctx context.Context, sessionID, stepID string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State == types.StateExecuting || conv.State == types.StateVerifying {
+		return nil, fmt.Errorf("conversation is %s; wait for it to stop before restarting", conv.State)
+	}
+	start := -1
+	for i := range conv.Steps {
+		if conv.Steps[i].ID == stepID {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("step %s not found", stepID)
+	}
+	for i := start; i < len(conv.Steps); i++ {
+		step := &conv.Steps[i]
+		step.Status = types.StepPending
+		step.Logs = []string{}
+		step.DiscoveryCommands = 0
+		clearPending(step)
+		step.StartedAt = time.Time{}
+		step.CompletedAt = time.Time{}
+	}
+	conv.CompletedMessage = ""
+	conv.CompletedAt = time.Time{}
+	return s.startExecution(ctx, conv)
+}
+
+// SetState forces a conversation into state, recording an audit transition.
+// It is an operator override for recovery and does not run execution. The
+// reason becomes the awaiting reason only for states that wait on something;
+// entering any other state clears it.
+func (s *Service) SetState(ctx context.Context, sessionID string, state types.ConversationState, reason string) (*types.Conversation, error) {
+	if !state.Valid() {
+		return nil, fmt.Errorf("unknown state %q", state)
+	}
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	conv.Transitions = append(conv.Transitions, types.StateTransition{
+		From:   conv.State,
+		To:     state,
+		Reason: reason,
+		Actor:  "admin",
+		At:     s.clock(),
+	})
+	conv.State = state
+	conv.AwaitingReason = ""
+	if waitingState(state) {
+		conv.AwaitingReason = reason
+	}
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:      "state",
+		SessionID: conv.SessionID,
+		Prompt:    conv.Prompt,
+		Note:      fmt.Sprintf("admin override to %s: %s", state, reason),
+	})
+	return conv, nil
+}
+
+// waitingState reports whether a conversation in state is held up by
+// something an AwaitingReason explains. Planning, executing and finished
+// conversations are not.
+func waitingState(state types.ConversationState) bool {
+	switch state {
+	case types.StatePlanning, types.StateExecuting, types.StateCompleted, types.StateAborted:
+		return false
+	}
+	return true
+}
+
+// Complete finishes a conversation that is awaiting human completion review.
+func (s *Service) Complete(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State != types.StateAwaitingCompletion {
+		return nil, fmt.Errorf("conversation not awaiting completion review")
+	}
+	return s.completeConversation(ctx, conv)
+}
+
+// VerifyNow skips the remaining steps of a waiting conversation and checks
+// the acceptance criteria against the progress so far. A PASS completes the
+// conversation; a FAIL is handled like any failed verification. It is refused
+// while a step is executing, since that step owns the conversation until it
+// stops.
+func (s *Service) VerifyNow(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	switch conv.State {
+	case types.StateAwaitingCommand, types.StateAwaitingInfo, types.StateAwaitingStepApproval:
+	case types.StateExecuting:
+		// The running step would save over the verification when it returns.
+		return nil, fmt.Errorf("conversation is executing; verify early once it stops for input")
+	default:
+		return nil, fmt.Errorf("conversation is %s; only waiting conversations can be verified early", conv.State)
+	}
+	if len(conv.AcceptanceCriteria) == 0 {
+		return nil, fmt.Errorf("conversation has no acceptance criteria to verify")
+	}
+	for i := range conv.Steps {
+		clearPending(&conv.Steps[i])
+	}
+	conv.State = types.StateVerifying
+	conv.AwaitingReason = "Verifying acceptance criteria (requested early)"
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return s.verifyAcceptance(ctx, conv)
+}
+
+// DenyCommand refuses the command pending on a step and asks the model for a
+// new plan that reaches the goal without it.
+func (s *Service) DenyCommand(ctx context.Context, sessionID, stepID, reason string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	target := findStep(conv, stepID)
+	if target == nil {
+		return nil, fmt.Errorf("step %s not found", stepID)
+	}
+	if target.PendingCommand == "" {
+		return nil, fmt.Errorf("no pending command for step %s", stepID)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = "denied by user"
+	}
+	denied := target.PendingCommand
+	target.PendingCommand = ""
+	target.CommandProvenance = nil
+	target.Status = types.StepBlocked
+	s.appendLog(conv, target, "DENIED: "+reason)
+	conv.State = types.StateReplanning
+	conv.AwaitingReason = fmt.Sprintf("Command `%s` was denied: %s", denied, reason)
+	conv.LastActivityAt = s.clock()
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:      "command",
+		SessionID: conv.SessionID,
+		StepID:    target.ID,
+		StepTitle: target.Title,
+		Command:   denied,
+		Note:      "DENIED: " + reason,
+	})
+	blockReason := conv.AwaitingReason + ". Do not run that command; propose an alternative approach."
+	if err := s.resolveBlock(ctx, conv, blockReason, target.Title); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// Abort terminates a conversation that hasn't finished, recording reason as
+// its final message. A running command is stopped, and background execution
+// halts before its next step.
+func (s *Service) Abort(ctx context.Context, sessionID, reason string) (*types.Conversation, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State == types.StateCompleted || conv.State == types.StateAborted {
+		return nil, fmt.Errorf("conversation already %s", conv.State)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = "Aborted by user"
+	}
+	if err := s.abort(ctx, conv, reason); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	rc := s.commands[sessionID]
+	s.mu.Unlock()
+	if rc != nil {
+		rc.cancel(ErrAborted)
+	}
+	return conv, nil
+}
+
+// Continue reopens a completed conversation with a follow-up goal. It plans
+// the follow-up in the same model session, so earlier work stays in context,
+// and waits for plan approval again.
+func (s *Service) Continue(ctx context.Context, sessionID, newPrompt string) (*types.Conversation, error) {
+	newPrompt = strings.TrimSpace(newPrompt)
+	if newPrompt == "" {
+		return nil, fmt.Errorf("prompt is required")
+	}
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State != types.StateCompleted {
+		return nil, fmt.Errorf("conversation is %s; only completed conversations can continue", conv.State)
+	}
+	if err := s.checkModelCallBudget(conv); err != nil {
+		return nil, err
+	}
+	planPrompt, err := s.renderPlanPrompt(newPrompt)
+	if err != nil {
+		return nil, err
+	}
+	reply, raw, newSession, duration, err := s.model.Send(withWorkDir(ctx, conv.Settings), codexSession(conv), planPrompt)
+	if err != nil {
+		return nil, err
+	}
+	conv.CodexSessionID = newSession
+	conv.Prompt += "\nFollow-up: " + newPrompt
+	conv.Messages = append(conv.Messages, types.Message{Role: "user", Content: newPrompt})
+	conv.PlanText = s.capPlanText(reply)
+	conv.Steps, conv.AcceptanceCriteria = s.parsePlan(reply)
+	conv.PlanVersion++
+	conv.PlanCreatedAt = s.clock()
+	conv.State = types.StateAwaitingPlanApproval
+	conv.AwaitingReason = "Awaiting approval of follow-up plan"
+	conv.MetCriteria = nil
+	conv.CompletedMessage = ""
+	conv.CompletedAt = time.Time{}
+	s.recordCall(conv, types.ModelCall{
+		Prompt:     planPrompt,
+		Phase:      types.CallPhasePlan,
+		RawOutput:  raw,
+		Reply:      reply,
+		Timestamp:  s.clock(),
+		DurationMS: duration,
+		SessionID:  newSession,
+	})
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:        "plan",
+		SessionID:   conv.SessionID,
+		Prompt:      newPrompt,
+		ModelPrompt: planPrompt,
+		PlanText:    reply,
+		RawOutput:   raw,
+		Note:        "Follow-up plan",
+	})
+	return conv, nil
+}
+
+// UpdatePlan replaces the plan awaiting approval with planText as edited by
+// the user. The new plan bumps PlanVersion and still needs approval.
+func (s *Service) UpdatePlan(ctx context.Context, sessionID, planText string) (*types.Conversation, error) {
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State != types.StateAwaitingPlanApproval {
+		return nil, fmt.Errorf("conversation not awaiting plan approval")
+	}
+	steps, acceptance := s.parsePlan(planText)
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("plan has no steps")
+	}
+	conv.PlanText = s.capPlanText(strings.TrimSpace(planText))
+	conv.Steps, conv.AcceptanceCriteria = steps, acceptance
+	conv.PlanVersion++
+	conv.PlanCreatedAt = s.clock()
+	conv.AwaitingReason = "Awaiting approval of edited plan"
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:      "plan",
+		SessionID: conv.SessionID,
+		Prompt:    conv.Prompt,
+		PlanText:  conv.PlanText,
+		Note:      "Plan edited by user",
+	})
+	return conv, nil
+}
+
+// RejectPlan discards the plan awaiting approval and asks the model for a new
+// one that addresses the user's feedback. The revised plan bumps PlanVersion
+// and waits for approval again; if replanning fails the old plan is kept.
+func (s *Service) RejectPlan(ctx context.Context, sessionID, feedback string) (*types.Conversation, error) {
+	feedback = strings.TrimSpace(feedback)
+	if feedback == "" {
+		return nil, fmt.Errorf("feedback is required")
+	}
+	defer s.actions.Lock(sessionID)()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.State != types.StateAwaitingPlanApproval {
+		return nil, fmt.Errorf("conversation not awaiting plan approval")
+	}
+	if err := s.checkModelCallBudget(conv); err != nil {
+		return nil, err
+	}
+	conv.Messages = append(conv.Messages, types.Message{Role: "user", Content: feedback})
+	conv.State = types.StateReplanning
+	conv.AwaitingReason = "Replanning after plan rejection"
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	prompt, err := s.renderRejectPlanPrompt(conv, feedback)
+	var reply, raw, newSession string
+	var duration int64
+	if err == nil {
+		reply, raw, newSession, duration, err = s.model.Send(withWorkDir(ctx, conv.Settings), codexSession(conv), prompt)
+	}
+	if err != nil {
+		conv.State = types.StateAwaitingPlanApproval
+		conv.AwaitingReason = "Awaiting plan approval"
+		_ = s.save(context.WithoutCancel(ctx), conv)
+		return nil, fmt.Errorf("replan: %w", err)
+	}
+	conv.CodexSessionID = newSession
+	conv.PlanText = s.capPlanText(reply)
+	conv.Steps, conv.AcceptanceCriteria = s.parsePlan(reply)
+	conv.PlanVersion++
+	conv.PlanCreatedAt = s.clock()
+	conv.State = types.StateAwaitingPlanApproval
+	conv.AwaitingReason = "Awaiting approval of revised plan"
+	s.recordCall(conv, types.ModelCall{
+		Prompt:     prompt,
+		Phase:      types.CallPhaseReplan,
+		RawOutput:  raw,
+		Reply:      reply,
+		Timestamp:  s.clock(),
+		DurationMS: duration,
+		SessionID:  newSession,
+	})
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	s.emit(obs.Event{
+		Type:        "plan",
+		SessionID:   conv.SessionID,
+		Prompt:      conv.Prompt,
+		ModelPrompt: prompt,
+		PlanText:    reply,
+		RawOutput:   raw,
+		Note:        "Revised plan after rejection",
+	})
+	return conv, nil
+}
+
+// PreviewStepPrompt renders the execution prompt a step would receive next,
+// without calling the model or reporting context truncation.
+func (s *Service) PreviewStepPrompt(ctx context.Context, sessionID, stepID string) (string, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	step := findStep(conv, stepID)
+	if step == nil {
+		return "", fmt.Errorf("step %s not found", stepID)
+	}
+	return s.renderExecutePrompt(conv, step, s.executionContext(conv, "preview", false))
+}
+
+// ChatMessages exports the conversation as OpenAI-style chat messages: a system
+// message with the goal and criteria, the prompt and plan, then each step
+// that has run as a user/assistant exchange, followed by any chat messages.
+// Consecutive turns from the same role are merged so roles alternate.
+func (s *Service) ChatMessages(ctx context.Context, sessionID string) ([]types.Message, error) {
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	system := "You are helping with this goal: " + conv.Prompt
+	if len(conv.AcceptanceCriteria) > 0 {
+		system += "\nAcceptance criteria:\n- " + strings.Join(conv.AcceptanceCriteria, "\n- ")
+	}
+	msgs := []types.Message{{Role: "system", Content: system}}
+	if conv.PlanText != "" {
+		msgs = appendTurn(msgs, "user", conv.Prompt)
+		msgs = appendTurn(msgs, "assistant", "Plan:\n"+conv.PlanText)
+	}
+	for _, step := range conv.Steps {
+		if len(step.Logs) == 0 {
+			continue
+		}
+		msgs = appendTurn(msgs, "user", "Execute step: "+step.Title)
+		msgs = appendTurn(msgs, "assistant", strings.Join(step.Logs, "\n"))
+	}
+	for _, m := range conv.Messages {
+		msgs = appendTurn(msgs, m.Role, m.Content)
+	}
+	return msgs, nil
+}
+
+// appendTurn adds a message, folding it into the previous one when the role repeats.
+func appendTurn(msgs []types.Message, role, content string) []types.Message {
+	if content == "" {
+		return msgs
+	}
+	if n := len(msgs); n > 0 && msgs[n-1].Role == role {
+		msgs[n-1].Content += "\n\n" + content
+		return msgs
+	}
+	return append(msgs, types.Message{Role: role, Content: content})
+}
+
+// PlanAndExecute plans prompt and runs it within the call until it
+// finishes or stops for input, for scripts that want to block. It does not
+// go through the background worker or the MaxExecuting cap.
+func (s *Service) PlanAndExecute(ctx context.Context, prompt string) (string, error) {
+	conv, err := s.CreateConversation(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	conv.State = types.StateExecuting
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		return "", err
+	}
+	conv, err = s.advanceExecution(ctx, conv)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Conversation %s completed with state %s", conv.SessionID, conv.State), nil
+}
+
+func (s *Service) ListInbox(ctx context.Context) ([]types.InboxItem, error) {
+	return s.ListInboxStates(ctx, nil)
+}
+
+// ListInboxStates is ListInbox restricted to items in one of states; an
+// empty set returns every item.
+func (s *Service) ListInboxStates(ctx context.Context, states map[types.ConversationState]bool) ([]types.InboxItem, error) {
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inbox := make([]types.InboxItem, 0)
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		if len(states) > 0 && !states[conv.State] {
+			continue
+		}
+		if item, ok := inboxItem(conv); ok {
+			item.PendingCommand = s.DisplayText(item.PendingCommand)
+			item.AwaitingReason = s.DisplayText(item.AwaitingReason)
+			item.PendingInfo = s.DisplayText(item.PendingInfo)
+			item.PendingDependency = s.DisplayText(item.PendingDependency)
+			inbox = append(inbox, item)
+		}
+	}
+	// Highest priority first; within a priority, whoever has waited longest.
+	sort.SliceStable(inbox, func(i, j int) bool {
+		if inbox[i].Priority != inbox[j].Priority {
+			return inbox[i].Priority > inbox[j].Priority
+		}
+		if !inbox[i].LastActivityAt.Equal(inbox[j].LastActivityAt) {
+			return inbox[i].LastActivityAt.Before(inbox[j].LastActivityAt)
+		}
+		return inbox[i].SessionID < inbox[j].SessionID
+	})
+	return inbox, nil
+}
+
+// AllArtifacts lists artifacts from every conversation, oldest first. A
+// non-empty filter keeps only artifacts whose title or source contains it,
+// ignoring case.
+func (s *Service) AllArtifacts(ctx context.Context, filter string) ([]types.ArtifactRef, error) {
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	refs := make([]types.ArtifactRef, 0)
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		for _, art := range conv.Artifacts {
+			if filter != "" && !strings.Contains(strings.ToLower(art.Title), filter) && !strings.Contains(strings.ToLower(art.Source), filter) {
+				continue
+			}
+			art.Content = s.DisplayText(art.Content)
+			refs = append(refs, types.ArtifactRef{SessionID: conv.SessionID, Artifact: art})
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		if !refs[i].CreatedAt.Equal(refs[j].CreatedAt) {
+			return refs[i].CreatedAt.Before(refs[j].CreatedAt)
+		}
+		return refs[i].ID < refs[j].ID
+	})
+	return refs, nil
+}
+
+// OutstandingQuestions lists the pending info and dependency requests of every
+// conversation awaiting info, so an operator can answer them from one queue.
+func (s *Service) OutstandingQuestions(ctx context.Context) ([]types.Question, error) {
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
 		return nil, err
 	}
-	s.emit(obs.Event{
-		Type:       "command",
-		SessionID:  conv.SessionID,
-		StepID:     target.ID,
-		StepTitle:  target.Title,
-		Command:    pending,
-		RawOutput:  output,
-		Note:       "SUCCESS",
-		ArtifactID: artifact.ID,
-	})
-	return s.advanceExecution(ctx, conv)
+	questions := make([]types.Question, 0)
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil || conv.State != types.StateAwaitingInfo {
+			continue
+		}
+		for _, step := range conv.Steps {
+			q := types.Question{SessionID: conv.SessionID, Prompt: conv.Prompt, StepID: step.ID, StepTitle: step.Title}
+			if step.PendingInfo != "" {
+				q.Kind, q.Question = "info", s.DisplayText(step.PendingInfo)
+				questions = append(questions, q)
+			}
+			if step.PendingDependency != "" {
+				q.Kind, q.Question = "dependency", s.DisplayText(step.PendingDependency)
+				questions = append(questions, q)
+			}
+		}
+	}
+	return questions, nil
 }
 
-func (s *Service) PlanAndExecute(ctx context.Context, prompt string) (string, error) {
-	conv, err := s.CreateConversation(ctx, prompt)
+// InboxCounts tallies actionable conversations by state without building the
+// full inbox payload. When the store implements store.StateLister, only
+// conversations whose membership depends on their current step are loaded;
+// the rest are counted from their state alone. Every completion records a
+// completion message, so completed conversations count without being loaded.
+func (s *Service) InboxCounts(ctx context.Context) (map[types.ConversationState]int, error) {
+	lister, ok := s.store.(store.StateLister)
+	if !ok {
+		return s.inboxCountsByLoading(ctx)
+	}
+	states, err := lister.ListStates(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	conv.State = types.StateExecuting
-	conv.AwaitingReason = ""
-	if err := s.store.Save(ctx, conv); err != nil {
-		return "", err
+	counts := make(map[types.ConversationState]int)
+	for id, state := range states {
+		switch state {
+		case types.StateAwaitingCommand, types.StateBlocked, types.StateAwaitingInfo:
+			conv, err := s.store.Get(ctx, id)
+			if err != nil {
+				continue
+			}
+			if _, ok := inboxItem(conv); ok {
+				counts[conv.State]++
+			}
+		case types.StateAwaitingPlanApproval, types.StateAwaitingStepApproval, types.StateReplanning,
+			types.StateAwaitingCompletion, types.StateCompleted:
+			counts[state]++
+		}
 	}
-	conv, err = s.advanceExecution(ctx, conv)
+	return counts, nil
+}
+
+// inboxCountsByLoading is InboxCounts for stores that cannot list states.
+func (s *Service) inboxCountsByLoading(ctx context.Context) (map[types.ConversationState]int, error) {
+	ids, err := s.store.ListIDs(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return fmt.Sprintf("Conversation %s completed with state %s", conv.SessionID, conv.State), nil
+	counts := make(map[types.ConversationState]int)
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		if _, ok := inboxItem(conv); ok {
+			counts[conv.State]++
+		}
+	}
+	return counts, nil
 }
 
-func (s *Service) ListInbox(ctx context.Context) ([]types.InboxItem, error) {
+// StuckConversations returns executing conversations with no model call or command activity within threshold.
+func (s *Service) StuckConversations(ctx context.Context, threshold time.Duration) ([]*types.Conversation, error) {
 	ids, err := s.store.ListIDs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var inbox []types.InboxItem
+	cutoff := s.clock().Add(-threshold)
+	stuck := make([]*types.Conversation, 0)
 	for _, id := range ids {
 		conv, err := s.store.Get(ctx, id)
 		if err != nil {
 			continue
 		}
-		item := types.InboxItem{
-			SessionID:        conv.SessionID,
-			State:            conv.State,
-			AwaitingReason:   conv.AwaitingReason,
-			Prompt:           conv.Prompt,
-			CompletedMessage: conv.CompletedMessage,
-			CompletedAt:      conv.CompletedAt,
+		if conv.State != types.StateExecuting || conv.LastActivityAt.IsZero() {
+			continue
 		}
-		switch conv.State {
-		case types.StateAwaitingPlanApproval:
-			inbox = append(inbox, item)
-		case types.StateAwaitingCommand, types.StateBlocked:
-			var pendingStep *types.Step
-			for i := range conv.Steps {
-				if conv.Steps[i].PendingCommand != "" {
-					pendingStep = &conv.Steps[i]
-					break
-				}
-			}
-			if pendingStep != nil {
-				item.StepID = pendingStep.ID
-				item.StepTitle = pendingStep.Title
-				item.PendingCommand = pendingStep.PendingCommand
-				inbox = append(inbox, item)
-			}
-		case types.StateAwaitingInfo:
-			for i := range conv.Steps {
-				if conv.Steps[i].PendingInfo != "" || conv.Steps[i].PendingDependency != "" {
-					item.StepID = conv.Steps[i].ID
-					item.StepTitle = conv.Steps[i].Title
-					item.PendingInfo = conv.Steps[i].PendingInfo
-					item.PendingDependency = conv.Steps[i].PendingDependency
-					inbox = append(inbox, item)
-					break
-				}
-			}
-		case types.StateAwaitingStepApproval:
-			inbox = append(inbox, item)
-		case types.StateReplanning:
-			inbox = append(inbox, item)
-		case types.StateCompleted:
-			if conv.CompletedMessage != "" {
-				inbox = append(inbox, item)
-			}
+		if conv.LastActivityAt.Before(cutoff) {
+			stuck = append(stuck, conv)
 		}
 	}
-	return inbox, nil
+	return stuck, nil
+}
+
+// inboxItem summarizes conv for the inbox and reports whether it needs attention.
+func inboxItem(conv *types.Conversation) (types.InboxItem, bool) {
+	item := types.InboxItem{
+		SessionID:        conv.SessionID,
+		State:            conv.State,
+		AwaitingReason:   conv.AwaitingReason,
+		Prompt:           conv.Prompt,
+		CompletedMessage: conv.CompletedMessage,
+		CompletedAt:      conv.CompletedAt,
+		Priority:         conv.Priority,
+		LastActivityAt:   conv.LastActivityAt,
+	}
+	switch conv.State {
+	case types.StateAwaitingPlanApproval:
+		return item, true
+	case types.StateAwaitingCommand, types.StateBlocked:
+		// Only the current step's command is actionable; steps run in order.
+		if step := currentStep(conv); step != nil && step.PendingCommand != "" {
+			item.StepID = step.ID
+			item.StepTitle = step.Title
+			item.PendingCommand = step.PendingCommand
+			item.CommandProvenance = step.CommandProvenance
+			return item, true
+		}
+	case types.StateAwaitingInfo:
+		if step := currentStep(conv); step != nil && (step.PendingInfo != "" || step.PendingDependency != "") {
+			item.StepID = step.ID
+			item.StepTitle = step.Title
+			item.PendingInfo = step.PendingInfo
+			item.PendingDependency = step.PendingDependency
+			return item, true
+		}
+	case types.StateAwaitingStepApproval:
+		return item, true
+	case types.StateReplanning:
+		return item, true
+	case types.StateAwaitingCompletion:
+		return item, true
+	case types.StateCompleted:
+		if conv.CompletedMessage != "" {
+			return item, true
+		}
+	}
+	return item, false
 }
 
 func (s *Service) advanceExecution(ctx context.Context, conv *types.Conversation) (*types.Conversation, error) {
@@ -349,74 +1340,99 @@ func (s *Service) advanceExecution(ctx context.Context, conv *types.Conversation
 		if step.Status == types.StepDone {
 			continue
 		}
+		if stored, aborted := s.abortedMeanwhile(ctx, conv.SessionID); aborted {
+			return stored, nil
+		}
+		if err := s.checkModelCallBudget(conv); err != nil {
+			return s.blockOnBudget(ctx, conv, err)
+		}
 		if step.RequiresApproval {
 			conv.State = types.StateAwaitingStepApproval
 			conv.AwaitingReason = fmt.Sprintf("Awaiting manual approval for step %s", step.Title)
-			if err := s.store.Save(ctx, conv); err != nil {
+			if err := s.save(ctx, conv); err != nil {
 				return nil, err
 			}
 			return conv, nil
 		}
+		// A re-run supersedes whatever the step asked for last time, so at
+		// most one pending request (this step's) exists per conversation.
+		clearPending(step)
+		step.Result = ""
 		step.Status = types.StepInProgress
 		step.StartedAt = s.clock()
-		contextLogs := summarizeLogs(conv, 5)
+		contextLogs := s.executionContext(conv, "execute", true)
 		execPrompt, err := s.renderExecutePrompt(conv, step, contextLogs)
 		if err != nil {
 			return nil, err
 		}
-		reply, raw, newSession, duration, err := s.model.Send(ctx, conv.SessionID, execPrompt)
-		conv.SessionID = newSession
+		sendCtx, cancelSend := ctx, context.CancelFunc(func() {})
+		if d := stepTimeout(step); d > 0 {
+			sendCtx, cancelSend = context.WithTimeout(ctx, d)
+		}
+		reply, raw, newSession, duration, err := s.sendStreaming(sendCtx, s.model, conv, step, codexSession(conv), execPrompt)
+		if err != nil && ctx.Err() == nil && errors.Is(sendCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("step timed out after %s", stepTimeout(step))
+		}
+		cancelSend()
+		conv.CodexSessionID = newSession
 		call := types.ModelCall{
 			Prompt:     execPrompt,
+			Phase:      types.CallPhaseStep,
 			RawOutput:  raw,
 			Reply:      reply,
 			Timestamp:  s.clock(),
 			DurationMS: duration,
 			SessionID:  newSession,
 		}
-		conv.ModelCalls = append(conv.ModelCalls, call)
-		step.Logs = append(step.Logs, reply)
+		s.recordCall(conv, call)
+		s.appendLog(conv, step, reply)
+		if conv.Settings.LogVerbosity == types.LogVerbosityFull && raw != "" {
+			s.appendLog(conv, step, "RAW: "+raw)
+		}
 		step.CompletedAt = s.clock()
 		stepEvent := obs.Event{
-			Type:        "step",
-			SessionID:   newSession,
-			Prompt:      conv.Prompt,
-			ModelPrompt: execPrompt,
-			StepID:      step.ID,
-			StepTitle:   step.Title,
-			RawOutput:   raw,
-			Reply:       reply,
-		}
-		upper := strings.ToUpper(strings.TrimSpace(reply))
-		if strings.HasPrefix(upper, "COMMAND:") {
-			cmdText := strings.TrimSpace(reply[len("COMMAND:"):])
+			Type:           "step",
+			SessionID:      newSession,
+			ConversationID: conv.SessionID,
+			Prompt:         conv.Prompt,
+			ModelPrompt:    execPrompt,
+			StepID:         step.ID,
+			StepTitle:      step.Title,
+			RawOutput:      raw,
+			Reply:          reply,
+		}
+		keyword, payload := s.directive(reply)
+		if keyword == "COMMAND" {
+			cmdText := payload
 			step.PendingCommand = cmdText
+			step.CommandProvenance = nil
 			step.Status = types.StepBlocked
 			conv.State = types.StateAwaitingCommand
 			conv.AwaitingReason = "Awaiting approval to run: " + cmdText
 			stepEvent.Command = cmdText
 			stepEvent.Note = "COMMAND_REQUEST"
 			s.emit(stepEvent)
-			if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+			if saveErr := s.save(ctx, conv); saveErr != nil {
 				return nil, saveErr
 			}
 			return conv, nil
 		}
-		if strings.HasPrefix(upper, "NEED:") {
-			info := strings.TrimSpace(reply[len("NEED:"):])
-			cmd, cmdCall := s.proposeDiscoveryCommand(ctx, conv, info, "info")
+		if keyword == "NEED" {
+			info := payload
+			cmd, cmdCall := s.proposeDiscoveryCommand(ctx, conv, step, info, "info")
 			if cmdCall != nil {
-				conv.ModelCalls = append(conv.ModelCalls, *cmdCall)
+				s.recordCall(conv, *cmdCall)
 			}
 			if cmd != "" {
 				step.PendingCommand = cmd
+				step.CommandProvenance = discoveryProvenance(conv, info, "info")
 				step.Status = types.StepBlocked
 				conv.State = types.StateAwaitingCommand
 				conv.AwaitingReason = "Awaiting approval to gather info: " + info
 				stepEvent.Command = cmd
 				stepEvent.Note = "INFO_COMMAND_REQUEST"
 				s.emit(stepEvent)
-				if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+				if saveErr := s.save(ctx, conv); saveErr != nil {
 					return nil, saveErr
 				}
 				return conv, nil
@@ -427,26 +1443,27 @@ func (s *Service) advanceExecution(ctx context.Context, conv *types.Conversation
 			conv.AwaitingReason = "Needs info: " + info
 			stepEvent.Note = conv.AwaitingReason
 			s.emit(stepEvent)
-			if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+			if saveErr := s.save(ctx, conv); saveErr != nil {
 				return nil, saveErr
 			}
 			return conv, nil
 		}
-		if strings.HasPrefix(upper, "DEPENDENCY:") {
-			dep := strings.TrimSpace(reply[len("DEPENDENCY:"):])
-			cmd, cmdCall := s.proposeDiscoveryCommand(ctx, conv, dep, "dependency")
+		if keyword == "DEPENDENCY" {
+			dep := payload
+			cmd, cmdCall := s.proposeDiscoveryCommand(ctx, conv, step, dep, "dependency")
 			if cmdCall != nil {
-				conv.ModelCalls = append(conv.ModelCalls, *cmdCall)
+				s.recordCall(conv, *cmdCall)
 			}
 			if cmd != "" {
 				step.PendingCommand = cmd
+				step.CommandProvenance = discoveryProvenance(conv, dep, "dependency")
 				step.Status = types.StepBlocked
 				conv.State = types.StateAwaitingCommand
 				conv.AwaitingReason = "Awaiting approval to satisfy dependency: " + dep
 				stepEvent.Command = cmd
 				stepEvent.Note = "DEPENDENCY_COMMAND_REQUEST"
 				s.emit(stepEvent)
-				if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+				if saveErr := s.save(ctx, conv); saveErr != nil {
 					return nil, saveErr
 				}
 				return conv, nil
@@ -457,14 +1474,17 @@ func (s *Service) advanceExecution(ctx context.Context, conv *types.Conversation
 			conv.AwaitingReason = "Dependency required: " + dep
 			stepEvent.Note = conv.AwaitingReason
 			s.emit(stepEvent)
-			if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+			if saveErr := s.save(ctx, conv); saveErr != nil {
 				return nil, saveErr
 			}
 			return conv, nil
 		}
-		if err != nil || strings.HasPrefix(upper, "BLOCKED") || strings.HasPrefix(upper, "ERROR") {
+		if err != nil || keyword == "BLOCKED" || keyword == "ERROR" {
 			step.Status = types.StepBlocked
 			conv.State = types.StateReplanning
+			if s.blockEscalation == "human" {
+				conv.State = types.StateBlocked
+			}
 			if err != nil {
 				conv.AwaitingReason = fmt.Sprintf("Execution blocked: %v", err)
 			} else {
@@ -472,29 +1492,45 @@ func (s *Service) advanceExecution(ctx context.Context, conv *types.Conversation
 			}
 			stepEvent.Note = conv.AwaitingReason
 			s.emit(stepEvent)
-			if saveErr := s.store.Save(ctx, conv); saveErr != nil {
+			if saveErr := s.save(ctx, conv); saveErr != nil {
 				return nil, saveErr
 			}
+			if conv.State == types.StateBlocked {
+				return conv, nil
+			}
 			if helperErr := s.resolveBlock(ctx, conv, conv.AwaitingReason, step.Title); helperErr != nil {
 				return nil, helperErr
 			}
 			return conv, nil
 		}
 		step.Status = types.StepDone
+		step.Result = payload
 		conv.State = types.StateExecuting
 		conv.AwaitingReason = ""
+		if s.stepArtifacts(conv) {
+			artifact := s.addArtifact(conv, step.Title, "Result of step "+step.ID, reply, "step:"+step.ID)
+			stepEvent.ArtifactID = artifact.ID
+		}
 		stepEvent.Note = "SUCCESS"
 		s.emit(stepEvent)
-		if err := s.store.Save(ctx, conv); err != nil {
+		if err := s.save(ctx, conv); err != nil {
 			return nil, err
 		}
 	}
 	if len(conv.AcceptanceCriteria) == 0 {
+		if s.requireCompletionReview {
+			conv.State = types.StateAwaitingCompletion
+			conv.AwaitingReason = "All steps done; awaiting human completion review"
+			if err := s.save(ctx, conv); err != nil {
+				return nil, err
+			}
+			return conv, nil
+		}
 		return s.completeConversation(ctx, conv)
 	}
 	conv.State = types.StateVerifying
 	conv.AwaitingReason = "Verifying acceptance criteria"
-	if err := s.store.Save(ctx, conv); err != nil {
+	if err := s.save(ctx, conv); err != nil {
 		return nil, err
 	}
 	return s.verifyAcceptance(ctx, conv)
@@ -513,57 +1549,66 @@ func (s *Service) completeConversation(ctx context.Context, conv *types.Conversa
 			finalReply = lastStep.Logs[len(lastStep.Logs)-1]
 		}
 	}
-	conv.CompletedMessage = "Plan completed successfully."
-	if finalReply != "" {
-		conv.CompletedMessage += " Last response: " + finalReply
-	}
+	conv.CompletedMessage = s.renderCompletionMessage(conv, finalReply)
 	conv.CompletedAt = s.clock()
-	if err := s.store.Save(ctx, conv); err != nil {
+	if err := s.save(ctx, conv); err != nil {
 		return nil, err
 	}
 	return conv, nil
 }
 
 func (s *Service) verifyAcceptance(ctx context.Context, conv *types.Conversation) (*types.Conversation, error) {
-	checklist := "-"
-	if len(conv.AcceptanceCriteria) > 0 {
-		checklist = "- " + strings.Join(conv.AcceptanceCriteria, "\n- ")
+	if s.verifyRemainingOnly && s.allCriteriaMet(conv) {
+		return s.completeVerified(ctx, conv, "All criteria were confirmed by earlier verifications.")
+	}
+	if err := s.checkModelCallBudget(conv); err != nil {
+		return s.blockOnBudget(ctx, conv, err)
 	}
-	verifyPrompt, err := s.renderVerifyPrompt(conv, checklist)
+	verifyPrompt, err := s.renderVerifyPrompt(conv, s.verifyChecklist(conv))
 	if err != nil {
 		return nil, err
 	}
-	reply, raw, sessionID, duration, err := s.model.Send(ctx, conv.SessionID, verifyPrompt)
+	// A separate verify model keeps its own session; execution must not
+	// resume in the verifier's thread.
+	session := codexSession(conv)
+	if s.verifyModel != nil {
+		session = conv.VerifySessionID
+	}
+	reply, raw, sessionID, duration, err := s.sendStreaming(ctx, s.verifier(), conv, nil, session, verifyPrompt)
 	if err != nil {
 		conv.State = types.StateBlocked
 		conv.AwaitingReason = fmt.Sprintf("Verification failed: %v", err)
-		_ = s.store.Save(ctx, conv)
+		_ = s.save(ctx, conv)
 		return nil, err
 	}
-	conv.SessionID = sessionID
+	if s.verifyModel != nil {
+		conv.VerifySessionID = sessionID
+	} else {
+		conv.CodexSessionID = sessionID
+	}
 	call := types.ModelCall{
 		Prompt:     verifyPrompt,
+		Phase:      types.CallPhaseVerify,
 		RawOutput:  raw,
 		Reply:      reply,
 		Timestamp:  s.clock(),
 		DurationMS: duration,
 		SessionID:  sessionID,
 	}
-	conv.ModelCalls = append(conv.ModelCalls, call)
-	upper := strings.ToUpper(strings.TrimSpace(reply))
-	if strings.HasPrefix(upper, "PASS") || strings.HasPrefix(upper, "SUCCESS") {
-		conv.CompletedMessage = "Acceptance criteria satisfied. " + reply
-		conv.CompletedAt = s.clock()
-		conv.State = types.StateCompleted
-		conv.AwaitingReason = ""
-		if err := s.store.Save(ctx, conv); err != nil {
-			return nil, err
-		}
-		return conv, nil
+	s.recordCall(conv, call)
+	keyword, _ := s.directive(reply)
+	passed := keyword == "PASS" || keyword == "SUCCESS"
+	s.recordVerification(conv, passed, reply)
+	if passed {
+		return s.completeVerified(ctx, conv, reply)
+	}
+	conv.VerifyFailures++
+	if s.verifyReplansExhausted(conv) {
+		return s.restartAttempt(ctx, conv, reply)
 	}
 	conv.State = types.StateReplanning
 	conv.AwaitingReason = "Verification failed: " + reply
-	if err := s.store.Save(ctx, conv); err != nil {
+	if err := s.save(ctx, conv); err != nil {
 		return nil, err
 	}
 	if err := s.resolveBlock(ctx, conv, reply, "acceptance verification"); err != nil {
@@ -572,17 +1617,40 @@ func (s *Service) verifyAcceptance(ctx context.Context, conv *types.Conversation
 	return conv, nil
 }
 
-func (s *Service) proposeDiscoveryCommand(ctx context.Context, conv *types.Conversation, need, kind string) (string, *types.ModelCall) {
+// completeVerified marks conv completed after its acceptance criteria were
+// satisfied, with detail explaining how.
+func (s *Service) completeVerified(ctx context.Context, conv *types.Conversation, detail string) (*types.Conversation, error) {
+	conv.CompletedMessage = "Acceptance criteria satisfied. " + detail
+	conv.CompletedAt = s.clock()
+	conv.State = types.StateCompleted
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+func (s *Service) proposeDiscoveryCommand(ctx context.Context, conv *types.Conversation, step *types.Step, need, kind string) (string, *types.ModelCall) {
 	if conv == nil {
 		return "", nil
 	}
+	if s.checkModelCallBudget(conv) != nil {
+		// Out of calls: skip discovery and ask the human directly.
+		return "", nil
+	}
+	if s.maxDiscoveryDepth > 0 && step.DiscoveryCommands >= s.maxDiscoveryDepth {
+		// The step keeps needing more; stop chaining commands and ask the human.
+		s.appendLog(conv, step, fmt.Sprintf("DISCOVERY_LIMIT: %d discovery commands proposed; asking for %s", step.DiscoveryCommands, kind))
+		return "", nil
+	}
 	prompt, err := s.renderProposeCommandPrompt(conv, need, kind)
 	if err != nil {
 		return "", nil
 	}
-	reply, raw, sessionID, duration, err := s.model.Send(ctx, conv.SessionID, prompt)
+	reply, raw, sessionID, duration, err := s.model.Send(withWorkDir(ctx, conv.Settings), codexSession(conv), prompt)
 	call := &types.ModelCall{
 		Prompt:     prompt,
+		Phase:      types.CallPhaseDiscovery,
 		RawOutput:  raw,
 		Reply:      reply,
 		Timestamp:  s.clock(),
@@ -592,20 +1660,32 @@ func (s *Service) proposeDiscoveryCommand(ctx context.Context, conv *types.Conve
 	if err != nil {
 		return "", call
 	}
-	upper := strings.ToUpper(strings.TrimSpace(reply))
-	if !strings.HasPrefix(upper, "COMMAND:") {
+	keyword, cmd := s.directive(reply)
+	if keyword != "COMMAND" {
 		return "", call
 	}
-	cmd := strings.TrimSpace(reply[len("COMMAND:"):])
+	step.DiscoveryCommands++
 	return cmd, call
 }
 
-func parsePlanAndCriteria(plan string) ([]types.Step, []string) {
+// discoveryProvenance links a proposed command to the need it answers and the
+// model call (the most recent one) that proposed it.
+func discoveryProvenance(conv *types.Conversation, need, kind string) *types.CommandProvenance {
+	return &types.CommandProvenance{
+		Need:           need,
+		Kind:           kind,
+		ModelCallIndex: len(conv.ModelCalls) - 1,
+	}
+}
+
+// parsePlanAndCriteria splits a plan reply into steps and acceptance criteria,
+// keeping at most maxSteps steps (zero means no cap).
+func parsePlanAndCriteria(plan string, maxSteps int) ([]types.Step, []string) {
 	lines := strings.Split(plan, "\n")
 	steps := make([]types.Step, 0, len(lines))
 	acceptance := make([]string, 0)
 	inAcceptance := false
-	for i, line := range lines {
+	for _, line := range lines {
 		text := strings.TrimSpace(line)
 		if text == "" {
 			continue
@@ -629,6 +1709,10 @@ func parsePlanAndCriteria(plan string) ([]types.Step, []string) {
 			acceptance = append(acceptance, strings.TrimPrefix(text, "- "))
 			continue
 		}
+		if maxSteps > 0 && len(steps) >= maxSteps {
+			// avoid huge plans, but keep scanning for acceptance criteria
+			continue
+		}
 		steps = append(steps, types.Step{
 			ID:               fmt.Sprintf("step-%d", len(steps)+1),
 			Title:            text,
@@ -636,87 +1720,431 @@ func parsePlanAndCriteria(plan string) ([]types.Step, []string) {
 			RequiresApproval: false,
 			Logs:             []string{},
 		})
-		if i > 10 {
-			// avoid huge plans by default
-			break
-		}
 	}
 	return steps, acceptance
 }
 
-func summarizeLogs(conv *types.Conversation, max int) string {
+// parsePlan parses a model plan and applies the configured post-processing.
+func (s *Service) parsePlan(plan string) ([]types.Step, []string) {
+	steps, acceptance, ok := parseJSONPlan(plan, s.maxSteps)
+	if !ok {
+		steps, acceptance = parsePlanAndCriteria(plan, s.maxSteps)
+	}
+	acceptance = s.dedupCriteria(acceptance)
+	if s.dedupSteps {
+		steps = dedupSteps(steps)
+	}
+	return steps, acceptance
+}
+
+// dedupSteps drops steps whose normalized title repeats an earlier one and renumbers the rest.
+func dedupSteps(steps []types.Step) []types.Step {
+	seen := make(map[string]bool, len(steps))
+	out := make([]types.Step, 0, len(steps))
+	for _, step := range steps {
+		key := normalizeStepTitle(step.Title)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		step.ID = fmt.Sprintf("step-%d", len(out)+1)
+		out = append(out, step)
+	}
+	return out
+}
+
+// normalizeStepTitle strips list markers, case, punctuation, and extra spaces so
+// "1) Install dependencies" and "3. install dependencies." compare equal.
+func normalizeStepTitle(title string) string {
+	t := strings.TrimSpace(title)
+	t = strings.TrimLeft(t, "-*• ")
+	t = strings.TrimLeft(t, "0123456789")
+	t = strings.TrimLeft(t, ").:- ")
+	t = strings.TrimRight(t, ".!;: ")
+	return strings.ToLower(strings.Join(strings.Fields(t), " "))
+}
+
+// planTruncatedMarker starts the note appended to a PlanText cut by WithMaxPlanText.
+const planTruncatedMarker = "[plan truncated:"
+
+// artifactTruncatedMarker starts the note appended to capped artifact content.
+const artifactTruncatedMarker = "[artifact truncated:"
+
+// capPlanText trims plan to WithMaxPlanText bytes on a rune boundary, noting how much was dropped.
+func (s *Service) capPlanText(plan string) string {
+	if s.maxPlanText <= 0 || len(plan) <= s.maxPlanText {
+		return plan
+	}
+	cut := s.maxPlanText
+	for cut > 0 && !utf8.RuneStart(plan[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n%s %d bytes omitted]", plan[:cut], planTruncatedMarker, len(plan)-cut)
+}
+
+// capArtifactContent truncates artifact content longer than WithMaxArtifactBytes,
+// noting how much was dropped.
+func (s *Service) capArtifactContent(content string) string {
+	if s.maxArtifactBytes <= 0 || len(content) <= s.maxArtifactBytes {
+		return content
+	}
+	cut := s.maxArtifactBytes
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n%s %d of %d bytes omitted]", content[:cut], artifactTruncatedMarker, len(content)-cut, len(content))
+}
+
+// planContext is the plan as shown in prompts. A truncated PlanText is
+// replaced by the parsed step titles, which survive truncation intact.
+func (s *Service) planContext(conv *types.Conversation) string {
+	if len(conv.Steps) == 0 || !strings.Contains(conv.PlanText, planTruncatedMarker) {
+		return conv.PlanText
+	}
+	titles := make([]string, len(conv.Steps))
+	for i, step := range conv.Steps {
+		titles[i] = step.Title
+	}
+	return strings.Join(titles, "\n")
+}
+
+// codexSession is the model session conv continues. Conversations saved
+// before CodexSessionID existed used their SessionID for both.
+func codexSession(conv *types.Conversation) string {
+	if conv.CodexSessionID != "" || conv.PlanCached || conv.SessionReset {
+		return conv.CodexSessionID
+	}
+	return conv.SessionID
+}
+
+// stepArtifacts reports whether successful steps in conv become artifacts.
+func (s *Service) stepArtifacts(conv *types.Conversation) bool {
+	if conv.Settings.StepArtifacts != nil {
+		return *conv.Settings.StepArtifacts
+	}
+	return s.stepArtifactsDefault
+}
+
+// commandArtifact reports whether an approved command's output in conv is
+// saved as an artifact, given whether the command failed.
+func (s *Service) commandArtifact(conv *types.Conversation, failed bool) bool {
+	mode := s.commandArtifacts
+	if conv.Settings.CommandArtifacts != "" {
+		mode = conv.Settings.CommandArtifacts
+	}
+	switch mode {
+	case types.CommandArtifactsNever:
+		return false
+	case types.CommandArtifactsOnlyOnFailure:
+		return failed
+	default:
+		return true
+	}
+}
+
+// verifier returns the client used for acceptance verification.
+func (s *Service) verifier() codex.Client {
+	if s.verifyModel != nil {
+		return s.verifyModel
+	}
+	return s.model
+}
+
+// validateSettings rejects per-conversation settings with unknown values.
+func validateSettings(settings types.ConversationSettings) error {
+	switch settings.LogVerbosity {
+	case "", types.LogVerbosityLow, types.LogVerbosityNormal, types.LogVerbosityFull:
+	default:
+		return fmt.Errorf("unknown log verbosity %q: want low, normal, or full", settings.LogVerbosity)
+	}
+	switch settings.CommandArtifacts {
+	case "", types.CommandArtifactsAlways, types.CommandArtifactsOnlyOnFailure, types.CommandArtifactsNever:
+	default:
+		return fmt.Errorf("unknown command artifacts %q: want always, only-on-failure, or never", settings.CommandArtifacts)
+	}
+	if settings.WorkDir != "" {
+		if info, err := os.Stat(settings.WorkDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("work dir %q is not a directory", settings.WorkDir)
+		}
+	}
+	return nil
+}
+
+// withWorkDir points model calls and commands at the conversation's WorkDir
+// setting, when it has one.
+func withWorkDir(ctx context.Context, settings types.ConversationSettings) context.Context {
+	return codex.WithWorkDir(ctx, settings.WorkDir)
+}
+
+// clearPending drops any command, info, or dependency request left on step.
+func clearPending(step *types.Step) {
+	step.PendingCommand = ""
+	step.CommandProvenance = nil
+	step.PendingInfo = ""
+	step.PendingDependency = ""
+}
+
+// currentStep returns the first step that isn't done, which is the only one
+// execution can be waiting on.
+func currentStep(conv *types.Conversation) *types.Step {
+	for i := range conv.Steps {
+		if conv.Steps[i].Status != types.StepDone {
+			return &conv.Steps[i]
+		}
+	}
+	return nil
+}
+
+func findStep(conv *types.Conversation, stepID string) *types.Step {
+	for i := range conv.Steps {
+		if conv.Steps[i].ID == stepID {
+			return &conv.Steps[i]
+		}
+	}
+	return nil
+}
+
+// summarizeLogs returns the most recent max step logs, oldest first, along with
+// how many entries (and bytes) were left out.
+func summarizeLogs(conv *types.Conversation, max int) (string, int, int) {
 	var entries []string
-	for i := len(conv.Steps) - 1; i >= 0 && len(entries) < max; i-- {
+	omitted, omittedBytes := 0, 0
+	for i := len(conv.Steps) - 1; i >= 0; i-- {
 		step := conv.Steps[i]
-		for j := len(step.Logs) - 1; j >= 0 && len(entries) < max; j-- {
-			entries = append(entries, fmt.Sprintf("%s: %s", step.Title, step.Logs[j]))
+		for j := len(step.Logs) - 1; j >= 0; j-- {
+			entry := fmt.Sprintf("%s: %s", step.Title, step.Logs[j])
+			if len(entries) >= max {
+				omitted++
+				omittedBytes += len(entry)
+				continue
+			}
+			entries = append(entries, entry)
 		}
 	}
 	if len(entries) == 0 {
-		return "None"
+		return "None", 0, 0
 	}
 	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
 		entries[i], entries[j] = entries[j], entries[i]
 	}
-	return strings.Join(entries, "\n")
+	return strings.Join(entries, "\n"), omitted, omittedBytes
+}
+
+// contextLogs summarizes recent logs for a prompt. When report is set, any
+// truncation is logged at debug level (and published as an obs event when
+// WithEmitTruncation is set); previews leave it unset.
+func (s *Service) contextLogs(conv *types.Conversation, max int, phase string, report bool) string {
+	summary, omitted, omittedBytes := summarizeLogs(conv, max)
+	if omitted == 0 || !report {
+		return summary
+	}
+	s.logger().Debug("prompt context truncated",
+		"session_id", conv.SessionID,
+		"phase", phase,
+		"omitted_entries", omitted,
+		"omitted_bytes", omittedBytes,
+	)
+	if s.emitTruncation {
+		s.emit(obs.Event{
+			Type:      "truncation",
+			SessionID: conv.SessionID,
+			Prompt:    conv.Prompt,
+			Note:      fmt.Sprintf("%s prompt omitted %d log entries (%d bytes)", phase, omitted, omittedBytes),
+		})
+	}
+	return summary
+}
+
+// executionContext builds the "recent context" block for step prompts: recent
+// step logs plus, when WithContextMessages is set, the latest chat messages.
+// report is passed on to contextLogs.
+func (s *Service) executionContext(conv *types.Conversation, phase string, report bool) string {
+	summary := s.contextLogs(conv, 5, phase, report)
+	if s.contextMessages <= 0 || len(conv.Messages) == 0 {
+		return summary
+	}
+	msgs := conv.Messages
+	if len(msgs) > s.contextMessages {
+		msgs = msgs[len(msgs)-s.contextMessages:]
+	}
+	lines := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		lines = append(lines, fmt.Sprintf("%s: %s", m.Role, m.Content))
+	}
+	return summary + "\nRecent messages:\n" + strings.Join(lines, "\n")
+}
+
+func (s *Service) logger() *slog.Logger {
+	if s.log != nil {
+		return s.log
+	}
+	return slog.Default()
 }
 
 func seedPrompt(prompt string) string {
 	return "You are an execution planner. Given a prompt, produce a concise numbered plan (one step per line) and also list acceptance criteria as `ACCEPT: <criterion>` lines. Keep both lists short and outcome-focused.\nPrompt: " + prompt + "\nPlan:"
 }
 
+func rejectPlanPrompt(goal, planText, feedback string) string {
+	return fmt.Sprintf("The goal is: %s\nThe user rejected this plan:\n%s\nTheir feedback: %s\nProvide a concise revised plan (numbered steps) that addresses the feedback, and updated acceptance criteria as `ACCEPT:` lines. Keep it short.\nNew Plan:", goal, planText, feedback)
+}
+
 func unblockPrompt(goal, stepTitle, reason, planText string) string {
 	return fmt.Sprintf("The goal is: %s\nStep %q failed with reason: %s. Provide a concise revised plan (numbered steps) and updated acceptance criteria as `ACCEPT:` lines that help unblock and continue the goal. Keep it short.\nPrevious plan and acceptance criteria:\n%s\nNew Plan:", goal, stepTitle, reason, planText)
 }
 
 func (s *Service) resolveBlock(ctx context.Context, conv *types.Conversation, reason, stepTitle string) error {
-	prompt, err := s.renderUnblockPrompt(conv.Prompt, stepTitle, reason, conv.PlanText)
+	if err := s.checkModelCallBudget(conv); err != nil {
+		_, err = s.blockOnBudget(ctx, conv, err)
+		return err
+	}
+	prompt, err := s.renderUnblockPrompt(conv, stepTitle, reason)
 	if err != nil {
 		return err
 	}
-	reply, raw, sessionID, duration, err := s.model.Send(ctx, conv.SessionID, prompt)
+	planEvent := obs.Event{
+		Type:        "plan",
+		SessionID:   conv.SessionID,
+		Prompt:      conv.Prompt,
+		ModelPrompt: prompt,
+	}
+	blocked := currentStep(conv)
+	if blocked != nil {
+		planEvent.StepID = blocked.ID
+		planEvent.StepTitle = blocked.Title
+	}
+	reply, raw, sessionID, duration, err := s.sendStreaming(ctx, s.model, conv, blocked, codexSession(conv), prompt)
 	if err != nil {
 		return err
 	}
-	conv.SessionID = sessionID
-	conv.PlanText = reply
-	conv.Steps, conv.AcceptanceCriteria = parsePlanAndCriteria(reply)
+	conv.CodexSessionID = sessionID
+	conv.PlanText = s.capPlanText(reply)
+	conv.Steps, conv.AcceptanceCriteria = s.parsePlan(reply)
 	conv.PlanVersion++
+	conv.PlanCreatedAt = s.clock()
 	conv.State = types.StateAwaitingPlanApproval
 	conv.AwaitingReason = "Awaiting plan approval after block"
 	call := types.ModelCall{
 		Prompt:     prompt,
+		Phase:      types.CallPhaseResolve,
 		RawOutput:  raw,
 		Reply:      reply,
 		Timestamp:  s.clock(),
 		DurationMS: duration,
 		SessionID:  sessionID,
 	}
-	conv.ModelCalls = append(conv.ModelCalls, call)
-	if err := s.store.Save(ctx, conv); err != nil {
+	s.recordCall(conv, call)
+	if err := s.save(ctx, conv); err != nil {
 		return err
 	}
-	s.emit(obs.Event{
-		Type:        "plan",
-		SessionID:   conv.SessionID,
-		Prompt:      conv.Prompt,
-		ModelPrompt: prompt,
-		PlanText:    reply,
-		RawOutput:   raw,
-		Note:        "Block resolution plan",
-	})
+	planEvent.PlanText = reply
+	planEvent.RawOutput = raw
+	planEvent.Note = "Block resolution plan"
+	s.emit(planEvent)
 	return nil
 }
 
+// appendLog adds lines to a step's log and publishes each as a "log" event for followers.
+func (s *Service) appendLog(conv *types.Conversation, step *types.Step, lines ...string) {
+	step.Logs = append(step.Logs, lines...)
+	for _, line := range lines {
+		s.emit(obs.Event{
+			Type:      "log",
+			SessionID: conv.SessionID,
+			StepID:    step.ID,
+			StepTitle: step.Title,
+			Log:       line,
+		})
+	}
+}
+
+// WatchStepLogs returns a step's current logs plus a channel of lines appended
+// afterwards. The channel closes when ctx is done.
+func (s *Service) WatchStepLogs(ctx context.Context, sessionID, stepID string) ([]string, <-chan string, error) {
+	if s.obs == nil {
+		return nil, nil, fmt.Errorf("log streaming requires an observability broker")
+	}
+	events := s.obs.Subscribe()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		s.obs.Unsubscribe(events)
+		return nil, nil, err
+	}
+	step := findStep(conv, stepID)
+	if step == nil {
+		s.obs.Unsubscribe(events)
+		return nil, nil, fmt.Errorf("step %s not found", stepID)
+	}
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		defer s.obs.Unsubscribe(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				if ev.Type != "log" || ev.SessionID != sessionID || ev.StepID != stepID {
+					continue
+				}
+				select {
+				case lines <- ev.Log:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return append([]string{}, s.displayLines(step.Logs)...), lines, nil
+}
+
+// recordCall appends a model call to the conversation and marks it as active.
+func (s *Service) recordCall(conv *types.Conversation, call types.ModelCall) {
+	if call.TotalTokens == 0 && call.RawOutput != "" {
+		usage := codex.ParseUsage(call.RawOutput)
+		call.PromptTokens = usage.PromptTokens
+		call.CompletionTokens = usage.CompletionTokens
+		call.TotalTokens = usage.TotalTokens
+	}
+	conv.TotalTokens += call.TotalTokens
+	s.logCall(conv, call)
+	if conv.Settings.LogVerbosity == types.LogVerbosityLow {
+		call.RawOutput = ""
+	}
+	if s.promptStorage == "hash" {
+		call.Prompt = fingerprintPrompt(call.Prompt)
+	}
+	conv.ModelCalls = append(conv.ModelCalls, call)
+	conv.LastActivityAt = s.clock()
+}
+
+// promptPreviewRunes is how much of a prompt fingerprintPrompt keeps readable.
+const promptPreviewRunes = 80
+
+// fingerprintPrompt replaces prompt with its SHA-256, length, and a short
+// preview, e.g. "sha256:1f2e… (5120 bytes) Plan the following goal: …".
+func fingerprintPrompt(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	preview := prompt
+	if runes := []rune(prompt); len(runes) > promptPreviewRunes {
+		preview = string(runes[:promptPreviewRunes]) + "…"
+	}
+	preview = strings.Join(strings.Fields(preview), " ")
+	return fmt.Sprintf("sha256:%s (%d bytes) %s", hex.EncodeToString(sum[:]), len(prompt), preview)
+}
+
 func (s *Service) addArtifact(conv *types.Conversation, title, description, content, source string) *types.Artifact {
 	if conv == nil {
 		return nil
 	}
 	artifact := types.Artifact{
-		ID:          fmt.Sprintf("artifact-%d", time.Now().UnixNano()),
+		ID:          fmt.Sprintf("artifact-%d-%d", s.clock().UnixNano(), atomic.AddUint64(&s.artifactSeq, 1)),
 		Title:       title,
 		Description: description,
-		Content:     content,
+		Content:     s.capArtifactContent(content),
 		Source:      source,
 		CreatedAt:   s.clock(),
 	}
@@ -728,64 +2156,112 @@ func (s *Service) emit(ev obs.Event) {
 	if s.obs == nil {
 		return
 	}
+	if ev.ConversationID == "" {
+		ev.ConversationID = ev.SessionID
+	}
+	if !s.rawDisplay {
+		ev.Prompt = sanitizeDisplay(ev.Prompt)
+		ev.ModelPrompt = sanitizeDisplay(ev.ModelPrompt)
+		ev.PlanText = sanitizeDisplay(ev.PlanText)
+		ev.RawOutput = sanitizeDisplay(ev.RawOutput)
+		ev.Command = sanitizeDisplay(ev.Command)
+		ev.Reply = sanitizeDisplay(ev.Reply)
+		ev.Note = sanitizeDisplay(ev.Note)
+		ev.Log = sanitizeDisplay(ev.Log)
+	}
 	s.obs.Publish(ev)
 }
 
 func (s *Service) renderPlanPrompt(prompt string) (string, error) {
-	if s.Prompts != nil && s.Prompts.Plan != nil {
-		return renderPrompt(s.Prompts.Plan, map[string]string{"Prompt": prompt})
+	if s.jsonPlans {
+		if s.prompts != nil && s.prompts.PlanJSON != nil {
+			return renderPrompt(s.prompts.PlanJSON, s.planPromptData(prompt))
+		}
+		return jsonPlanPrompt(prompt), nil
+	}
+	if s.prompts != nil && s.prompts.Plan != nil {
+		return renderPrompt(s.prompts.Plan, s.planPromptData(prompt))
 	}
 	return seedPrompt(prompt), nil
 }
 
 func (s *Service) renderExecutePrompt(conv *types.Conversation, step *types.Step, contextLogs string) (string, error) {
-	if s.Prompts != nil && s.Prompts.ExecuteStep != nil {
-		return renderPrompt(s.Prompts.ExecuteStep, map[string]any{
-			"Goal":        conv.Prompt,
-			"Plan":        conv.PlanText,
-			"Criteria":    strings.Join(conv.AcceptanceCriteria, "; "),
-			"Context":     contextLogs,
-			"StepTitle":   step.Title,
-			"StepID":      step.ID,
-			"PlanVersion": conv.PlanVersion,
-		})
+	if s.prompts != nil && s.prompts.ExecuteStep != nil {
+		return renderPrompt(s.prompts.ExecuteStep, s.executePromptData(conv, step, contextLogs))
+	}
+	criteria, include := s.stepCriteria(conv)
+	criteriaLine := ""
+	if include {
+		criteriaLine = fmt.Sprintf("Acceptance criteria: %s\n", criteria)
+	}
+	return fmt.Sprintf("Prompt: %s\nPlan: %s\n%sRecent context:\n%s\nStep: %s\nYou are executing a plan step. Respond with one of:\n- COMMAND: <cmd> (shell command suggestion, do not execute)\n- NEED: <missing info>\n- DEPENDENCY: <what must be installed or prepared>\n- SUCCESS: <result>\n- BLOCKED: <reason>\nKeep it concise and actionable.", conv.Prompt, s.planContext(conv), criteriaLine, contextLogs, step.Title), nil
+}
+
+// stepCriteria returns the acceptance criteria to show in step prompts per
+// WithStepCriteria, and whether the criteria block should appear at all.
+func (s *Service) stepCriteria(conv *types.Conversation) (string, bool) {
+	criteria := conv.AcceptanceCriteria
+	switch mode := strings.TrimSpace(strings.ToLower(s.stepCriteriaMode)); mode {
+	case "", "all":
+	case "none":
+		return "", false
+	default:
+		n, err := strconv.Atoi(mode)
+		if err != nil || n <= 0 {
+			return "", false
+		}
+		if len(criteria) > n {
+			criteria = append(criteria[:n:n], fmt.Sprintf("(+%d more)", len(conv.AcceptanceCriteria)-n))
+		}
 	}
-	return fmt.Sprintf("Prompt: %s\nPlan: %s\nAcceptance criteria: %s\nRecent context:\n%s\nStep: %s\nYou are executing a plan step. Respond with one of:\n- COMMAND: <cmd> (shell command suggestion, do not execute)\n- NEED: <missing info>\n- DEPENDENCY: <what must be installed or prepared>\n- SUCCESS: <result>\n- BLOCKED: <reason>\nKeep it concise and actionable.", conv.Prompt, conv.PlanText, strings.Join(conv.AcceptanceCriteria, "; "), contextLogs, step.Title), nil
+	return strings.Join(criteria, "; "), true
 }
 
 func (s *Service) renderProposeCommandPrompt(conv *types.Conversation, need, kind string) (string, error) {
-	if s.Prompts != nil && s.Prompts.ProposeCommand != nil {
-		return renderPrompt(s.Prompts.ProposeCommand, map[string]any{
-			"Goal":     conv.Prompt,
-			"Need":     need,
-			"Plan":     conv.PlanText,
-			"Context":  summarizeLogs(conv, 5),
-			"Kind":     kind,
-			"Criteria": strings.Join(conv.AcceptanceCriteria, "; "),
-		})
+	contextLogs := s.contextLogs(conv, 5, "propose_command", true)
+	if s.prompts != nil && s.prompts.ProposeCommand != nil {
+		return renderPrompt(s.prompts.ProposeCommand, s.proposeCommandPromptData(conv, need, kind, contextLogs))
 	}
-	return fmt.Sprintf("Goal: %s\nNeed: %s\nPlan: %s\nRecent context:\n%s\nSuggest a single shell command to gather the missing %s or unblock the dependency. Respond strictly as `COMMAND: <cmd>` with no explanation and no execution.", conv.Prompt, need, conv.PlanText, summarizeLogs(conv, 5), kind), nil
+	return fmt.Sprintf("Goal: %s\nNeed: %s\nPlan: %s\nRecent context:\n%s\nSuggest a single shell command to gather the missing %s or unblock the dependency. Respond strictly as `COMMAND: <cmd>` with no explanation and no execution.", conv.Prompt, need, s.planContext(conv), contextLogs, kind), nil
 }
 
 func (s *Service) renderVerifyPrompt(conv *types.Conversation, checklist string) (string, error) {
-	if s.Prompts != nil && s.Prompts.Verify != nil {
-		return renderPrompt(s.Prompts.Verify, map[string]any{
-			"Goal":      conv.Prompt,
-			"Checklist": checklist,
-			"Context":   summarizeLogs(conv, 8),
-		})
+	contextLogs := s.contextLogs(conv, 8, "verify", true)
+	if s.prompts != nil && s.prompts.Verify != nil {
+		return renderPrompt(s.prompts.Verify, s.verifyPromptData(conv, checklist, contextLogs))
 	}
-	return fmt.Sprintf("Goal: %s\nAcceptance criteria:\n%s\nRecent execution context:\n%s\nRespond with PASS: <short reason> if all criteria are met. If any are missing, respond with FAIL: <gaps> and list missing items.", conv.Prompt, checklist, summarizeLogs(conv, 8)), nil
+	return fmt.Sprintf("Goal: %s\nAcceptance criteria:\n%s\nRecent execution context:\n%s\nRespond with PASS: <short reason> if all criteria are met. If any are missing, respond with FAIL: <gaps> and list missing items, then add a line MET: <criterion> for each criterion that is already satisfied.", conv.Prompt, checklist, contextLogs), nil
 }
 
-func (s *Service) renderUnblockPrompt(goal, stepTitle, reason, planText string) (string, error) {
-	if s.Prompts != nil && s.Prompts.Unblock != nil {
-		return renderPrompt(s.Prompts.Unblock, map[string]any{
-			"Goal":      goal,
-			"StepTitle": stepTitle,
-			"Reason":    reason,
-			"PlanText":  planText,
-		})
+// renderCompletionMessage uses the Completion template when configured, falling
+// back to the built-in summary if it is missing or fails to render.
+func (s *Service) renderCompletionMessage(conv *types.Conversation, finalReply string) string {
+	if s.prompts != nil && s.prompts.Completion != nil {
+		msg, err := renderPrompt(s.prompts.Completion, s.completionData(conv, finalReply))
+		if err == nil && strings.TrimSpace(msg) != "" {
+			return strings.TrimSpace(msg)
+		}
+		if err != nil {
+			s.logger().Warn("completion template failed", "session_id", conv.SessionID, "error", err)
+		}
+	}
+	msg := "Plan completed successfully."
+	if finalReply != "" {
+		msg += " Last response: " + finalReply
+	}
+	return msg
+}
+
+func (s *Service) renderRejectPlanPrompt(conv *types.Conversation, feedback string) (string, error) {
+	if s.prompts != nil && s.prompts.RejectPlan != nil {
+		return renderPrompt(s.prompts.RejectPlan, s.rejectPlanPromptData(conv, feedback))
+	}
+	return rejectPlanPrompt(conv.Prompt, s.planContext(conv), feedback), nil
+}
+
+func (s *Service) renderUnblockPrompt(conv *types.Conversation, stepTitle, reason string) (string, error) {
+	if s.prompts != nil && s.prompts.Unblock != nil {
+		return renderPrompt(s.prompts.Unblock, s.unblockPromptData(conv, stepTitle, reason))
 	}
-	return unblockPrompt(goal, stepTitle, reason, planText), nil
+	return unblockPrompt(conv.Prompt, stepTitle, reason, s.planContext(conv)), nil
 }
@@ -1,12 +1,26 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
+	"trill/internal/obs"
 	"trill/internal/store"
+	"trill/internal/types"
 )
 
 type fakeModel struct {
@@ -30,12 +44,17 @@ type scriptedModel struct {
 	replies   []string
 	sessionID string
 	idx       int
+	prompts   []string
+	// sessions records the session id each call was made with.
+	sessions []string
 }
 
 func (m *scriptedModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
 	if m.sessionID == "" {
 		m.sessionID = "sess-scripted"
 	}
+	m.prompts = append(m.prompts, prompt)
+	m.sessions = append(m.sessions, sessionID)
 	if m.idx >= len(m.replies) {
 		return "", "", m.sessionID, 0, errors.New("no more replies")
 	}
@@ -105,6 +124,63 @@ func TestAutoProvideInfoAdvancesExecution(t *testing.T) {
 	if conv.Steps[0].PendingCommand != "echo detecting" {
 		t.Fatalf("pending command not captured: %+v", conv.Steps[0])
 	}
+	prov := conv.Steps[0].CommandProvenance
+	if prov == nil {
+		t.Fatalf("discovery provenance not recorded: %+v", conv.Steps[0])
+	}
+	if prov.Need != "Which OS and package managers?" || prov.Kind != "info" {
+		t.Fatalf("unexpected provenance: %+v", prov)
+	}
+	if prov.ModelCallIndex != 2 || conv.ModelCalls[prov.ModelCallIndex].Reply != "COMMAND: echo detecting" {
+		t.Fatalf("provenance should point at the proposing model call: %+v", prov)
+	}
+	stored, err := st.Get(context.Background(), conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.Steps[0].CommandProvenance == nil || stored.Steps[0].CommandProvenance.Need != prov.Need {
+		t.Fatalf("provenance not persisted: %+v", stored.Steps[0])
+	}
+}
+
+func TestOutstandingQuestionsAcrossConversations(t *testing.T) {
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	seed := []*types.Conversation{
+		{SessionID: "sess-a", Prompt: "Deploy", State: types.StateAwaitingInfo, Steps: []types.Step{
+			{ID: "step-1", Title: "pick target", Status: types.StepBlocked, PendingInfo: "Which region?"},
+		}},
+		{SessionID: "sess-b", Prompt: "Build", State: types.StateAwaitingInfo, Steps: []types.Step{
+			{ID: "step-1", Title: "compile", Status: types.StepDone},
+			{ID: "step-2", Title: "link", Status: types.StepBlocked, PendingDependency: "libssl headers"},
+		}},
+		{SessionID: "sess-c", Prompt: "Done", State: types.StateCompleted, Steps: []types.Step{
+			{ID: "step-1", Title: "stale", Status: types.StepDone, PendingInfo: "ignored"},
+		}},
+	}
+	for _, conv := range seed {
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	svc := New(st, &scriptedModel{}, nil)
+
+	questions, err := svc.OutstandingQuestions(ctx)
+	if err != nil {
+		t.Fatalf("questions: %v", err)
+	}
+	want := map[string]types.Question{
+		"sess-a": {SessionID: "sess-a", Prompt: "Deploy", StepID: "step-1", StepTitle: "pick target", Kind: "info", Question: "Which region?"},
+		"sess-b": {SessionID: "sess-b", Prompt: "Build", StepID: "step-2", StepTitle: "link", Kind: "dependency", Question: "libssl headers"},
+	}
+	if len(questions) != len(want) {
+		t.Fatalf("questions = %+v, want %d", questions, len(want))
+	}
+	for _, q := range questions {
+		if q != want[q.SessionID] {
+			t.Fatalf("question = %+v, want %+v", q, want[q.SessionID])
+		}
+	}
 }
 
 func TestSendUnblocksAwaitingInfo(t *testing.T) {
@@ -154,3 +230,3066 @@ func TestSendUnblocksAwaitingInfo(t *testing.T) {
 		t.Fatalf("user info not logged: %+v", updated.Steps[0].Logs)
 	}
 }
+
+// getCountingStore records which conversations were loaded in full.
+type getCountingStore struct {
+	*store.MemoryStore
+	gets []string
+}
+
+func (g *getCountingStore) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	g.gets = append(g.gets, sessionID)
+	return g.MemoryStore.Get(ctx, sessionID)
+}
+
+func TestInboxCountsByState(t *testing.T) {
+	st := &getCountingStore{MemoryStore: store.NewMemoryStore()}
+	ctx := context.Background()
+	seed := []*types.Conversation{
+		{SessionID: "plan-1", State: types.StateAwaitingPlanApproval},
+		{SessionID: "plan-2", State: types.StateAwaitingPlanApproval},
+		{SessionID: "cmd-1", State: types.StateAwaitingCommand, Steps: []types.Step{{ID: "step-1", PendingCommand: "ls"}}},
+		{SessionID: "blocked-1", State: types.StateBlocked, Steps: []types.Step{{ID: "step-1", PendingCommand: "make"}}},
+		{SessionID: "blocked-2", State: types.StateBlocked, Steps: []types.Step{{ID: "step-1"}}},
+		{SessionID: "info-1", State: types.StateAwaitingInfo, Steps: []types.Step{{ID: "step-1", PendingInfo: "which repo?"}}},
+		{SessionID: "done-1", State: types.StateCompleted, CompletedMessage: "Plan completed successfully."},
+		{SessionID: "exec-1", State: types.StateExecuting},
+	}
+	for _, conv := range seed {
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("seed %s: %v", conv.SessionID, err)
+		}
+	}
+	want := map[types.ConversationState]int{
+		types.StateAwaitingPlanApproval: 2,
+		types.StateAwaitingCommand:      1,
+		types.StateBlocked:              1,
+		types.StateAwaitingInfo:         1,
+		types.StateCompleted:            1,
+	}
+	check := func(name string, counts map[types.ConversationState]int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s counts: %v", name, err)
+		}
+		if len(counts) != len(want) {
+			t.Fatalf("%s counts = %v, want %v", name, counts, want)
+		}
+		for state, n := range want {
+			if counts[state] != n {
+				t.Fatalf("%s counts[%s] = %d, want %d (all: %v)", name, state, counts[state], n, counts)
+			}
+		}
+	}
+
+	counts, err := New(st, &fakeModel{}, nil).InboxCounts(ctx)
+	check("listed", counts, err)
+	sort.Strings(st.gets)
+	if got := strings.Join(st.gets, ","); got != "blocked-1,blocked-2,cmd-1,info-1" {
+		t.Fatalf("loaded %s; only conversations waiting on a step should be loaded", got)
+	}
+
+	// A store without ListStates falls back to loading every conversation.
+	counts, err = New(struct{ store.ConversationStore }{st.MemoryStore}, &fakeModel{}, nil).InboxCounts(ctx)
+	check("loaded", counts, err)
+}
+
+// blockingModel waits for the request context to end, mimicking a hung codex process.
+type blockingModel struct {
+	started chan struct{}
+}
+
+func (m *blockingModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	close(m.started)
+	<-ctx.Done()
+	return "", "", sessionID, 0, ctx.Err()
+}
+
+func TestCreateConversationHonorsCancellation(t *testing.T) {
+	model := &blockingModel{started: make(chan struct{})}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-model.started
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := svc.CreateConversation(ctx, "Never finishes")
+	if err == nil {
+		t.Fatalf("expected cancellation error")
+	}
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "planning canceled") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("create took %s after cancel", elapsed)
+	}
+}
+
+func TestEditAndRetryStepUsesNewTitle(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{
+		replies: []string{
+			"1) deploy from the wrong branch",
+			"NEED: Which branch?",
+			"No command",
+			"SUCCESS: deployed",
+		},
+	}
+	svc := New(st, model, nil)
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.Steps[0].Status != types.StepBlocked {
+		t.Fatalf("expected blocked step, got %s", conv.Steps[0].Status)
+	}
+
+	conv, err = svc.EditAndRetryStep(ctx, conv.SessionID, "step-1", "Deploy from main")
+	if err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("expected completion after retry, got %s", conv.State)
+	}
+	if conv.Steps[0].Title != "Deploy from main" || conv.Steps[0].PendingInfo != "" {
+		t.Fatalf("step not updated: %+v", conv.Steps[0])
+	}
+	last := model.prompts[len(model.prompts)-1]
+	if !strings.Contains(last, "Step: Deploy from main") {
+		t.Fatalf("re-execution prompt missing new title: %q", last)
+	}
+	if _, err := svc.EditAndRetryStep(ctx, conv.SessionID, "step-1", "again"); err == nil {
+		t.Fatalf("expected error retrying a finished step")
+	}
+}
+
+func TestStuckConversationsUsesLastActivity(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) long running step"}}
+	svc := New(st, model, nil)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Run forever")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !conv.LastActivityAt.Equal(now) {
+		t.Fatalf("last activity = %s, want %s", conv.LastActivityAt, now)
+	}
+	conv.State = types.StateExecuting
+	if err := st.Save(ctx, conv); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	stuck, err := svc.StuckConversations(ctx, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("stuck: %v", err)
+	}
+	if len(stuck) != 0 {
+		t.Fatalf("conversation should not be stuck yet: %+v", stuck)
+	}
+
+	now = now.Add(10 * time.Minute)
+	stuck, err = svc.StuckConversations(ctx, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("stuck: %v", err)
+	}
+	if len(stuck) != 1 || stuck[0].SessionID != conv.SessionID {
+		t.Fatalf("expected idle executing conversation to be stuck, got %+v", stuck)
+	}
+}
+
+func TestContextTruncationIsLoggedAndEmitted(t *testing.T) {
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	var logs bytes.Buffer
+	svc := New(store.NewMemoryStore(), &fakeModel{}, broker, WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))), WithEmitTruncation(true))
+
+	conv := &types.Conversation{SessionID: "sess-trunc", Steps: []types.Step{{
+		Title: "noisy",
+		Logs:  []string{"one", "two", "three", "four", "five", "six", "seven"},
+	}}}
+	summary := svc.contextLogs(conv, 5, "execute", true)
+	if strings.Contains(summary, "one") || !strings.Contains(summary, "seven") {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+	if !strings.Contains(logs.String(), "prompt context truncated") || !strings.Contains(logs.String(), "omitted_entries=2") {
+		t.Fatalf("truncation not logged: %q", logs.String())
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != "truncation" || !strings.Contains(ev.Note, "omitted 2 log entries") {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	default:
+		t.Fatalf("expected truncation event")
+	}
+
+	logs.Reset()
+	svc.contextLogs(conv, 10, "execute", true)
+	if logs.Len() != 0 {
+		t.Fatalf("no truncation should be silent, got %q", logs.String())
+	}
+
+	conv.Steps[0].ID = "step-1"
+	if err := svc.store.Save(context.Background(), conv); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if _, err := svc.PreviewStepPrompt(context.Background(), conv.SessionID, "step-1"); err != nil {
+		t.Fatalf("preview: %v", err)
+	}
+	if logs.Len() != 0 || len(events) != 0 {
+		t.Fatalf("preview reported truncation: logs %q, %d events", logs.String(), len(events))
+	}
+}
+
+func TestApproveCommandUsesConfiguredShell(t *testing.T) {
+	stub := filepath.Join(t.TempDir(), "stubshell")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\necho \"stub:$1:$2\"\n"), 0o755); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) list files", "COMMAND: echo hi"}}
+	svc := New(st, model, nil, WithRunner(&ShellRunner{Shell: stub, Args: []string{"--run"}}))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "List files")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, "step-1")
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	found := false
+	for _, line := range conv.Steps[0].Logs {
+		if strings.Contains(line, "stub:--run:echo hi") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("command not dispatched through stub shell: %+v", conv.Steps[0].Logs)
+	}
+}
+
+func TestParseShellRunner(t *testing.T) {
+	r, err := ParseShellRunner("powershell -NoProfile -Command")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Shell != "powershell" || strings.Join(r.Args, " ") != "-NoProfile -Command" {
+		t.Fatalf("unexpected runner: %+v", r)
+	}
+	if _, err := ParseShellRunner("  "); err == nil {
+		t.Fatalf("expected error for empty spec")
+	}
+}
+
+// gatedModel plans instantly but holds execution calls until release is closed.
+type gatedModel struct {
+	mu      sync.Mutex
+	plans   int
+	entered chan string
+	release chan struct{}
+}
+
+func (m *gatedModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	if sessionID == "" {
+		m.mu.Lock()
+		m.plans++
+		id := fmt.Sprintf("sess-%d", m.plans)
+		m.mu.Unlock()
+		return "1) do the work", "raw", id, 1, nil
+	}
+	m.entered <- sessionID
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return "", "", sessionID, 0, ctx.Err()
+	}
+	return "SUCCESS: done", "raw", sessionID, 1, nil
+}
+
+func TestAbortSticksWhileAStepIsRunning(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &gatedModel{entered: make(chan string, 1), release: make(chan struct{})}
+	svc := New(st, model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Long job")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.ApprovePlan(ctx, conv.SessionID)
+		done <- err
+	}()
+	<-model.entered
+	if _, err := svc.Abort(ctx, conv.SessionID, "stop"); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	close(model.release)
+	if err := <-done; !errors.Is(err, ErrAborted) {
+		t.Fatalf("approve should report the abort, got %v", err)
+	}
+
+	stored, err := st.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.State != types.StateAborted || stored.CompletedMessage != "stop" {
+		t.Fatalf("abort was overwritten by the running step: state %s, message %q", stored.State, stored.CompletedMessage)
+	}
+}
+
+func TestMaxExecutingQueuesExtraConversations(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &gatedModel{entered: make(chan string, 4), release: make(chan struct{})}
+	svc := New(st, model, nil, WithMaxExecuting(1))
+	ctx := context.Background()
+
+	first, err := svc.CreateConversation(ctx, "First")
+	if err != nil {
+		t.Fatalf("create first: %v", err)
+	}
+	second, err := svc.CreateConversation(ctx, "Second")
+	if err != nil {
+		t.Fatalf("create second: %v", err)
+	}
+
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := svc.ApprovePlan(ctx, first.SessionID)
+		firstDone <- err
+	}()
+	if got := <-model.entered; got != first.SessionID {
+		t.Fatalf("expected first conversation to execute, got %s", got)
+	}
+
+	queued, err := svc.ApprovePlan(ctx, second.SessionID)
+	if err != nil {
+		t.Fatalf("approve second: %v", err)
+	}
+	if queued.State != types.StateQueued {
+		t.Fatalf("second conversation state = %s, want queued", queued.State)
+	}
+
+	close(model.release)
+	if err := <-firstDone; err != nil {
+		t.Fatalf("first approve: %v", err)
+	}
+	if got := <-model.entered; got != second.SessionID {
+		t.Fatalf("expected queued conversation to be promoted, got %s", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		conv, err := st.Get(ctx, second.SessionID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if conv.State == types.StateCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued conversation never completed, state %s", conv.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// routedModel plans instantly, holds execution calls for the gated session
+// until release is closed, and answers every other session from its script.
+type routedModel struct {
+	mu      sync.Mutex
+	plans   int
+	gated   string
+	replies map[string][]string
+	entered chan string
+	release chan struct{}
+}
+
+func (m *routedModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	m.mu.Lock()
+	if sessionID == "" {
+		m.plans++
+		id := fmt.Sprintf("sess-%d", m.plans)
+		m.mu.Unlock()
+		return "1) do the work", "raw", id, 1, nil
+	}
+	if sessionID != m.gated {
+		reply := "SUCCESS: done"
+		if queue := m.replies[sessionID]; len(queue) > 0 {
+			reply, m.replies[sessionID] = queue[0], queue[1:]
+		}
+		m.mu.Unlock()
+		return reply, "raw", sessionID, 1, nil
+	}
+	m.mu.Unlock()
+	m.entered <- sessionID
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return "", "", sessionID, 0, ctx.Err()
+	}
+	return "SUCCESS: done", "raw", sessionID, 1, nil
+}
+
+func TestApproveCommandWaitsForExecutionSlot(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &routedModel{
+		gated:   "sess-1",
+		replies: map[string][]string{"sess-2": {"COMMAND: true"}},
+		entered: make(chan string, 4),
+		release: make(chan struct{}),
+	}
+	svc := New(st, model, nil, WithMaxExecuting(1), WithRunner(&ShellRunner{Shell: "true"}))
+	ctx := context.Background()
+
+	holder, err := svc.CreateConversation(ctx, "Hold the slot")
+	if err != nil {
+		t.Fatalf("create holder: %v", err)
+	}
+	waiter, err := svc.CreateConversation(ctx, "Run a command")
+	if err != nil {
+		t.Fatalf("create waiter: %v", err)
+	}
+	waiting, err := svc.ApprovePlan(ctx, waiter.SessionID)
+	if err != nil {
+		t.Fatalf("approve waiter: %v", err)
+	}
+	if waiting.State != types.StateAwaitingCommand {
+		t.Fatalf("waiter state = %s, want awaiting_command", waiting.State)
+	}
+
+	holderDone := make(chan error, 1)
+	go func() {
+		_, err := svc.ApprovePlan(ctx, holder.SessionID)
+		holderDone <- err
+	}()
+	<-model.entered
+
+	resumed, err := svc.ApproveCommand(ctx, waiter.SessionID, waiting.Steps[0].ID)
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if resumed.State != types.StateQueued {
+		t.Fatalf("waiter state after command = %s, want queued while the slot is held", resumed.State)
+	}
+
+	close(model.release)
+	if err := <-holderDone; err != nil {
+		t.Fatalf("holder approve: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		conv, err := st.Get(ctx, waiter.SessionID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if conv.State == types.StateCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued conversation never completed, state %s", conv.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRequeueStrandedResumesAfterRestart(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &routedModel{replies: map[string][]string{}}
+	before := New(st, model, nil)
+	ctx := context.Background()
+	var ids []string
+	for _, state := range []types.ConversationState{types.StateQueued, types.StateExecuting} {
+		conv, err := before.CreateConversation(ctx, "Stranded "+string(state))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		conv.State = state
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		ids = append(ids, conv.SessionID)
+	}
+
+	after := New(st, model, nil, WithMaxExecuting(1))
+	n, err := after.RequeueStranded(ctx)
+	if err != nil {
+		t.Fatalf("requeue: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("requeued %d conversations, want 2", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, id := range ids {
+		for {
+			conv, err := st.Get(ctx, id)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if conv.State == types.StateCompleted {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stranded conversation %s never completed, state %s", id, conv.State)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestWorkerShutdownWaitsForPromotionsAndParksUnstartedWork(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &gatedModel{entered: make(chan string, 4), release: make(chan struct{})}
+	svc := New(st, model, nil, WithMaxExecuting(1))
+	ctx := context.Background()
+	first, err := svc.CreateConversation(ctx, "First")
+	if err != nil {
+		t.Fatalf("create first: %v", err)
+	}
+	second, err := svc.CreateConversation(ctx, "Second")
+	if err != nil {
+		t.Fatalf("create second: %v", err)
+	}
+	workerCtx, stop := context.WithCancel(ctx)
+	wait := svc.StartWorker(workerCtx)
+	for _, id := range []string{first.SessionID, second.SessionID} {
+		if _, err := svc.ApprovePlan(ctx, id); err != nil {
+			t.Fatalf("approve %s: %v", id, err)
+		}
+	}
+	<-model.entered
+	close(model.release)
+	// The second conversation is promoted by releaseSlot, outside the
+	// worker's own loop; shutdown must still wait for it.
+	<-model.entered
+	stop()
+	wait()
+	conv, err := st.Get(ctx, second.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("promoted conversation state after wait = %s, want completed", conv.State)
+	}
+
+	third, err := svc.CreateConversation(ctx, "Third")
+	if err != nil {
+		t.Fatalf("create third: %v", err)
+	}
+	work, slots, _, _ := svc.openWorkQueue(ctx)
+	if _, err := svc.ApprovePlan(ctx, third.SessionID); err != nil {
+		t.Fatalf("approve third: %v", err)
+	}
+	svc.drainWorkQueue(ctx, work, slots)
+	conv, err = st.Get(ctx, third.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if conv.State != types.StateQueued {
+		t.Fatalf("unstarted conversation state after shutdown = %s, want queued", conv.State)
+	}
+}
+
+// concurrencyModel plans slowly and records the most planning calls it saw
+// in flight at once.
+type concurrencyModel struct {
+	mu       sync.Mutex
+	plans    int
+	inFlight int
+	peak     int
+}
+
+func (m *concurrencyModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	m.mu.Lock()
+	m.plans++
+	id := fmt.Sprintf("sess-%d", m.plans)
+	m.inFlight++
+	m.peak = max(m.peak, m.inFlight)
+	m.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+	return "1) do the work", "raw", id, 1, nil
+}
+
+func TestPlanConcurrencyBoundsEveryCreate(t *testing.T) {
+	model := &concurrencyModel{}
+	svc := New(store.NewMemoryStore(), model, nil, WithPlanConcurrency(2))
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			items := make([]types.BulkCreateItem, 4)
+			for j := range items {
+				items[j].Prompt = fmt.Sprintf("Bulk goal %d", j)
+			}
+			for _, result := range svc.CreateConversations(ctx, items) {
+				if result.Error != "" {
+					t.Errorf("bulk create: %s", result.Error)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := svc.CreateConversation(ctx, "Single goal"); err != nil {
+				t.Errorf("create: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if model.plans != 10 {
+		t.Fatalf("planned %d conversations, want 10", model.plans)
+	}
+	if model.peak > 2 {
+		t.Fatalf("%d planning calls ran at once, want at most 2", model.peak)
+	}
+}
+
+func TestParsePlanDedupSteps(t *testing.T) {
+	plan := "1) Install dependencies\n2) Run tests\n3) install dependencies.\n4) Ship it\nACCEPT: tests pass"
+	svc := New(store.NewMemoryStore(), &fakeModel{}, nil)
+
+	steps, _ := svc.parsePlan(plan)
+	if len(steps) != 4 {
+		t.Fatalf("dedup disabled should keep all steps, got %d", len(steps))
+	}
+
+	svc.dedupSteps = true
+	steps, acceptance := svc.parsePlan(plan)
+	if len(steps) != 3 {
+		t.Fatalf("expected duplicate removed, got %+v", steps)
+	}
+	if steps[0].Title != "1) Install dependencies" || steps[2].Title != "4) Ship it" {
+		t.Fatalf("unexpected steps kept: %+v", steps)
+	}
+	for i, step := range steps {
+		if want := fmt.Sprintf("step-%d", i+1); step.ID != want {
+			t.Fatalf("step %d id = %s, want %s", i, step.ID, want)
+		}
+	}
+	if len(acceptance) != 1 {
+		t.Fatalf("acceptance criteria should be untouched: %v", acceptance)
+	}
+}
+
+func TestRestartFromStepRerunsLaterSteps(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{
+		replies: []string{
+			"1) fetch\n2) build\n3) test",
+			"SUCCESS: fetched",
+			"SUCCESS: built v1",
+			"SUCCESS: tested v1",
+			"SUCCESS: built v2",
+			"SUCCESS: tested v2",
+		},
+	}
+	svc := New(st, model, nil)
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Release")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("expected completion, got %s", conv.State)
+	}
+
+	conv, err = svc.RestartFromStep(ctx, conv.SessionID, "step-2")
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("expected completion after restart, got %s", conv.State)
+	}
+	if got := strings.Join(conv.Steps[0].Logs, "|"); got != "SUCCESS: fetched" {
+		t.Fatalf("step 1 should be untouched, logs %q", got)
+	}
+	if got := strings.Join(conv.Steps[1].Logs, "|"); got != "SUCCESS: built v2" {
+		t.Fatalf("step 2 should re-run, logs %q", got)
+	}
+	if got := strings.Join(conv.Steps[2].Logs, "|"); got != "SUCCESS: tested v2" {
+		t.Fatalf("step 3 should re-run, logs %q", got)
+	}
+	rerun := model.prompts[len(model.prompts)-2:]
+	if !strings.Contains(rerun[0], "Step: 2) build") || !strings.Contains(rerun[1], "Step: 3) test") {
+		t.Fatalf("unexpected re-run prompts: %q", rerun)
+	}
+}
+
+func TestCompletionTemplateOverridesMessage(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) compile\n2) package", "COMMAND: make", "SUCCESS: packaged"}}
+	svc := New(st, model, nil)
+	svc.prompts = &PromptSet{
+		Completion: template.Must(template.New("completion").Parse(
+			"Finished {{.Goal}}:{{range .Steps}} [{{.Title}}]{{end}}")),
+	}
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Build release")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	svc.runner = &ShellRunner{Shell: "true"}
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, "step-1")
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("expected completion, got %s", conv.State)
+	}
+	if want := "Finished Build release: [1) compile] [2) package]"; conv.CompletedMessage != want {
+		t.Fatalf("completed message = %q, want %q", conv.CompletedMessage, want)
+	}
+
+	svc.prompts = nil
+	if got := svc.renderCompletionMessage(conv, "SUCCESS: packaged"); got != "Plan completed successfully. Last response: SUCCESS: packaged" {
+		t.Fatalf("fallback message = %q", got)
+	}
+}
+
+func TestValidatePromptsFlagsMissingFields(t *testing.T) {
+	prompts, err := LoadPrompts("../../prompts")
+	if err != nil {
+		t.Fatalf("load prompts: %v", err)
+	}
+	svc := New(store.NewMemoryStore(), &fakeModel{}, nil, WithPrompts(prompts))
+	if errs := svc.ValidatePrompts(); len(errs) != 0 {
+		t.Fatalf("shipped prompts should validate, got %+v", errs)
+	}
+
+	prompts.Verify = template.Must(template.New("verify.tmpl").Parse("Goal: {{.Goal}}\n{{.Checklst}}"))
+	errs := svc.ValidatePrompts()
+	if len(errs) != 1 || errs[0].Template != "verify" || !strings.Contains(errs[0].Error, "Checklst") {
+		t.Fatalf("expected verify template to be flagged, got %+v", errs)
+	}
+}
+
+func TestExecutionPromptIncludesChatMessages(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) deploy the service", "Noted, staging it is.", "SUCCESS: deployed"}}
+	svc := New(st, model, nil, WithContextMessages(4))
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.Send(ctx, conv.SessionID, "Use the staging cluster, not prod"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	execPrompt := model.prompts[len(model.prompts)-1]
+	if !strings.Contains(execPrompt, "Recent messages:\nuser: Use the staging cluster, not prod\nassistant: Noted, staging it is.") {
+		t.Fatalf("execution prompt missing chat context: %q", execPrompt)
+	}
+
+	svc.contextMessages = 0
+	if got := svc.executionContext(conv, "execute", true); strings.Contains(got, "Recent messages") {
+		t.Fatalf("messages should be omitted when disabled: %q", got)
+	}
+}
+
+func TestSweepExpiresUnapprovedPlans(t *testing.T) {
+	st := store.NewMemoryStore()
+	svc := New(st, &scriptedModel{replies: []string{"1) deploy"}}, nil)
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	svc.maxHumanWait = time.Hour
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy the service")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("human wait must not expire plans: n=%d err=%v", n, err)
+	}
+
+	svc.planExpiry = 3 * time.Hour
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("plan expired early: n=%d err=%v", n, err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, err := svc.Sweep(ctx); err != nil || n != 1 {
+		t.Fatalf("expected one expired plan: n=%d err=%v", n, err)
+	}
+	got, err := st.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.State != types.StateAborted || !strings.Contains(got.CompletedMessage, "Plan expired") {
+		t.Fatalf("unexpected expired conversation: state=%s message=%q", got.State, got.CompletedMessage)
+	}
+}
+
+func TestSweepMeasuresPlanExpiryFromLatestPlanVersion(t *testing.T) {
+	st := store.NewMemoryStore()
+	svc := New(st, &scriptedModel{replies: []string{"1) deploy"}}, nil, WithPlanExpiry(time.Hour))
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy the service")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	now = now.Add(50 * time.Minute)
+	if _, err := svc.UpdatePlan(ctx, conv.SessionID, "1) deploy to staging\n2) deploy to prod"); err != nil {
+		t.Fatalf("update plan: %v", err)
+	}
+	now = now.Add(20 * time.Minute)
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("plan edited 20 minutes ago expired: n=%d err=%v", n, err)
+	}
+	now = now.Add(45 * time.Minute)
+	if n, err := svc.Sweep(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the edited plan to expire an hour after the edit: n=%d err=%v", n, err)
+	}
+}
+
+func TestSweepMeasuresWaitFromStateEntry(t *testing.T) {
+	st := store.NewMemoryStore()
+	svc := New(st, &scriptedModel{replies: []string{"1) deploy"}}, nil, WithMaxHumanWait(time.Hour))
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy the service")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	now = now.Add(3 * time.Hour)
+	if _, err := svc.SetState(ctx, conv.SessionID, types.StateAwaitingInfo, "Which region?"); err != nil {
+		t.Fatalf("set state: %v", err)
+	}
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("conversation that just entered awaiting_info was swept: n=%d err=%v", n, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	unlock := svc.actions.Lock(conv.SessionID)
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("conversation a human is acting on was swept: n=%d err=%v", n, err)
+	}
+	unlock()
+	if n, err := svc.Sweep(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the overdue conversation swept: n=%d err=%v", n, err)
+	}
+}
+
+func TestSweepAbortsConversationsWaitingOnHuman(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) ask for the repo", "NEED: Which repo?", "No command"}}
+	svc := New(st, model, nil)
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Clone the repo")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateAwaitingInfo {
+		t.Fatalf("expected awaiting_info, got %s", conv.State)
+	}
+
+	now = now.Add(48 * time.Hour)
+	if n, err := svc.Sweep(ctx); err != nil || n != 0 {
+		t.Fatalf("sweeper must be opt-in: n=%d err=%v", n, err)
+	}
+
+	svc.maxHumanWait = 24 * time.Hour
+	n, err := svc.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected one aborted conversation, got %d", n)
+	}
+	got, err := st.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.State != types.StateAborted || !strings.Contains(got.CompletedMessage, "Timed out waiting for human") {
+		t.Fatalf("unexpected aborted conversation: state=%s message=%q", got.State, got.CompletedMessage)
+	}
+	if !got.CompletedAt.Equal(now) {
+		t.Fatalf("completed at = %s, want %s", got.CompletedAt, now)
+	}
+}
+
+func TestSetStateRecordsTransition(t *testing.T) {
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	if err := st.Save(ctx, &types.Conversation{SessionID: "sess-admin", State: types.StateBlocked, AwaitingReason: "Command failed"}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	svc := New(st, &fakeModel{}, nil)
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+
+	if _, err := svc.SetState(ctx, "sess-admin", "bogus", "typo"); err == nil {
+		t.Fatalf("expected unknown state to be rejected")
+	}
+	conv, err := svc.SetState(ctx, "sess-admin", types.StateExecuting, "manual recovery")
+	if err != nil {
+		t.Fatalf("set state: %v", err)
+	}
+	if conv.State != types.StateExecuting || conv.AwaitingReason != "" {
+		t.Fatalf("state = %s, awaiting reason = %q; want executing with no reason", conv.State, conv.AwaitingReason)
+	}
+	stored, err := st.Get(ctx, "sess-admin")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(stored.Transitions) != 1 {
+		t.Fatalf("expected one transition, got %+v", stored.Transitions)
+	}
+	tr := stored.Transitions[0]
+	if tr.From != types.StateBlocked || tr.To != types.StateExecuting || tr.Reason != "manual recovery" || !tr.At.Equal(now) {
+		t.Fatalf("unexpected transition: %+v", tr)
+	}
+	if conv, err = svc.SetState(ctx, "sess-admin", types.StateBlocked, "waiting on ops"); err != nil {
+		t.Fatalf("set state: %v", err)
+	}
+	if conv.AwaitingReason != "waiting on ops" {
+		t.Fatalf("awaiting reason = %q, want the override reason", conv.AwaitingReason)
+	}
+}
+
+func TestStepCriteriaInclusion(t *testing.T) {
+	conv := &types.Conversation{
+		Prompt:             "Ship",
+		PlanText:           "1) build",
+		AcceptanceCriteria: []string{"binary builds", "tests pass", "docs updated"},
+		Steps:              []types.Step{{ID: "step-1", Title: "1) build"}},
+	}
+	svc := New(store.NewMemoryStore(), &fakeModel{}, nil)
+	prompts, err := LoadPrompts("../../prompts")
+	if err != nil {
+		t.Fatalf("load prompts: %v", err)
+	}
+	for _, withTemplates := range []bool{false, true} {
+		svc.prompts = nil
+		if withTemplates {
+			svc.prompts = prompts
+		}
+		svc.stepCriteriaMode = ""
+		prompt, err := svc.renderExecutePrompt(conv, &conv.Steps[0], "None")
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		if !strings.Contains(prompt, "Acceptance criteria: binary builds; tests pass; docs updated") {
+			t.Fatalf("default should include all criteria (templates=%v): %q", withTemplates, prompt)
+		}
+
+		svc.stepCriteriaMode = "none"
+		prompt, err = svc.renderExecutePrompt(conv, &conv.Steps[0], "None")
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		if strings.Contains(prompt, "Acceptance criteria") || strings.Contains(prompt, "tests pass") {
+			t.Fatalf("none should omit the criteria block (templates=%v): %q", withTemplates, prompt)
+		}
+		if !strings.Contains(prompt, "Plan: 1) build\nRecent context:") {
+			t.Fatalf("prompt layout broken (templates=%v): %q", withTemplates, prompt)
+		}
+
+		svc.stepCriteriaMode = "1"
+		prompt, err = svc.renderExecutePrompt(conv, &conv.Steps[0], "None")
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		if !strings.Contains(prompt, "Acceptance criteria: binary builds; (+2 more)") {
+			t.Fatalf("subset should truncate criteria (templates=%v): %q", withTemplates, prompt)
+		}
+	}
+}
+
+func TestWorkerAdvancesEnqueuedConversation(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &gatedModel{entered: make(chan string, 4), release: make(chan struct{})}
+	svc := New(st, model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Background")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	workerCtx, stop := context.WithCancel(ctx)
+	wait := svc.StartWorker(workerCtx)
+	deadline := time.Now().Add(2 * time.Second)
+
+	// The model is gated, so this only returns promptly if execution was handed off.
+	approved, err := svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if approved.State != types.StateExecuting {
+		t.Fatalf("state = %s, want executing", approved.State)
+	}
+	if got := <-model.entered; got != conv.SessionID {
+		t.Fatalf("worker executed %s, want %s", got, conv.SessionID)
+	}
+	close(model.release)
+	for {
+		got, err := st.Get(ctx, conv.SessionID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got.State == types.StateCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("conversation never completed, state %s", got.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stop()
+	wait()
+}
+
+func TestBlockEscalationToHumanSkipsReplan(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) deploy", "BLOCKED: missing credentials"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithBlockEscalation("human"))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateBlocked {
+		t.Fatalf("state = %s, want blocked", conv.State)
+	}
+	if !strings.Contains(conv.AwaitingReason, "missing credentials") {
+		t.Fatalf("awaiting reason = %q", conv.AwaitingReason)
+	}
+	if len(model.prompts) != 2 {
+		t.Fatalf("expected only plan and execute calls, got %d", len(model.prompts))
+	}
+	if conv.PlanVersion != 1 {
+		t.Fatalf("plan should not be replaced, version %d", conv.PlanVersion)
+	}
+}
+
+func TestOnlyOnePendingCommandPerConversation(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) build\n2) deploy",
+		"COMMAND: make build",
+		"SUCCESS: built it another way",
+		"COMMAND: make deploy",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Ship")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	// Resuming without approving re-runs the first step, which moves on.
+	conv, err = svc.Resume(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if conv.State != types.StateAwaitingCommand {
+		t.Fatalf("state = %s, want awaiting_command", conv.State)
+	}
+	var pending []string
+	for _, step := range conv.Steps {
+		if step.PendingCommand != "" {
+			pending = append(pending, step.PendingCommand)
+		}
+	}
+	if len(pending) != 1 || pending[0] != "make deploy" {
+		t.Fatalf("pending commands = %v, want only the current step's", pending)
+	}
+	inbox, err := svc.ListInbox(ctx)
+	if err != nil {
+		t.Fatalf("inbox: %v", err)
+	}
+	if len(inbox) != 1 || inbox[0].PendingCommand != "make deploy" || inbox[0].StepID != conv.Steps[1].ID {
+		t.Fatalf("inbox should surface the current step's command, got %+v", inbox)
+	}
+}
+
+type recordingRunner struct {
+	commands []string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, command string) ([]byte, error) {
+	r.commands = append(r.commands, command)
+	return []byte("\x1b[31mred\x1b[0m\n"), nil
+}
+
+func TestPendingCommandIsSanitizedForDisplayOnly(t *testing.T) {
+	const command = "echo ok\x1b[2K\x1b]0;pwned\x07\u202e"
+	model := &scriptedModel{replies: []string{"1) run it", "COMMAND: " + command}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	runner := &recordingRunner{}
+	svc.runner = runner
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Run")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	const shown = `echo ok\x1b[2K\x1b]0;pwned\x07\u202e`
+	inbox, err := svc.ListInbox(ctx)
+	if err != nil {
+		t.Fatalf("inbox: %v", err)
+	}
+	if len(inbox) != 1 || inbox[0].PendingCommand != shown {
+		t.Fatalf("inbox command not sanitized: %+v", inbox)
+	}
+	stored, err := svc.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got := svc.ForDisplay(stored).Steps[0].PendingCommand; got != shown {
+		t.Fatalf("display command = %q", got)
+	}
+	sawCommand := false
+	for len(events) > 0 {
+		ev := <-events
+		if ev.Command != "" {
+			sawCommand = true
+			if ev.Command != shown {
+				t.Fatalf("event command not sanitized: %q", ev.Command)
+			}
+		}
+	}
+	if !sawCommand {
+		t.Fatal("expected a command event")
+	}
+
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, "step-1")
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if len(runner.commands) != 1 || runner.commands[0] != command {
+		t.Fatalf("runner got %q, want the exact original", runner.commands)
+	}
+	for _, line := range svc.ForDisplay(conv).Steps[0].Logs {
+		if strings.ContainsRune(line, '\x1b') {
+			t.Fatalf("command output not sanitized for display: %q", line)
+		}
+	}
+}
+
+func TestQuestionsAndMessagesAreSanitizedForDisplay(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) deploy", "NEED: token\x1b]0;pwned\x07", "no command", "SUCCESS: deployed"}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateAwaitingInfo {
+		t.Fatalf("state = %s, want awaiting_info", conv.State)
+	}
+	const question = `token\x1b]0;pwned\x07`
+	inbox, err := svc.ListInbox(ctx)
+	if err != nil {
+		t.Fatalf("inbox: %v", err)
+	}
+	if len(inbox) != 1 || inbox[0].PendingInfo != question {
+		t.Fatalf("inbox question not sanitized: %+v", inbox)
+	}
+	if got := svc.ForDisplay(conv).Steps[0].PendingInfo; got != question {
+		t.Fatalf("display question = %q", got)
+	}
+
+	if _, err := svc.Send(ctx, conv.SessionID, "abc\x1b[2K123"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	stored, err := svc.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	shown := svc.ForDisplay(stored).Messages
+	if len(shown) == 0 || shown[len(shown)-1].Content != `abc\x1b[2K123` {
+		t.Fatalf("display messages = %+v", shown)
+	}
+	if stored.Messages[len(stored.Messages)-1].Content != "abc\x1b[2K123" {
+		t.Fatalf("stored message changed: %+v", stored.Messages)
+	}
+	msgs, err := svc.ChatMessages(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("chat messages: %v", err)
+	}
+	for _, m := range svc.DisplayMessages(msgs) {
+		if strings.ContainsRune(m.Content, '\x1b') {
+			t.Fatalf("chat message not sanitized: %q", m.Content)
+		}
+	}
+	for len(events) > 0 {
+		ev := <-events
+		for _, text := range []string{ev.Prompt, ev.ModelPrompt, ev.Note, ev.RawOutput} {
+			if strings.ContainsRune(text, '\x1b') {
+				t.Fatalf("%s event not sanitized: %+v", ev.Type, ev)
+			}
+		}
+	}
+}
+
+func TestMaxPlanTextCapsStoredPlan(t *testing.T) {
+	detail := strings.Repeat(" with lots of detail", 20)
+	plan := "1) build" + detail + "\n2) test" + detail + "\n3) ship" + detail
+	model := &scriptedModel{replies: []string{plan}}
+	svc := New(store.NewMemoryStore(), model, nil, WithMaxPlanText(200))
+
+	conv, err := svc.CreateConversation(context.Background(), "Ship")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(conv.PlanText) > 250 || !strings.Contains(conv.PlanText, "[plan truncated:") {
+		t.Fatalf("plan text not capped (%d bytes): %q", len(conv.PlanText), conv.PlanText)
+	}
+	if len(conv.Steps) != 3 || conv.Steps[2].Title != "3) ship"+detail {
+		t.Fatalf("steps should come from the full plan: %+v", conv.Steps)
+	}
+	prompt, err := svc.renderExecutePrompt(conv, &conv.Steps[0], "None")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(prompt, "\n3) ship"+detail+"\n") || strings.Contains(prompt, "[plan truncated:") {
+		t.Fatalf("prompt should use step titles for a truncated plan: %q", prompt)
+	}
+}
+
+func TestAllArtifactsAcrossConversations(t *testing.T) {
+	st := store.NewMemoryStore()
+	svc := New(st, &fakeModel{}, nil)
+	ctx := context.Background()
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seed := []*types.Conversation{
+		{SessionID: "sess-a", Artifacts: []types.Artifact{{ID: "art-1", Title: "go version", Source: "go version", Content: "go1.22", CreatedAt: base}}},
+		{SessionID: "sess-b", Artifacts: []types.Artifact{{ID: "art-2", Title: "disk usage", Source: "df -h", Content: "42%", CreatedAt: base.Add(time.Minute)}}},
+	}
+	for _, conv := range seed {
+		if err := st.Save(ctx, conv); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	refs, err := svc.AllArtifacts(ctx, "")
+	if err != nil {
+		t.Fatalf("all artifacts: %v", err)
+	}
+	if len(refs) != 2 || refs[0].SessionID != "sess-a" || refs[0].ID != "art-1" || refs[1].SessionID != "sess-b" || refs[1].ID != "art-2" {
+		t.Fatalf("unexpected listing: %+v", refs)
+	}
+
+	refs, err = svc.AllArtifacts(ctx, "DF")
+	if err != nil {
+		t.Fatalf("filtered artifacts: %v", err)
+	}
+	if len(refs) != 1 || refs[0].SessionID != "sess-b" {
+		t.Fatalf("filter should match source case-insensitively: %+v", refs)
+	}
+}
+
+func TestRequireCompletionReviewHoldsZeroCriteriaPlan(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) do it", "SUCCESS: done"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithRequireCompletionReview(true))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Regulated change")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateAwaitingCompletion || !conv.CompletedAt.IsZero() {
+		t.Fatalf("state = %s, completed at %v; want awaiting completion review", conv.State, conv.CompletedAt)
+	}
+	conv, err = svc.Complete(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("state after review = %s", conv.State)
+	}
+}
+
+func TestLowLogVerbosityOmitsRawOutput(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) check", "SUCCESS: fine"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversationWith(ctx, "Check", types.ConversationSettings{LogVerbosity: types.LogVerbosityLow})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if got := conv.Steps[0].Logs; len(got) != 1 || got[0] != "SUCCESS: fine" {
+		t.Fatalf("step logs should hold only the reply: %q", got)
+	}
+	for _, call := range conv.ModelCalls {
+		if call.RawOutput != "" {
+			t.Fatalf("raw output kept on model call: %+v", call)
+		}
+	}
+
+	full := &scriptedModel{replies: []string{"1) check", "SUCCESS: fine"}}
+	svc = New(store.NewMemoryStore(), full, nil)
+	conv, err = svc.CreateConversationWith(ctx, "Check", types.ConversationSettings{LogVerbosity: types.LogVerbosityFull})
+	if err != nil {
+		t.Fatalf("create full: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve full: %v", err)
+	}
+	if got := conv.Steps[0].Logs; len(got) != 2 || got[1] != "RAW: raw" {
+		t.Fatalf("full verbosity should log raw output: %q", got)
+	}
+
+	if _, err := svc.CreateConversationWith(ctx, "Check", types.ConversationSettings{LogVerbosity: "loud"}); err == nil {
+		t.Fatal("expected unknown verbosity to be rejected")
+	}
+}
+
+func TestStepArtifactsCaptureSuccessfulResults(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) measure latency\n2) report", "SUCCESS: p99 is 120ms", "SUCCESS: reported"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+	off := false
+	svc.stepArtifactsDefault = true
+
+	conv, err := svc.CreateConversation(ctx, "Latency check")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if len(conv.Artifacts) != 2 {
+		t.Fatalf("expected an artifact per successful step, got %+v", conv.Artifacts)
+	}
+	art := conv.Artifacts[0]
+	if art.Title != "1) measure latency" || art.Content != "SUCCESS: p99 is 120ms" || art.Source != "step:step-1" {
+		t.Fatalf("unexpected step artifact: %+v", art)
+	}
+
+	model = &scriptedModel{replies: []string{"1) measure latency", "SUCCESS: p99 is 120ms"}}
+	svc = New(store.NewMemoryStore(), model, nil, WithStepArtifacts(true))
+	conv, err = svc.CreateConversationWith(ctx, "Latency check", types.ConversationSettings{StepArtifacts: &off})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if len(conv.Artifacts) != 0 {
+		t.Fatalf("per-conversation setting should disable step artifacts: %+v", conv.Artifacts)
+	}
+}
+
+func TestCommandArtifactsOnlyOnFailure(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\n2) test", "COMMAND: true", "COMMAND: exit 3"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversationWith(ctx, "Check", types.ConversationSettings{CommandArtifacts: types.CommandArtifactsOnlyOnFailure})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve plan: %v", err)
+	}
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, conv.Steps[0].ID)
+	if err != nil {
+		t.Fatalf("approve build: %v", err)
+	}
+	if len(conv.Artifacts) != 0 {
+		t.Fatalf("successful command should not create an artifact: %+v", conv.Artifacts)
+	}
+	if conv.State != types.StateAwaitingCommand {
+		t.Fatalf("state = %s, want awaiting_command", conv.State)
+	}
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, conv.Steps[1].ID)
+	if err != nil {
+		t.Fatalf("approve test: %v", err)
+	}
+	if conv.State != types.StateBlocked {
+		t.Fatalf("state = %s, want blocked", conv.State)
+	}
+	if len(conv.Artifacts) != 1 || conv.Artifacts[0].Source != "exit 3" {
+		t.Fatalf("failed command should create an artifact: %+v", conv.Artifacts)
+	}
+}
+
+func TestCancelRunningCommandKeepsPartialOutput(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) long job", "COMMAND: echo partial-output; sleep 30"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Long job")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.ApproveCommand(ctx, conv.SessionID, "step-1")
+		done <- err
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		svc.mu.Lock()
+		running := svc.commands[conv.SessionID] != nil
+		svc.mu.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("command never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // let the echo land before canceling
+
+	start := time.Now()
+	conv, err = svc.CancelRunningCommand(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("cancel took %s", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if conv.State != types.StateBlocked || conv.Steps[0].Status != types.StepBlocked || conv.AwaitingReason != "Command canceled by user" {
+		t.Fatalf("unexpected state %s / step %s / reason %q", conv.State, conv.Steps[0].Status, conv.AwaitingReason)
+	}
+	if logs := strings.Join(conv.Steps[0].Logs, "\n"); !strings.Contains(logs, "partial-output") {
+		t.Fatalf("partial output not kept: %q", logs)
+	}
+	if _, err := svc.CancelRunningCommand(ctx, conv.SessionID); err == nil {
+		t.Fatal("expected error when nothing is running")
+	}
+}
+
+func TestVerifyRemainingOnlySkipsSatisfiedCriteria(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) build\nACCEPTANCE:\n- Code compiles.\n- Tests pass",
+		"SUCCESS: built",
+		"FAIL: tests pass is not met yet\nMET: Code compiles",
+		"1) fix tests\nACCEPTANCE:\n- code compiles\n- Tests pass",
+		"SUCCESS: fixed",
+		"PASS: tests pass now",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil, WithVerifyRemainingOnly(true))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Fix the build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve replan: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("state = %s, want completed", conv.State)
+	}
+	reverify := model.prompts[5]
+	if strings.Contains(strings.ToLower(reverify), "code compiles") {
+		t.Fatalf("satisfied criterion was re-verified: %q", reverify)
+	}
+	if !strings.Contains(reverify, "- Tests pass") {
+		t.Fatalf("remaining criterion missing from verify prompt: %q", reverify)
+	}
+
+	// With every criterion already confirmed, no verify call is made at all.
+	calls := len(conv.ModelCalls)
+	conv.State = types.StateVerifying
+	if conv, err = svc.verifyAcceptance(ctx, conv); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if conv.State != types.StateCompleted || len(conv.ModelCalls) != calls {
+		t.Fatalf("expected completion without a model call, got state %s and %d new calls", conv.State, len(conv.ModelCalls)-calls)
+	}
+}
+
+func TestVerifyRemainingOnlyReverifiesAfterVagueFailure(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) build\nACCEPTANCE:\n- Code compiles\n- Tests pass",
+		"SUCCESS: built",
+		"FAIL: tests still red",
+		"1) fix tests\nACCEPTANCE:\n- Code compiles\n- Tests pass",
+		"SUCCESS: fixed",
+		"FAIL: still red",
+		"1) fix tests again",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil, WithVerifyRemainingOnly(true))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Fix the build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve replan: %v", err)
+	}
+	if conv.State == types.StateCompleted {
+		t.Fatal("a conversation whose verification failed completed without being re-verified")
+	}
+	verifies := 0
+	for _, call := range conv.ModelCalls {
+		if call.Phase == types.CallPhaseVerify {
+			verifies++
+		}
+	}
+	if verifies != 2 {
+		t.Fatalf("verify calls = %d, want the model asked again after the failure", verifies)
+	}
+}
+
+func TestReverificationRecognizesRephrasedCriteria(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) build\nACCEPTANCE:\n- Code compiles.\n- Tests pass",
+		"SUCCESS: built",
+		"FAIL: tests pass is not met yet\nMET: Code compiles",
+		"1) fix tests\nACCEPTANCE:\n- code compiles\n- All tests pass!",
+		"SUCCESS: fixed",
+		"PASS: all good",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Fix the build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateAwaitingPlanApproval || len(conv.MetCriteria) != 1 || conv.MetCriteria[0] != "Code compiles." {
+		t.Fatalf("after failed verification: state %s, met %q", conv.State, conv.MetCriteria)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve replan: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("state = %s, want completed", conv.State)
+	}
+	reverify := model.prompts[5]
+	if !strings.Contains(reverify, "- code compiles (previously verified)") {
+		t.Fatalf("rephrased criterion not recognized: %q", reverify)
+	}
+	if strings.Contains(reverify, "All tests pass! (previously verified)") {
+		t.Fatalf("unverified criterion marked as verified: %q", reverify)
+	}
+
+	if got := svc.dedupCriteria([]string{"Code compiles.", "- code  compiles", "Tests pass"}); len(got) != 2 || got[0] != "Code compiles." {
+		t.Fatalf("dedup = %q", got)
+	}
+}
+
+func TestVagueVerifyFailureConfirmsNoCriteria(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) build\nACCEPTANCE:\n- Code compiles\n- Tests pass",
+		"SUCCESS: built",
+		"FAIL: tests still red",
+		"1) fix tests\nACCEPTANCE:\n- Code compiles\n- Tests pass",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Fix the build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if len(conv.MetCriteria) != 0 {
+		t.Fatalf("a failure that confirms nothing marked criteria met: %q", conv.MetCriteria)
+	}
+}
+
+func TestVerificationUsesConfiguredVerifyModel(t *testing.T) {
+	exec := &scriptedModel{replies: []string{"1) build\nACCEPT: binary exists", "SUCCESS: built"}}
+	verify := &scriptedModel{replies: []string{"PASS: binary exists"}, sessionID: "sess-scripted"}
+	svc := New(store.NewMemoryStore(), exec, nil, WithVerifyModel(verify))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("state = %s, want completed", conv.State)
+	}
+	if len(verify.prompts) != 1 || !strings.Contains(verify.prompts[0], "binary exists") {
+		t.Fatalf("verify model prompts = %q", verify.prompts)
+	}
+	for _, p := range exec.prompts {
+		if strings.Contains(p, "Respond with PASS") {
+			t.Fatalf("execution model received the verification prompt: %q", p)
+		}
+	}
+}
+
+func TestVerifyModelKeepsItsOwnSession(t *testing.T) {
+	exec := &scriptedModel{replies: []string{
+		"1) build\nACCEPT: binary exists",
+		"SUCCESS: built",
+		"1) rebuild\nACCEPT: binary exists",
+		"SUCCESS: rebuilt",
+	}, sessionID: "sess-exec"}
+	verify := &scriptedModel{replies: []string{"FAIL: no binary", "PASS: binary exists"}, sessionID: "sess-verify"}
+	svc := New(store.NewMemoryStore(), exec, nil, WithVerifyModel(verify))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.CodexSessionID != "sess-exec" || conv.VerifySessionID != "sess-verify" {
+		t.Fatalf("sessions = %q/%q, want execution and verification kept apart", conv.CodexSessionID, conv.VerifySessionID)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve replan: %v", err)
+	}
+	if conv.State != types.StateCompleted {
+		t.Fatalf("state = %s, want completed", conv.State)
+	}
+	for i, session := range exec.sessions[1:] {
+		if session != "sess-exec" {
+			t.Fatalf("execution call %d resumed session %q, want sess-exec", i+1, session)
+		}
+	}
+	if got := strings.Join(verify.sessions, ","); got != ",sess-verify" {
+		t.Fatalf("verify sessions = %q, want a fresh session then its own", got)
+	}
+}
+
+func TestRejectPlanReplansWithFeedback(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) rewrite in Rust", "1) profile the hot path\n2) optimize it\nACCEPT: p99 under 100ms"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Make it faster")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.RejectPlan(ctx, conv.SessionID, "  "); err == nil {
+		t.Fatal("expected empty feedback to be rejected")
+	}
+	conv, err = svc.RejectPlan(ctx, conv.SessionID, "No rewrites; profile first")
+	if err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	if conv.State != types.StateAwaitingPlanApproval || conv.PlanVersion != 2 {
+		t.Fatalf("state = %s, plan version = %d; want awaiting approval of version 2", conv.State, conv.PlanVersion)
+	}
+	if len(conv.Steps) != 2 || conv.Steps[0].Title != "1) profile the hot path" {
+		t.Fatalf("revised plan not applied: %+v", conv.Steps)
+	}
+	if last := conv.Messages[len(conv.Messages)-1]; last.Role != "user" || last.Content != "No rewrites; profile first" {
+		t.Fatalf("feedback not recorded as a message: %+v", conv.Messages)
+	}
+	prompt := model.prompts[len(model.prompts)-1]
+	if !strings.Contains(prompt, "No rewrites; profile first") || !strings.Contains(prompt, "rewrite in Rust") {
+		t.Fatalf("replan prompt should carry feedback and the rejected plan: %q", prompt)
+	}
+}
+
+// flakyStore fails its first `failures` saves with err, or like a briefly
+// locked database when err is nil.
+type flakyStore struct {
+	*store.MemoryStore
+	failures int
+	saves    int
+	err      error
+}
+
+func (f *flakyStore) Save(ctx context.Context, conv *types.Conversation) error {
+	f.saves++
+	if f.saves <= f.failures {
+		if f.err != nil {
+			return f.err
+		}
+		return errors.New("database is locked")
+	}
+	return f.MemoryStore.Save(ctx, conv)
+}
+
+func TestSaveRetriesTransientStoreErrors(t *testing.T) {
+	st := &flakyStore{MemoryStore: store.NewMemoryStore(), failures: 1}
+	model := &scriptedModel{replies: []string{"1) expensive plan"}}
+	svc := New(st, model, nil, WithSaveRetries(2, time.Millisecond))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Plan it")
+	if err != nil {
+		t.Fatalf("create should survive a transient save failure: %v", err)
+	}
+	stored, err := st.Get(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("conversation not persisted: %v", err)
+	}
+	if stored.PlanText != "1) expensive plan" || len(model.prompts) != 1 {
+		t.Fatalf("plan = %q after %d model calls", stored.PlanText, len(model.prompts))
+	}
+
+	st = &flakyStore{MemoryStore: store.NewMemoryStore(), failures: 5}
+	svc = New(st, &scriptedModel{replies: []string{"1) plan"}}, nil, WithSaveRetries(2, time.Millisecond))
+	if _, err := svc.CreateConversation(ctx, "Plan it"); err == nil {
+		t.Fatal("expected the error once retries are exhausted")
+	}
+	if st.saves != 3 {
+		t.Fatalf("saves = %d, want 1 attempt + 2 retries", st.saves)
+	}
+
+	st = &flakyStore{MemoryStore: store.NewMemoryStore(), failures: 5, err: fmt.Errorf("encode conversation: %w", store.ErrInvalid)}
+	svc = New(st, &scriptedModel{replies: []string{"1) plan"}}, nil, WithSaveRetries(2, time.Hour))
+	if _, err := svc.CreateConversation(ctx, "Plan it"); !errors.Is(err, store.ErrInvalid) {
+		t.Fatalf("expected the invalid conversation error, got %v", err)
+	}
+	if st.saves != 1 {
+		t.Fatalf("saves = %d, want no retries for an invalid conversation", st.saves)
+	}
+}
+
+func TestUpdatePlanReplacesStepsBeforeApproval(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\n2) deploy to prod\nACCEPT: site is up", "SUCCESS: built", "SUCCESS: deployed", "PASS: staging is up"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Release")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.UpdatePlan(ctx, conv.SessionID, "1) build\n2) deploy to staging\nACCEPT: staging is up")
+	if err != nil {
+		t.Fatalf("update plan: %v", err)
+	}
+	if conv.State != types.StateAwaitingPlanApproval || conv.PlanVersion != 2 {
+		t.Fatalf("state = %s, plan version = %d; want awaiting approval of version 2", conv.State, conv.PlanVersion)
+	}
+	if len(conv.Steps) != 2 || conv.Steps[1].Title != "2) deploy to staging" {
+		t.Fatalf("steps not replaced: %+v", conv.Steps)
+	}
+	if len(conv.AcceptanceCriteria) != 1 || conv.AcceptanceCriteria[0] != "staging is up" {
+		t.Fatalf("criteria not replaced: %v", conv.AcceptanceCriteria)
+	}
+	if len(model.prompts) != 1 {
+		t.Fatalf("editing a plan should not call the model, got %d calls", len(model.prompts))
+	}
+
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if _, err := svc.UpdatePlan(ctx, conv.SessionID, "1) something else"); err == nil {
+		t.Fatal("expected update to be rejected once the plan is approved")
+	}
+}
+
+func TestAbortTerminatesConversation(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) deploy", "COMMAND: make deploy"}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	svc.clock = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Ship")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	conv, err = svc.Abort(ctx, conv.SessionID, "wrong environment")
+	if err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if conv.State != types.StateAborted || conv.AwaitingReason != "" || conv.CompletedMessage != "wrong environment" || conv.CompletedAt.IsZero() {
+		t.Fatalf("unexpected aborted conversation: %+v", conv)
+	}
+	if _, err := svc.Get(ctx, conv.SessionID); err != nil {
+		t.Fatalf("aborted conversation should stay retrievable: %v", err)
+	}
+	inbox, err := svc.ListInbox(ctx)
+	if err != nil {
+		t.Fatalf("inbox: %v", err)
+	}
+	if len(inbox) != 0 {
+		t.Fatalf("aborted conversation should leave the inbox: %+v", inbox)
+	}
+	if _, err := svc.Abort(ctx, conv.SessionID, ""); err == nil {
+		t.Fatal("expected aborting twice to fail")
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == "abort" {
+				if ev.Note != "wrong environment" {
+					t.Fatalf("abort event note = %q", ev.Note)
+				}
+				return
+			}
+		default:
+			t.Fatal("no abort event published")
+		}
+	}
+}
+
+func TestSuccessReplyPopulatesStepResult(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) measure latency\n2) summarize", "SUCCESS: p99 is 120ms", "done without a prefix"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Latency check")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if got := conv.Steps[0].Result; got != "p99 is 120ms" {
+		t.Fatalf("step result = %q, want text after SUCCESS:", got)
+	}
+	if got := conv.Steps[1].Result; got != "done without a prefix" {
+		t.Fatalf("step result = %q, want the whole reply", got)
+	}
+}
+
+func TestDenyCommandReplansWithoutRunningIt(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) clean up", "COMMAND: rm -rf /", "1) delete only build/"}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	runner := &recordingRunner{}
+	svc.runner = runner
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Free disk space")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	conv, err = svc.DenyCommand(ctx, conv.SessionID, conv.Steps[0].ID, "too destructive")
+	if err != nil {
+		t.Fatalf("deny: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Fatalf("denied command was run: %v", runner.commands)
+	}
+	if conv.State != types.StateAwaitingPlanApproval || conv.PlanVersion != 2 {
+		t.Fatalf("state = %s, plan version = %d; want a new plan awaiting approval", conv.State, conv.PlanVersion)
+	}
+	if len(conv.Steps) != 1 || conv.Steps[0].Title != "1) delete only build/" {
+		t.Fatalf("alternative plan not applied: %+v", conv.Steps)
+	}
+	prompt := model.prompts[len(model.prompts)-1]
+	if !strings.Contains(prompt, "rm -rf /") || !strings.Contains(prompt, "too destructive") {
+		t.Fatalf("replan prompt should name the denied command and reason: %q", prompt)
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == "log" && ev.Log == "DENIED: too destructive" {
+				return
+			}
+		default:
+			t.Fatal("DENIED log line not published")
+		}
+	}
+}
+
+func TestParseDirectiveToleratesMarkdown(t *testing.T) {
+	cases := []struct {
+		reply, keyword, payload string
+	}{
+		{"**COMMAND:** ls", "COMMAND", "ls"},
+		{"**COMMAND: ls -la**", "COMMAND", "ls -la"},
+		{"COMMAND: `make test`", "COMMAND", "make test"},
+		{"- NEED: foo", "NEED", "foo"},
+		{"> BLOCKED: x", "BLOCKED", "x"},
+		{"  success: shipped", "SUCCESS", "shipped"},
+		{"Built it; NEED: nothing", "", "Built it; NEED: nothing"},
+		{"- NEED more time", "", "- NEED more time"},
+		{"SUCCESS", "SUCCESS", ""},
+		{"PASS - all criteria met", "PASS", "- all criteria met"},
+		{"Successfully deployed", "", "Successfully deployed"},
+		{"Errors fixed", "", "Errors fixed"},
+		{"Blockedness resolved", "", "Blockedness resolved"},
+		{"Passed all checks", "", "Passed all checks"},
+		{"Failover configured", "", "Failover configured"},
+	}
+	for _, c := range cases {
+		keyword, payload := parseDirective(c.reply, true)
+		if keyword != c.keyword || payload != c.payload {
+			t.Errorf("parseDirective(%q) = %q, %q; want %q, %q", c.reply, keyword, payload, c.keyword, c.payload)
+		}
+	}
+	if keyword, _ := parseDirective("**COMMAND:** ls", false); keyword != "" {
+		t.Errorf("strict parsing should not see through markdown, got %q", keyword)
+	}
+}
+
+func TestMarkdownDirectivesRouteExecution(t *testing.T) {
+	cases := []struct {
+		reply string
+		state types.ConversationState
+	}{
+		{"**COMMAND:** ls", types.StateAwaitingCommand},
+		{"- NEED: foo", types.StateAwaitingInfo},
+		{"> BLOCKED: x", types.StateBlocked},
+	}
+	for _, c := range cases {
+		model := &scriptedModel{replies: []string{"1) do it", c.reply, "No command"}}
+		svc := New(store.NewMemoryStore(), model, nil, WithBlockEscalation("human"))
+		ctx := context.Background()
+		conv, err := svc.CreateConversation(ctx, "Route")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+		if err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if conv.State != c.state {
+			t.Errorf("%q routed to %s, want %s", c.reply, conv.State, c.state)
+		}
+		if c.state == types.StateAwaitingCommand && conv.Steps[0].PendingCommand != "ls" {
+			t.Errorf("pending command = %q, want ls", conv.Steps[0].PendingCommand)
+		}
+		if c.state == types.StateAwaitingInfo && conv.Steps[0].PendingInfo != "foo" {
+			t.Errorf("pending info = %q, want foo", conv.Steps[0].PendingInfo)
+		}
+	}
+}
+
+func TestMaxArtifactBytesTruncatesContent(t *testing.T) {
+	svc := New(store.NewMemoryStore(), &scriptedModel{}, nil, WithMaxArtifactBytes(16))
+	conv := &types.Conversation{SessionID: "sess-art"}
+
+	art := svc.addArtifact(conv, "Command output", "huge", strings.Repeat("x", 100), "yes")
+	if !strings.HasPrefix(art.Content, strings.Repeat("x", 16)+"\n") {
+		t.Fatalf("content not truncated to the cap: %q", art.Content)
+	}
+	if !strings.Contains(art.Content, "[artifact truncated: 84 of 100 bytes omitted]") {
+		t.Fatalf("truncation note missing: %q", art.Content)
+	}
+	small := svc.addArtifact(conv, "Command output", "small", "ok", "true")
+	if small.Content != "ok" {
+		t.Fatalf("content under the cap should be kept: %q", small.Content)
+	}
+}
+
+func TestCommandPolicyRefusesDeniedCommands(t *testing.T) {
+	policy, err := NewCommandPolicy([]string{"rm -rf", "mkfs", ":(){", `re:\bdd\s+if=`})
+	if err != nil {
+		t.Fatalf("policy: %v", err)
+	}
+	for _, cmd := range []string{"rm -rf /", "sudo mkfs.ext4 /dev/sda", ":(){ :|:& };:", "dd if=/dev/zero of=/dev/sda"} {
+		if policy.Check(cmd) == nil {
+			t.Errorf("%q should be denied", cmd)
+		}
+	}
+	if err := policy.Check("git add . && make test"); err != nil {
+		t.Errorf("harmless command denied: %v", err)
+	}
+	if _, err := NewCommandPolicy([]string{"re:("}); err == nil {
+		t.Error("expected invalid regexp to be rejected")
+	}
+
+	// A comma-separated config with spaces after the commas.
+	policy, err = NewCommandPolicy(strings.Split("rm -rf, mkfs, re:\\bdd\\s+if=", ","))
+	if err != nil {
+		t.Fatalf("policy from config: %v", err)
+	}
+	for _, cmd := range []string{"mkfs /dev/sda", "dd if=/dev/zero of=/dev/sda"} {
+		if policy.Check(cmd) == nil {
+			t.Errorf("%q should be denied by a pattern listed after \", \"", cmd)
+		}
+	}
+}
+
+func TestApproveCommandNeverRunsDeniedCommand(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) clean up", "COMMAND: rm -rf /tmp/work"}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	runner := &recordingRunner{}
+	svc.runner = runner
+	svc.commandPolicy, _ = NewCommandPolicy([]string{"rm -rf"})
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Clean")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve plan: %v", err)
+	}
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, conv.Steps[0].ID)
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Fatalf("denied command was executed: %v", runner.commands)
+	}
+	if conv.State != types.StateBlocked || conv.Steps[0].Status != types.StepBlocked || conv.Steps[0].PendingCommand != "" {
+		t.Fatalf("step should be blocked with nothing pending: %s %+v", conv.State, conv.Steps[0])
+	}
+	if !strings.Contains(conv.AwaitingReason, `"rm -rf"`) {
+		t.Fatalf("awaiting reason should name the pattern: %q", conv.AwaitingReason)
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == "command" && strings.HasPrefix(ev.Note, "REFUSED") {
+				return
+			}
+		default:
+			t.Fatal("no REFUSED command event published")
+		}
+	}
+}
+
+// sessionSwitchingModel hands back a new Codex session after planning.
+type sessionSwitchingModel struct {
+	calls    int
+	sessions []string
+}
+
+func (m *sessionSwitchingModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	m.calls++
+	m.sessions = append(m.sessions, sessionID)
+	if m.calls == 1 {
+		return "1) check", "raw", "codex-a", 1, nil
+	}
+	return "SUCCESS: checked", "raw", "codex-b", 1, nil
+}
+
+func TestGetByCodexSessionAfterSessionChanges(t *testing.T) {
+	model := &sessionSwitchingModel{}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Check")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	found, err := svc.GetByCodexSession(ctx, "codex-a")
+	if err != nil || found.SessionID != conv.SessionID {
+		t.Fatalf("lookup by planning session = %v, %v", found, err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.SessionID != "codex-a" || conv.CodexSessionID != "codex-b" {
+		t.Fatalf("ids = %q / %q; the stable id should stay put while the codex session moves", conv.SessionID, conv.CodexSessionID)
+	}
+	found, err = svc.GetByCodexSession(ctx, "codex-b")
+	if err != nil || found.SessionID != "codex-a" {
+		t.Fatalf("lookup by new codex session = %v, %v", found, err)
+	}
+	if _, err := svc.GetByCodexSession(ctx, "codex-z"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown codex session err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestInboxUpdatesAreCoalesced(t *testing.T) {
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), &scriptedModel{}, broker, WithInboxDebounce(30*time.Millisecond))
+	ctx := context.Background()
+
+	conv := &types.Conversation{SessionID: "sess-inbox", Prompt: "Ship"}
+	for _, state := range []types.ConversationState{types.StateExecuting, types.StateVerifying, types.StateAwaitingCompletion} {
+		conv.State = state
+		if err := svc.save(ctx, conv); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	var updates []obs.Event
+	deadline := time.After(150 * time.Millisecond)
+	for collecting := true; collecting; {
+		select {
+		case ev := <-events:
+			if ev.Type == "inbox" {
+				updates = append(updates, ev)
+			}
+		case <-deadline:
+			collecting = false
+		}
+	}
+	if len(updates) != 1 {
+		t.Fatalf("inbox updates = %+v, want one coalesced update", updates)
+	}
+	if updates[0].SessionID != "sess-inbox" || updates[0].State != string(types.StateAwaitingCompletion) {
+		t.Fatalf("coalesced update = %+v, want the latest state", updates[0])
+	}
+}
+
+func TestPromptTemplatesReceiveConversationAndStep(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) compile", "BLOCKED: no compiler", "1) install a compiler"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	svc.prompts = &PromptSet{
+		ExecuteStep: template.Must(template.New("execute_step").Parse(
+			"run {{.Step.ID}} of v{{.Conversation.PlanVersion}} ({{.Step.Status}})")),
+		Unblock: template.Must(template.New("unblock").Parse(
+			"unblock {{.Conversation.SessionID}} after {{len .Conversation.ModelCalls}} calls")),
+	}
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if got := model.prompts[1]; got != "run step-1 of v1 (in_progress)" {
+		t.Fatalf("execute prompt = %q", got)
+	}
+	if got := model.prompts[2]; got != "unblock sess-scripted after 2 calls" {
+		t.Fatalf("unblock prompt = %q", got)
+	}
+	if errs := svc.ValidatePrompts(); len(errs) != 0 {
+		t.Fatalf("templates using .Conversation and .Step should validate: %+v", errs)
+	}
+}
+
+func TestStatusUpdatedAtAdvancesOnStateTransition(t *testing.T) {
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	model := &scriptedModel{replies: []string{"1) build"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+	conv, err := svc.CreateConversation(ctx, "Build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	before, err := svc.Status(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := svc.SetState(ctx, conv.SessionID, types.StateBlocked, "waiting on ops"); err != nil {
+		t.Fatalf("set state: %v", err)
+	}
+	after, err := svc.Status(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !after.UpdatedAt.Equal(now) || !after.UpdatedAt.After(before.UpdatedAt) {
+		t.Fatalf("updated_at = %s after transition, was %s; want %s", after.UpdatedAt, before.UpdatedAt, now)
+	}
+}
+
+func TestNewOptionsPinClockAndCapSteps(t *testing.T) {
+	now := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	model := &scriptedModel{replies: []string{"1) build\n2) test\n3) deploy", "SUCCESS: built", "SUCCESS: tested"}}
+	svc := New(store.NewMemoryStore(), model, nil,
+		WithClock(func() time.Time { return now }),
+		WithMaxSteps(2),
+		WithCommandTimeout(5*time.Second),
+	)
+	svc.stepArtifactsDefault = true
+	ctx := context.Background()
+
+	if svc.commandTimeout != 5*time.Second {
+		t.Fatalf("command timeout = %s, want 5s", svc.commandTimeout)
+	}
+	conv, err := svc.CreateConversation(ctx, "Ship it")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(conv.Steps) != 2 {
+		t.Fatalf("expected plan capped at 2 steps, got %+v", conv.Steps)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	for _, step := range conv.Steps {
+		if !step.StartedAt.Equal(now) || !step.CompletedAt.Equal(now) {
+			t.Fatalf("step %s times = %s..%s, want %s", step.ID, step.StartedAt, step.CompletedAt, now)
+		}
+	}
+	if len(conv.Artifacts) != 2 {
+		t.Fatalf("expected two step artifacts, got %+v", conv.Artifacts)
+	}
+	prefix := fmt.Sprintf("artifact-%d-", now.UnixNano())
+	if a, b := conv.Artifacts[0].ID, conv.Artifacts[1].ID; a == b || !strings.HasPrefix(a, prefix) || !strings.HasPrefix(b, prefix) {
+		t.Fatalf("artifact IDs should use the clock and stay unique: %q, %q", a, b)
+	}
+}
+
+func TestStepTimeoutBlocksSlowStep(t *testing.T) {
+	model := &gatedModel{entered: make(chan string, 1), release: make(chan struct{})}
+	svc := New(store.NewMemoryStore(), model, nil, WithCommandTimeout(time.Hour), WithBlockEscalation("human"))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.SetStepTimeout(ctx, conv.SessionID, "step-1", -1); err == nil {
+		t.Fatal("expected a negative timeout to be rejected")
+	}
+	if _, err := svc.SetStepTimeout(ctx, conv.SessionID, "step-1", 1); err != nil {
+		t.Fatalf("set timeout: %v", err)
+	}
+
+	start := time.Now()
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("step ran %s despite a 1s timeout", elapsed)
+	}
+	step := conv.Steps[0]
+	if step.Status != types.StepBlocked || conv.State != types.StateBlocked {
+		t.Fatalf("expected blocked step, got step=%s conv=%s", step.Status, conv.State)
+	}
+	if !strings.Contains(conv.AwaitingReason, "step timed out after 1s") {
+		t.Fatalf("unexpected reason: %q", conv.AwaitingReason)
+	}
+	if _, err := svc.SetStepTimeout(ctx, conv.SessionID, "step-9", 1); err == nil {
+		t.Fatal("expected unknown step to be rejected")
+	}
+}
+
+func TestPromptStorageHashKeepsFingerprint(t *testing.T) {
+	ctx := context.Background()
+	goal := "Rotate the database password" + strings.Repeat(" and keep it secret", 20)
+
+	full := New(store.NewMemoryStore(), &scriptedModel{replies: []string{"1) rotate"}}, nil)
+	conv, err := full.CreateConversation(ctx, goal)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if got := conv.ModelCalls[0].Prompt; !strings.Contains(got, goal) {
+		t.Fatalf("full mode should keep the whole prompt, got %q", got)
+	}
+	fullPrompt := conv.ModelCalls[0].Prompt
+
+	hashed := New(store.NewMemoryStore(), &scriptedModel{replies: []string{"1) rotate"}}, nil, WithPromptStorage("hash"))
+	conv, err = hashed.CreateConversation(ctx, goal)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	got := conv.ModelCalls[0].Prompt
+	sum := sha256.Sum256([]byte(fullPrompt))
+	want := fmt.Sprintf("sha256:%s (%d bytes) ", hex.EncodeToString(sum[:]), len(fullPrompt))
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "…") {
+		t.Fatalf("hash mode prompt = %q, want fingerprint %q plus preview", got, want)
+	}
+	if strings.Contains(got, goal) || len(got) >= len(fullPrompt) {
+		t.Fatalf("hash mode leaked the full prompt: %q", got)
+	}
+}
+
+func TestParsePlanCapCountsStepsNotLines(t *testing.T) {
+	plan := "Plan:\n\n1) fetch\n\n\n2) build\n\n3) test\n\n\n\n4) package\n\n5) deploy\n\nACCEPTANCE:\n- site is up\n- tests pass\n"
+	steps, acceptance := parsePlanAndCriteria(plan, 0)
+	if len(steps) != 5 || steps[4].Title != "5) deploy" || steps[4].ID != "step-5" {
+		t.Fatalf("blank lines and preamble must not drop steps, got %+v", steps)
+	}
+	if len(acceptance) != 2 {
+		t.Fatalf("expected both criteria, got %v", acceptance)
+	}
+
+	svc := New(store.NewMemoryStore(), &scriptedModel{}, nil, WithMaxSteps(3))
+	steps, acceptance = svc.parsePlan(plan)
+	if len(steps) != 3 || steps[2].Title != "3) test" {
+		t.Fatalf("expected the first three steps, got %+v", steps)
+	}
+	if len(acceptance) != 2 {
+		t.Fatalf("criteria after the cap must survive, got %v", acceptance)
+	}
+}
+
+func TestVerifyNowCompletesWithPendingSteps(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) deploy\n2) smoke test\n3) announce\nACCEPT: site is up",
+		"COMMAND: make deploy",
+		"PASS: site is up",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Ship the site")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.VerifyNow(ctx, conv.SessionID); err == nil {
+		t.Fatal("expected verify-now to be refused before execution starts")
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateAwaitingCommand {
+		t.Fatalf("expected awaiting_command, got %s", conv.State)
+	}
+
+	conv, err = svc.VerifyNow(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("verify now: %v", err)
+	}
+	if conv.State != types.StateCompleted || conv.CompletedAt.IsZero() {
+		t.Fatalf("expected completion after PASS, got %s", conv.State)
+	}
+	if conv.Steps[1].Status != types.StepPending || conv.Steps[0].PendingCommand != "" {
+		t.Fatalf("remaining steps should be skipped and pending requests cleared: %+v", conv.Steps)
+	}
+	if last := model.prompts[len(model.prompts)-1]; !strings.Contains(last, "site is up") {
+		t.Fatalf("verification prompt should list the criteria: %q", last)
+	}
+}
+
+func TestVerifyNowRefusesWhileAStepIsRunning(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &gatedModel{entered: make(chan string, 1), release: make(chan struct{})}
+	svc := New(st, model, nil)
+	ctx, stop := context.WithCancel(context.Background())
+	wait := svc.StartWorker(ctx)
+	defer func() {
+		stop()
+		wait()
+	}()
+
+	conv, err := svc.CreateConversation(ctx, "Long job")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	<-model.entered
+	if _, err := svc.VerifyNow(ctx, conv.SessionID); err == nil || !strings.Contains(err.Error(), "executing") {
+		t.Fatalf("verify-now during a running step: err = %v", err)
+	}
+	close(model.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stored, err := st.Get(ctx, conv.SessionID)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if stored.State == types.StateCompleted {
+			break
+		}
+		if stored.State != types.StateExecuting || time.Now().After(deadline) {
+			t.Fatalf("the running step should finish undisturbed, got %s", stored.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJSONPlansParseStructuredReplies(t *testing.T) {
+	reply := "```json\n{\"steps\": [\"build the image\", {\"title\": \"deploy\", \"timeout_seconds\": 300}, \"  \"], \"acceptance\": [\"site is up\"]}\n```"
+	model := &scriptedModel{replies: []string{reply}}
+	svc := New(store.NewMemoryStore(), model, nil, WithJSONPlans(true))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Ship it")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.Contains(model.prompts[0], `{"steps":`) {
+		t.Fatalf("plan prompt should ask for JSON: %q", model.prompts[0])
+	}
+	if len(conv.Steps) != 2 || conv.Steps[0].Title != "build the image" || conv.Steps[1].ID != "step-2" || conv.Steps[1].TimeoutSeconds != 300 {
+		t.Fatalf("unexpected steps: %+v", conv.Steps)
+	}
+	if len(conv.AcceptanceCriteria) != 1 || conv.AcceptanceCriteria[0] != "site is up" {
+		t.Fatalf("unexpected criteria: %v", conv.AcceptanceCriteria)
+	}
+
+	steps, acceptance := svc.parsePlan("{ not json }\n1) build\nACCEPT: image exists")
+	if len(steps) != 2 || steps[1].Title != "1) build" || len(acceptance) != 1 {
+		t.Fatalf("invalid JSON should fall back to the text parser: %+v %v", steps, acceptance)
+	}
+}
+
+func TestModelCallBudgetBlocksUntilRaised(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\n2) test\n3) deploy", "SUCCESS: built", "SUCCESS: tested", "SUCCESS: deployed"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithMaxModelCalls(2))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Ship it")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv.State != types.StateBlocked || !strings.Contains(conv.AwaitingReason, "model-call budget exhausted") {
+		t.Fatalf("expected budget block, got %s %q", conv.State, conv.AwaitingReason)
+	}
+	if len(conv.ModelCalls) != 2 || conv.Steps[0].Status != types.StepDone || conv.Steps[1].Status != types.StepPending {
+		t.Fatalf("expected exactly two calls before blocking: calls=%d steps=%+v", len(conv.ModelCalls), conv.Steps)
+	}
+	if _, err := svc.Send(ctx, conv.SessionID, "any update?"); !errors.Is(err, ErrModelCallBudget) {
+		t.Fatalf("chat should be refused while out of budget, got %v", err)
+	}
+
+	conv, err = svc.ResumeWithBudget(ctx, conv.SessionID, 2)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if conv.State != types.StateCompleted || conv.ModelCallBudget != 4 || len(conv.ModelCalls) != 4 {
+		t.Fatalf("expected completion within the raised budget: state=%s budget=%d calls=%d", conv.State, conv.ModelCallBudget, len(conv.ModelCalls))
+	}
+
+	// A completed conversation out of calls can't continue until its budget
+	// is raised; the raise alone leaves it completed.
+	if _, err := svc.Continue(ctx, conv.SessionID, "Now document it"); !errors.Is(err, ErrModelCallBudget) {
+		t.Fatalf("continue should be refused while out of budget, got %v", err)
+	}
+	if _, err := svc.Resume(ctx, conv.SessionID); !errors.Is(err, ErrNotResumable) {
+		t.Fatalf("resume without extra calls should be refused, got %v", err)
+	}
+	conv, err = svc.ResumeWithBudget(ctx, conv.SessionID, 1)
+	if err != nil {
+		t.Fatalf("raise budget: %v", err)
+	}
+	if conv.State != types.StateCompleted || conv.ModelCallBudget != 5 {
+		t.Fatalf("raise should only grant calls: state=%s budget=%d", conv.State, conv.ModelCallBudget)
+	}
+	model.replies = append(model.replies, "1) write docs")
+	if conv, err = svc.Continue(ctx, conv.SessionID, "Now document it"); err != nil {
+		t.Fatalf("continue after raise: %v", err)
+	}
+	if conv.State != types.StateAwaitingPlanApproval {
+		t.Fatalf("state = %s, want awaiting_plan_approval", conv.State)
+	}
+}
+
+// echoModel answers each prompt after a short delay, long enough for
+// concurrent calls to overlap.
+type echoModel struct{}
+
+func (echoModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	time.Sleep(20 * time.Millisecond)
+	return "re: " + prompt, "raw", sessionID, 20, nil
+}
+
+func TestConcurrentSendsKeepEveryExchange(t *testing.T) {
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	if err := st.Save(ctx, &types.Conversation{SessionID: "sess-1", State: types.StateExecuting}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	svc := New(st, echoModel{}, nil)
+
+	var wg sync.WaitGroup
+	for _, msg := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(msg string) {
+			defer wg.Done()
+			if _, err := svc.Send(ctx, "sess-1", msg); err != nil {
+				t.Errorf("send %s: %v", msg, err)
+			}
+		}(msg)
+	}
+	wg.Wait()
+
+	conv, err := st.Get(ctx, "sess-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(conv.Messages) != 4 {
+		t.Fatalf("expected 2 user + 2 assistant messages, got %+v", conv.Messages)
+	}
+	for i := 0; i < 4; i += 2 {
+		user, reply := conv.Messages[i], conv.Messages[i+1]
+		if user.Role != "user" || reply.Role != "assistant" || reply.Content != "re: "+user.Content {
+			t.Fatalf("exchange %d out of order: %+v", i/2, conv.Messages)
+		}
+	}
+
+	svc.concurrentSends = "reject"
+	unlock := svc.sends.Lock("sess-1")
+	if _, err := svc.Send(ctx, "sess-1", "third"); !errors.Is(err, ErrSendInProgress) {
+		t.Fatalf("expected ErrSendInProgress, got %v", err)
+	}
+	unlock()
+}
+
+func TestStepEventsCarryStepAndConversationIDs(t *testing.T) {
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	model := &scriptedModel{replies: []string{"1) deploy", "BLOCKED: no credentials", "1) fetch credentials\n2) deploy"}}
+	svc := New(store.NewMemoryStore(), model, broker)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Deploy")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+
+	sawStep, sawReplan := false, false
+	for len(events) > 0 {
+		ev := <-events
+		if ev.ConversationID != conv.SessionID {
+			t.Fatalf("%s event has conversation id %q, want %q", ev.Type, ev.ConversationID, conv.SessionID)
+		}
+		switch {
+		case ev.Type == "step":
+			sawStep = true
+			if ev.StepID != "step-1" || ev.StepTitle != "1) deploy" {
+				t.Fatalf("step event missing step identifiers: %+v", ev)
+			}
+		case ev.Type == "plan" && ev.Note == "Block resolution plan":
+			sawReplan = true
+			if ev.StepID != "step-1" || ev.StepTitle != "1) deploy" {
+				t.Fatalf("replan event should name the blocked step: %+v", ev)
+			}
+		}
+	}
+	if !sawStep || !sawReplan {
+		t.Fatalf("expected step and replan events (step=%v replan=%v)", sawStep, sawReplan)
+	}
+}
+
+// usageModel replies like codex --json, reporting fixed token usage per call.
+type usageModel struct{}
+
+func (usageModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	raw := `{"type":"thread.started","thread_id":"sess-usage"}
+{"type":"item.completed","item":{"type":"agent_message","text":"1) do the work"}}
+{"type":"turn.completed","usage":{"input_tokens":100,"output_tokens":20}}`
+	return "1) do the work", raw, "sess-usage", 5, nil
+}
+
+func TestModelCallsRecordTokenUsage(t *testing.T) {
+	ctx := context.Background()
+	svc := New(store.NewMemoryStore(), usageModel{}, nil)
+	conv, err := svc.CreateConversation(ctx, "count tokens")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	call := conv.ModelCalls[0]
+	if call.PromptTokens != 100 || call.CompletionTokens != 20 || call.TotalTokens != 120 {
+		t.Fatalf("call usage = %d/%d/%d, want 100/20/120", call.PromptTokens, call.CompletionTokens, call.TotalTokens)
+	}
+	if conv.TotalTokens != 120 {
+		t.Fatalf("conversation total = %d, want 120", conv.TotalTokens)
+	}
+
+	plain := New(store.NewMemoryStore(), &scriptedModel{replies: []string{"1) rotate"}}, nil)
+	conv, err = plain.CreateConversation(ctx, "no usage")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv.ModelCalls[0].TotalTokens != 0 || conv.TotalTokens != 0 {
+		t.Fatalf("expected zero usage from a model that reports none, got %+v", conv.ModelCalls[0])
+	}
+}
+
+// gitRunner answers git context commands with canned output.
+type gitRunner struct {
+	commands []string
+}
+
+func (r *gitRunner) Run(ctx context.Context, command string) ([]byte, error) {
+	r.commands = append(r.commands, command)
+	switch command {
+	case "git rev-parse --abbrev-ref HEAD":
+		return []byte("feature/login\n"), nil
+	case "git status --short":
+		return []byte(" M auth.go\n"), nil
+	}
+	return nil, errors.New("unexpected command")
+}
+
+func TestGitContextBecomesArtifactsAndPlanContext(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) fix login"}}
+	runner := &gitRunner{}
+	svc := New(store.NewMemoryStore(), model, nil, WithRunner(runner))
+	policy, err := NewCommandPolicy([]string{"git push"})
+	if err != nil {
+		t.Fatalf("policy: %v", err)
+	}
+	svc.commandPolicy = policy
+	svc.gitContext = []string{"git rev-parse --abbrev-ref HEAD", "git status --short", "git push origin HEAD"}
+
+	conv, err := svc.CreateConversation(context.Background(), "Fix the login bug")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(runner.commands) != 2 {
+		t.Fatalf("policy should stop the refused command, ran %v", runner.commands)
+	}
+	if len(conv.Artifacts) != 2 || conv.Artifacts[0].Content != "feature/login" || conv.Artifacts[1].Source != "git status --short" {
+		t.Fatalf("unexpected git artifacts: %+v", conv.Artifacts)
+	}
+	prompt := model.prompts[0]
+	for _, want := range []string{"Fix the login bug", "$ git rev-parse --abbrev-ref HEAD\nfeature/login", "M auth.go"} {
+		if !strings.Contains(prompt, want) {
+			t.Fatalf("plan prompt missing %q:\n%s", want, prompt)
+		}
+	}
+	if conv.Prompt != "Fix the login bug" {
+		t.Fatalf("stored goal should stay unchanged, got %q", conv.Prompt)
+	}
+}
+
+func TestFullWorkQueueRejectsApprovalsWithoutStartingThem(t *testing.T) {
+	st := store.NewMemoryStore()
+	model := &scriptedModel{replies: []string{"1) first", "1) second"}, sessionID: "sess-first"}
+	svc := New(st, model, nil, WithWorkQueue(1, 0))
+	ctx := context.Background()
+	// Open the queue without a worker draining it, as during a burst.
+	work, slots, _, _ := svc.openWorkQueue(ctx)
+
+	first, err := svc.CreateConversation(ctx, "first")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	model.sessionID = "sess-second"
+	second, err := svc.CreateConversation(ctx, "second")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, first.SessionID); err != nil {
+		t.Fatalf("approve first: %v", err)
+	}
+
+	svc.enqueueWait = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := svc.ApprovePlan(ctx, second.SessionID); !errors.Is(err, ErrWorkQueueFull) {
+		t.Fatalf("expected ErrWorkQueueFull, got %v", err)
+	}
+	if waited := time.Since(start); waited < svc.enqueueWait {
+		t.Fatalf("approval should wait EnqueueWait before failing, waited %s", waited)
+	}
+	stored, err := st.Get(ctx, second.SessionID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.State != types.StateAwaitingPlanApproval {
+		t.Fatalf("rejected approval must leave the plan awaiting approval, got %s", stored.State)
+	}
+
+	// Once the worker takes the first conversation there is room again.
+	if got := <-work; got != first.SessionID {
+		t.Fatalf("queued %q, want %q", got, first.SessionID)
+	}
+	<-slots
+	if _, err := svc.ApprovePlan(ctx, second.SessionID); err != nil {
+		t.Fatalf("approve after drain: %v", err)
+	}
+}
+
+// attemptModel plans, succeeds every step, and always fails verification,
+// starting a new session for each fresh conversation.
+type attemptModel struct {
+	sessions int
+}
+
+func (m *attemptModel) Send(ctx context.Context, sessionID, prompt string) (string, string, string, int64, error) {
+	if sessionID == "" {
+		m.sessions++
+		sessionID = fmt.Sprintf("attempt-%d", m.sessions)
+	}
+	switch {
+	case strings.Contains(prompt, "Respond with PASS"):
+		return "FAIL: still broken", "raw", sessionID, 1, nil
+	case strings.HasPrefix(prompt, "You are an execution planner"), strings.Contains(prompt, "New Plan:"):
+		return "1) fix it\nACCEPT: it works", "raw", sessionID, 1, nil
+	}
+	return "SUCCESS: fixed", "raw", sessionID, 1, nil
+}
+
+func TestVerificationFailuresRestartFreshAttempts(t *testing.T) {
+	st := store.NewMemoryStore()
+	// The plan cache must not hand the failed plan back to the fresh attempt.
+	svc := New(st, &attemptModel{}, nil, WithMaxVerifyReplans(1), WithMaxAttempts(2), WithPlanCacheTTL(time.Hour))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Fix the flaky build")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	first := conv.SessionID
+	// One replan is allowed, so the second failed verification gives up.
+	for i := 0; i < 2; i++ {
+		if conv, err = svc.ApprovePlan(ctx, first); err != nil {
+			t.Fatalf("approve %d: %v", i, err)
+		}
+	}
+	if conv.State != types.StateAborted || conv.RestartedAs == "" {
+		t.Fatalf("first attempt should be aborted and linked, got state=%s restarted_as=%q", conv.State, conv.RestartedAs)
+	}
+	next, err := st.Get(ctx, conv.RestartedAs)
+	if err != nil {
+		t.Fatalf("get next attempt: %v", err)
+	}
+	if next.SessionID == first || next.Attempt != 2 || strings.Join(next.PriorAttempts, ",") != first {
+		t.Fatalf("unexpected second attempt: id=%s attempt=%d prior=%v", next.SessionID, next.Attempt, next.PriorAttempts)
+	}
+	if next.State != types.StateAwaitingPlanApproval || next.Prompt != "Fix the flaky build" || next.PlanCached {
+		t.Fatalf("second attempt should replan the original prompt, got state=%s prompt=%q cached=%v", next.State, next.Prompt, next.PlanCached)
+	}
+
+	// The last attempt blocks instead of starting a third.
+	for i := 0; i < 2; i++ {
+		if conv, err = svc.ApprovePlan(ctx, next.SessionID); err != nil {
+			t.Fatalf("approve attempt 2 (%d): %v", i, err)
+		}
+	}
+	if conv.State != types.StateBlocked || conv.RestartedAs != "" {
+		t.Fatalf("final attempt should block, got state=%s restarted_as=%q", conv.State, conv.RestartedAs)
+	}
+	ids, err := svc.List(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected exactly two attempts, got %v", ids)
+	}
+}
+
+func TestPlanCacheDropsExpiredEntries(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	model := &scriptedModel{replies: []string{"1) one", "1) two", "1) three"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithPlanCacheTTL(time.Minute), WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+	for _, prompt := range []string{"First goal", "Second goal"} {
+		if _, err := svc.CreateConversation(ctx, prompt); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := svc.CreateConversation(ctx, "Third goal"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if n := len(svc.planCache); n != 1 {
+		t.Fatalf("plan cache holds %d entries, want only the unexpired one", n)
+	}
+}
+
+func TestConversationWorkDirAppliesToApprovedCommands(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	model := &scriptedModel{replies: []string{"1) check location", "COMMAND: pwd -P"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	ctx := context.Background()
+
+	if _, err := svc.CreateConversationWith(ctx, "Where am I", types.ConversationSettings{WorkDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expected a missing work dir to be rejected")
+	}
+	conv, err := svc.CreateConversationWith(ctx, "Where am I", types.ConversationSettings{WorkDir: dir})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if conv, err = svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if conv, err = svc.ApproveCommand(ctx, conv.SessionID, conv.Steps[0].ID); err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if logs := strings.Join(conv.Steps[0].Logs, "\n"); !strings.Contains(logs, dir) {
+		t.Fatalf("command did not run in %s: %q", dir, logs)
+	}
+}
+
+func TestPlanCacheServesIdenticalPlanningPrompts(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\nACCEPT: it builds", "1) build again"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	svc.clock = func() time.Time { return now }
+	svc.planCacheTTL = time.Hour
+	ctx := context.Background()
+
+	first, err := svc.CreateConversation(ctx, "Build the project")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	second, err := svc.CreateConversation(ctx, "Build the project")
+	if err != nil {
+		t.Fatalf("create again: %v", err)
+	}
+	if len(model.prompts) != 1 {
+		t.Fatalf("expected one planning call to reach the model, got %d", len(model.prompts))
+	}
+	if second.SessionID == first.SessionID || !second.PlanCached || codexSession(second) != "" {
+		t.Fatalf("cached plan must get its own conversation and no codex session: id=%s cached=%v codex=%q", second.SessionID, second.PlanCached, codexSession(second))
+	}
+	if second.PlanText != first.PlanText || len(second.AcceptanceCriteria) != 1 {
+		t.Fatalf("cached plan differs: %q / %v", second.PlanText, second.AcceptanceCriteria)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := svc.CreateConversation(ctx, "Build the project"); err != nil {
+		t.Fatalf("create after expiry: %v", err)
+	}
+	if len(model.prompts) != 2 {
+		t.Fatalf("expired cache entry should call the model again, got %d calls", len(model.prompts))
+	}
+}
+
+// streamingModel is a scriptedModel that streams each reply word by word.
+type streamingModel struct {
+	scriptedModel
+}
+
+func (m *streamingModel) SendStream(ctx context.Context, sessionID, prompt string, onChunk func(string)) (string, string, string, int64, error) {
+	reply, raw, session, duration, err := m.Send(ctx, sessionID, prompt)
+	for _, word := range strings.Fields(reply) {
+		onChunk(word)
+	}
+	return reply, raw, session, duration, err
+}
+
+func TestStreamingModelPublishesDeltaEvents(t *testing.T) {
+	model := &streamingModel{scriptedModel{replies: []string{"1) greet", "SUCCESS: said hello"}}}
+	broker := obs.NewBroker()
+	events := broker.Subscribe()
+	defer broker.Unsubscribe(events)
+	svc := New(store.NewMemoryStore(), model, broker)
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Greet")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if deltas := broker.Events(obs.EventFilter{Type: "delta"}); len(deltas) != 0 {
+		t.Fatalf("deltas should stay out of history, got %d", len(deltas))
+	}
+	var chunks []string
+	for len(events) > 0 {
+		ev := <-events
+		if ev.Type != "delta" {
+			continue
+		}
+		if ev.StepID != conv.Steps[0].ID || ev.ConversationID != conv.SessionID {
+			t.Fatalf("delta not tagged with the step: %+v", ev)
+		}
+		chunks = append(chunks, ev.Reply)
+	}
+	if got := strings.Join(chunks, " "); got != "SUCCESS: said hello" {
+		t.Fatalf("delta chunks = %q, want the step reply", got)
+	}
+}
+
+func TestResetSessionStartsAFreshCodexSession(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\n2) ship", "COMMAND: make", "SUCCESS: shipped"}}
+	svc := New(store.NewMemoryStore(), model, nil, WithRunner(&recordingRunner{}))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Release")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := svc.ApprovePlan(ctx, conv.SessionID); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	conv, err = svc.ResetSession(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("reset session: %v", err)
+	}
+	if conv.State != types.StateAwaitingCommand || conv.PlanText == "" || len(conv.Steps) != 2 {
+		t.Fatalf("reset should keep the plan and progress: %+v", conv)
+	}
+	calls := len(model.sessions)
+	model.sessionID = "sess-fresh"
+	conv, err = svc.ApproveCommand(ctx, conv.SessionID, "step-1")
+	if err != nil {
+		t.Fatalf("approve command: %v", err)
+	}
+	if len(model.sessions) != calls+1 || model.sessions[calls] != "" {
+		t.Fatalf("step after reset used sessions %q, want a fresh one", model.sessions[calls:])
+	}
+	if conv.CodexSessionID != "sess-fresh" {
+		t.Fatalf("codex session = %q, want the new session kept", conv.CodexSessionID)
+	}
+}
+
+func TestCallLogRecordsEveryModelCallWithItsPhase(t *testing.T) {
+	model := &scriptedModel{replies: []string{"1) build\n2) ship", "SUCCESS: built", "SUCCESS: shipped"}}
+	svc := New(store.NewMemoryStore(), model, nil)
+	var sink bytes.Buffer
+	svc.callLog = &sink
+	svc.promptStorage = "hash"
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Release")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	var phases []string
+	dec := json.NewDecoder(&sink)
+	for dec.More() {
+		var rec callRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode call log: %v", err)
+		}
+		if rec.ConversationID != conv.SessionID || rec.DurationMS != 10 || rec.Reply == "" {
+			t.Fatalf("incomplete record: %+v", rec)
+		}
+		if strings.HasPrefix(rec.Prompt, "sha256:") {
+			t.Fatalf("call log should keep the full prompt, got %q", rec.Prompt)
+		}
+		phases = append(phases, rec.Phase)
+	}
+	if got := strings.Join(phases, ","); got != "plan,step,step" || len(phases) != len(conv.ModelCalls) {
+		t.Fatalf("logged phases = %s for %d model calls", got, len(conv.ModelCalls))
+	}
+}
+
+// failingRunner fails every command.
+type failingRunner struct{}
+
+func (failingRunner) Run(ctx context.Context, command string) ([]byte, error) {
+	return []byte("no such file\n"), errors.New("exit status 1")
+}
+
+func TestDiscoveryChainStopsAtMaxDepth(t *testing.T) {
+	model := &scriptedModel{replies: []string{
+		"1) find the version",
+		"NEED: Which version file?",
+		"COMMAND: cat VERSION",
+		"NEED: Which version file?",
+		"COMMAND: cat version.txt",
+		"NEED: Which version file?",
+	}}
+	svc := New(store.NewMemoryStore(), model, nil, WithRunner(failingRunner{}), WithMaxDiscoveryDepth(2))
+	ctx := context.Background()
+
+	conv, err := svc.CreateConversation(ctx, "Report the version")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	conv, err = svc.ApprovePlan(ctx, conv.SessionID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	for _, want := range []string{"cat VERSION", "cat version.txt"} {
+		if conv.State != types.StateAwaitingCommand || conv.Steps[0].PendingCommand != want {
+			t.Fatalf("expected discovery command %q, got %s %+v", want, conv.State, conv.Steps[0])
+		}
+		if conv, err = svc.ApproveCommand(ctx, conv.SessionID, "step-1"); err != nil {
+			t.Fatalf("approve %q: %v", want, err)
+		}
+		if conv, err = svc.Resume(ctx, conv.SessionID); err != nil {
+			t.Fatalf("resume after %q: %v", want, err)
+		}
+	}
+	if conv.State != types.StateAwaitingInfo || conv.Steps[0].PendingInfo != "Which version file?" {
+		t.Fatalf("third NEED should go to a human, got %s %+v", conv.State, conv.Steps[0])
+	}
+	if len(model.prompts) != 6 {
+		t.Fatalf("model calls = %d, want no discovery call past the limit", len(model.prompts))
+	}
+}
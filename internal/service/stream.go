@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+
+	"trill/internal/codex"
+	"trill/internal/obs"
+	"trill/internal/types"
+)
+
+// sendStreaming is model.Send in session for a call made on conv's behalf.
+// When model can stream and events are being published, each chunk of output
+// is emitted as a transient "delta" event while the call runs, tagged with
+// step when there is one. Deltas reach live watchers but stay out of event
+// history.
+func (s *Service) sendStreaming(ctx context.Context, model codex.Client, conv *types.Conversation, step *types.Step, session, prompt string) (string, string, string, int64, error) {
+	ctx = withWorkDir(ctx, conv.Settings)
+	streamer, ok := model.(codex.StreamingClient)
+	if !ok || s.obs == nil {
+		return model.Send(ctx, session, prompt)
+	}
+	delta := obs.Event{
+		Type:      "delta",
+		SessionID: conv.SessionID,
+		Transient: true,
+	}
+	if step != nil {
+		delta.StepID = step.ID
+		delta.StepTitle = step.Title
+	}
+	return streamer.SendStream(ctx, session, prompt, func(chunk string) {
+		ev := delta
+		ev.Reply = chunk
+		s.emit(ev)
+	})
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"trill/internal/obs"
+	"trill/internal/types"
+)
+
+// RunSweeper calls Sweep every interval until ctx is done.
+func (s *Service) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.Sweep(ctx); err != nil {
+				s.logger().Error("sweep failed", "error", err)
+			} else if n > 0 {
+				s.logger().Info("sweep aborted stale conversations", "count", n)
+			}
+		}
+	}
+}
+
+// Sweep aborts conversations that have waited on a human longer than
+// WithMaxHumanWait, or on plan approval longer than WithPlanExpiry, and
+// returns how many it aborted. It is a no-op when both are zero. Human waits
+// are measured from when the conversation entered its state, or its latest
+// activity if that is newer; plan expiry from when the current plan version
+// was produced. Conversations a human is acting on are skipped
+// until the next sweep.
+func (s *Service) Sweep(ctx context.Context) (int, error) {
+	if s.maxHumanWait <= 0 && s.planExpiry <= 0 {
+		return 0, nil
+	}
+	ids, err := s.store.ListIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	aborted := 0
+	for _, id := range ids {
+		conv, err := s.store.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		if _, expired := s.expiry(conv); !expired {
+			continue
+		}
+		ok, err := s.sweepOne(ctx, id)
+		if err != nil {
+			return aborted, err
+		}
+		if ok {
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// sweepOne aborts sessionID if it is still overdue once re-read under its
+// action and send locks, so a concurrent approval or answer is never
+// overwritten. It reports false when the conversation is busy or no longer due.
+func (s *Service) sweepOne(ctx context.Context, sessionID string) (bool, error) {
+	unlockSends, ok := s.sends.TryLock(sessionID)
+	if !ok {
+		return false, nil
+	}
+	defer unlockSends()
+	unlockActions, ok := s.actions.TryLock(sessionID)
+	if !ok {
+		return false, nil
+	}
+	defer unlockActions()
+	conv, err := s.store.Get(ctx, sessionID)
+	if err != nil {
+		return false, nil
+	}
+	reason, expired := s.expiry(conv)
+	if !expired {
+		return false, nil
+	}
+	if err := s.abort(ctx, conv, reason); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// expiry reports whether conv has waited in its state past the limit the
+// sweeper applies to it, with the reason to abort it for.
+func (s *Service) expiry(conv *types.Conversation) (string, bool) {
+	var limit time.Duration
+	var reason string
+	switch conv.State {
+	case types.StateAwaitingInfo, types.StateAwaitingCommand, types.StateAwaitingStepApproval:
+		limit = s.maxHumanWait
+		reason = fmt.Sprintf("Timed out waiting for human after %s (%s)", s.maxHumanWait, conv.AwaitingReason)
+	case types.StateAwaitingPlanApproval:
+		limit = s.planExpiry
+		reason = fmt.Sprintf("Plan expired after %s without approval", s.planExpiry)
+	default:
+		return "", false
+	}
+	since := conv.LastActivityAt
+	if conv.EnteredState == conv.State && conv.StateEnteredAt.After(since) {
+		since = conv.StateEnteredAt
+	}
+	if conv.State == types.StateAwaitingPlanApproval && !conv.PlanCreatedAt.IsZero() {
+		// Only a new plan version restarts the clock; the plan is what goes stale.
+		since = conv.PlanCreatedAt
+	}
+	if limit <= 0 || since.IsZero() || !since.Before(s.clock().Add(-limit)) {
+		return "", false
+	}
+	return reason, true
+}
+
+// abort terminates conv, recording reason as its final message.
+func (s *Service) abort(ctx context.Context, conv *types.Conversation, reason string) error {
+	conv.State = types.StateAborted
+	conv.AwaitingReason = ""
+	conv.CompletedMessage = reason
+	conv.CompletedAt = s.clock()
+	if err := s.save(ctx, conv); err != nil {
+		return err
+	}
+	s.emit(obs.Event{
+		Type:      "abort",
+		SessionID: conv.SessionID,
+		Prompt:    conv.Prompt,
+		Note:      reason,
+	})
+	return nil
+}
+
+// abortedMeanwhile reports whether sessionID was aborted while it was being
+// worked on, returning the stored conversation so the caller can stop
+// without overwriting the abort.
+func (s *Service) abortedMeanwhile(ctx context.Context, sessionID string) (*types.Conversation, bool) {
+	stored, err := s.store.Get(ctx, sessionID)
+	if err != nil || stored.State != types.StateAborted {
+		return nil, false
+	}
+	return stored, true
+}
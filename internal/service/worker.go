@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"trill/internal/types"
+)
+
+// defaultWorkQueueSize bounds how many conversations may wait for the worker
+// to pick them up when WithWorkQueue's size is unset.
+const defaultWorkQueueSize = 64
+
+// ErrWorkQueueFull is returned when an approval finds the worker's queue full
+// for longer than WithWorkQueue's wait. The conversation is left as it was.
+var ErrWorkQueueFull = errors.New("work queue is full; try again shortly")
+
+// StartWorker starts a background worker that advances conversations handed
+// off by startExecution until ctx is done. While it runs, approvals and resumes
+// return as soon as execution is enqueued instead of blocking on it. The
+// returned func blocks until the worker has stopped and in-flight advancement,
+// including queued conversations promoted as slots free up, has finished.
+// Conversations still waiting in the work queue at shutdown are parked in
+// StateQueued for RequeueStranded to pick up at the next start.
+func (s *Service) StartWorker(ctx context.Context) (wait func()) {
+	work, slots, inflight, runCtx := s.openWorkQueue(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runWorker(ctx, runCtx, work, slots, inflight)
+	}()
+	return func() { <-done }
+}
+
+// openWorkQueue installs a work queue of WithWorkQueue's size for enqueue to
+// fill, and the WaitGroup and context that promotions run under until the
+// worker stops.
+func (s *Service) openWorkQueue(ctx context.Context) (chan string, chan struct{}, *sync.WaitGroup, context.Context) {
+	size := s.workQueueSize
+	if size <= 0 {
+		size = defaultWorkQueueSize
+	}
+	work := make(chan string, size)
+	slots := make(chan struct{}, size)
+	inflight := &sync.WaitGroup{}
+	// Advancement outlives the request that enqueued it, and shutdown lets
+	// in-flight steps finish rather than failing them halfway.
+	runCtx := context.WithoutCancel(ctx)
+	s.mu.Lock()
+	s.work = work
+	s.workSlots = slots
+	s.inflight = inflight
+	s.runCtx = runCtx
+	s.stopped = false
+	s.mu.Unlock()
+	return work, slots, inflight, runCtx
+}
+
+func (s *Service) runWorker(ctx, runCtx context.Context, work chan string, slots chan struct{}, inflight *sync.WaitGroup) {
+	defer func() {
+		s.mu.Lock()
+		s.work = nil
+		s.workSlots = nil
+		s.stopped = true
+		s.mu.Unlock()
+		s.drainWorkQueue(runCtx, work, slots)
+		inflight.Wait()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sessionID := <-work:
+			<-slots
+			if !s.acquireSlot(sessionID) {
+				s.markQueued(runCtx, sessionID)
+				continue
+			}
+			s.mu.Lock()
+			s.dispatchLocked(sessionID)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// drainWorkQueue parks conversations the stopped worker never picked up in
+// StateQueued, since nothing in this process will run them now.
+func (s *Service) drainWorkQueue(ctx context.Context, work chan string, slots chan struct{}) {
+	for {
+		select {
+		case sessionID := <-work:
+			<-slots
+			s.markQueued(ctx, sessionID)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue marks conv executing and hands it to the worker. It reports false
+// without touching conv when no worker is running, and fails with
+// ErrWorkQueueFull, again without touching conv, when the queue stays full
+// for WithWorkQueue's wait.
+func (s *Service) enqueue(ctx context.Context, conv *types.Conversation) (bool, error) {
+	s.mu.Lock()
+	work, slots := s.work, s.workSlots
+	s.mu.Unlock()
+	if work == nil {
+		return false, nil
+	}
+	if err := s.reserveWorkSlot(ctx, slots); err != nil {
+		return true, err
+	}
+	conv.State = types.StateExecuting
+	conv.AwaitingReason = ""
+	if err := s.save(ctx, conv); err != nil {
+		<-slots
+		return true, err
+	}
+	// The reserved slot guarantees room, so this never blocks.
+	work <- conv.SessionID
+	return true, nil
+}
+
+// reserveWorkSlot takes a queue slot, waiting up to WithWorkQueue's wait for one.
+func (s *Service) reserveWorkSlot(ctx context.Context, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if s.enqueueWait <= 0 {
+		return ErrWorkQueueFull
+	}
+	timer := time.NewTimer(s.enqueueWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrWorkQueueFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"trill/internal/types"
+)
+
+var conversationsBucket = []byte("conversations")
+
+// BoltStore persists conversations as JSON values in an embedded bbolt file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating if needed) the database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open bolt store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(conversationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create bolt bucket: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close releases the database file lock.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) Save(ctx context.Context, conv *types.Conversation) error {
+	if conv == nil || conv.SessionID == "" {
+		return fmt.Errorf("conversation missing session id: %w", ErrInvalid)
+	}
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return fmt.Errorf("encode conversation %s: %w: %w", conv.SessionID, ErrInvalid, err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).Put([]byte(conv.SessionID), data)
+	})
+}
+
+func (b *BoltStore) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	var conv types.Conversation
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(conversationsBucket).Get([]byte(sessionID))
+		if data == nil {
+			return fmt.Errorf("conversation %s %w", sessionID, ErrNotFound)
+		}
+		if err := json.Unmarshal(data, &conv); err != nil {
+			return fmt.Errorf("decode conversation %s: %w", sessionID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func (b *BoltStore) ListIDs(ctx context.Context) ([]string, error) {
+	ids := make([]string, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// ListStates decodes only the state field of each stored conversation.
+func (b *BoltStore) ListStates(ctx context.Context) (map[string]types.ConversationState, error) {
+	states := make(map[string]types.ConversationState)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).ForEach(func(k, data []byte) error {
+			var head struct {
+				State types.ConversationState `json:"state"`
+			}
+			if err := json.Unmarshal(data, &head); err != nil {
+				return fmt.Errorf("decode conversation %s: %w", k, err)
+			}
+			states[string(k)] = head.State
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (b *BoltStore) Delete(ctx context.Context, sessionID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).Delete([]byte(sessionID))
+	})
+}
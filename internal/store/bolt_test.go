@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"trill/internal/types"
+)
+
+func TestBoltStoreMatchesMemoryStoreBehavior(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trill.bolt")
+	st, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := st.Save(ctx, &types.Conversation{}); err == nil {
+		t.Fatal("expected error saving a conversation without a session id")
+	}
+	if _, err := st.Get(ctx, "missing"); err == nil {
+		t.Fatal("expected not found for unknown session")
+	}
+	conv := &types.Conversation{
+		SessionID: "sess-1",
+		Prompt:    "Ship it",
+		State:     types.StateAwaitingCommand,
+		Steps:     []types.Step{{ID: "step-1", Title: "1) build", Logs: []string{"ok"}}},
+	}
+	for _, c := range []*types.Conversation{conv, {SessionID: "sess-2"}} {
+		if err := st.Save(ctx, c); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	got, err := st.Get(ctx, "sess-1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got.Steps[0].Logs[0] = "mutated"
+	again, _ := st.Get(ctx, "sess-1")
+	if again.Steps[0].Logs[0] != "ok" {
+		t.Fatal("mutating a returned conversation changed the stored copy")
+	}
+	if err := st.Delete(ctx, "sess-2"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	st.Close()
+
+	reopened, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	ids, err := reopened.ListIDs(ctx)
+	if err != nil || len(ids) != 1 || ids[0] != "sess-1" {
+		t.Fatalf("ids after reopen = %v, err %v", ids, err)
+	}
+	got, err = reopened.Get(ctx, "sess-1")
+	if err != nil || got.Prompt != "Ship it" || got.Steps[0].Title != "1) build" {
+		t.Fatalf("conversation not persisted: %+v, err %v", got, err)
+	}
+	states, err := reopened.ListStates(ctx)
+	if err != nil || len(states) != 1 || states["sess-1"] != types.StateAwaitingCommand {
+		t.Fatalf("states = %v, err %v", states, err)
+	}
+}
@@ -20,7 +20,7 @@ func NewMemoryStore() *MemoryStore {
 
 func (m *MemoryStore) Save(ctx context.Context, conv *types.Conversation) error {
 	if conv == nil || conv.SessionID == "" {
-		return fmt.Errorf("conversation missing session id")
+		return fmt.Errorf("conversation missing session id: %w", ErrInvalid)
 	}
 	m.mu.Lock()
 	m.convs[conv.SessionID] = cloneConversation(conv)
@@ -33,7 +33,7 @@ func (m *MemoryStore) Get(ctx context.Context, sessionID string) (*types.Convers
 	defer m.mu.RUnlock()
 	conv, ok := m.convs[sessionID]
 	if !ok {
-		return nil, fmt.Errorf("conversation %s not found", sessionID)
+		return nil, fmt.Errorf("conversation %s %w", sessionID, ErrNotFound)
 	}
 	return cloneConversation(conv), nil
 }
@@ -48,6 +48,16 @@ func (m *MemoryStore) ListIDs(ctx context.Context) ([]string, error) {
 	return ids, nil
 }
 
+func (m *MemoryStore) ListStates(ctx context.Context) (map[string]types.ConversationState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	states := make(map[string]types.ConversationState, len(m.convs))
+	for id, conv := range m.convs {
+		states[id] = conv.State
+	}
+	return states, nil
+}
+
 func (m *MemoryStore) Delete(ctx context.Context, sessionID string) error {
 	m.mu.Lock()
 	delete(m.convs, sessionID)
@@ -59,33 +69,33 @@ func cloneConversation(c *types.Conversation) *types.Conversation {
 	if c == nil {
 		return nil
 	}
-	msgs := make([]types.Message, len(c.Messages))
-	copy(msgs, c.Messages)
-	calls := make([]types.ModelCall, len(c.ModelCalls))
-	copy(calls, c.ModelCalls)
-	steps := make([]types.Step, len(c.Steps))
-	copy(steps, c.Steps)
-	for i := range steps {
-		if len(steps[i].Logs) > 0 {
-			logs := make([]string, len(steps[i].Logs))
-			copy(logs, steps[i].Logs)
-			steps[i].Logs = logs
+	cp := *c
+	cp.AcceptanceCriteria = append([]string(nil), c.AcceptanceCriteria...)
+	cp.Messages = make([]types.Message, len(c.Messages))
+	copy(cp.Messages, c.Messages)
+	cp.ModelCalls = make([]types.ModelCall, len(c.ModelCalls))
+	copy(cp.ModelCalls, c.ModelCalls)
+	cp.Steps = make([]types.Step, len(c.Steps))
+	copy(cp.Steps, c.Steps)
+	for i := range cp.Steps {
+		if len(cp.Steps[i].Logs) > 0 {
+			logs := make([]string, len(cp.Steps[i].Logs))
+			copy(logs, cp.Steps[i].Logs)
+			cp.Steps[i].Logs = logs
+		}
+		if p := cp.Steps[i].CommandProvenance; p != nil {
+			prov := *p
+			cp.Steps[i].CommandProvenance = &prov
 		}
 	}
-	artifacts := make([]types.Artifact, len(c.Artifacts))
-	copy(artifacts, c.Artifacts)
-	return &types.Conversation{
-		SessionID:        c.SessionID,
-		Prompt:           c.Prompt,
-		State:            c.State,
-		PlanVersion:      c.PlanVersion,
-		PlanText:         c.PlanText,
-		AwaitingReason:   c.AwaitingReason,
-		Steps:            steps,
-		Messages:         msgs,
-		ModelCalls:       calls,
-		Artifacts:        artifacts,
-		CompletedMessage: c.CompletedMessage,
-		CompletedAt:      c.CompletedAt,
+	cp.Artifacts = make([]types.Artifact, len(c.Artifacts))
+	copy(cp.Artifacts, c.Artifacts)
+	cp.Transitions = append([]types.StateTransition(nil), c.Transitions...)
+	cp.MetCriteria = append([]string(nil), c.MetCriteria...)
+	cp.PriorAttempts = append([]string(nil), c.PriorAttempts...)
+	if b := c.Settings.StepArtifacts; b != nil {
+		v := *b
+		cp.Settings.StepArtifacts = &v
 	}
+	return &cp
 }
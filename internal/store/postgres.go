@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"trill/internal/types"
+)
+
+// PostgresStore persists conversations as jsonb rows in a shared Postgres
+// database, so several trill instances can read the same conversations.
+//
+// Only storage is shared. Send serialization, the execution queue and its
+// MaxExecuting cap, and the plan cache stay per process, and Save is
+// last-writer-wins, so two instances acting on one conversation at once can
+// overwrite each other. Route each conversation to one instance (e.g. sticky
+// by session ID) when running several.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to the database at dsn (a postgres:// URL or
+// key=value string) and ensures the schema exists.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres store: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	const schema = `CREATE TABLE IF NOT EXISTS conversations (
+		session_id TEXT PRIMARY KEY,
+		data       JSONB NOT NULL
+	)`
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create postgres schema: %w", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// ConfigurePool bounds the connection pool: at most maxOpen connections
+// (zero leaves it unlimited), all of which may stay idle, each reused for at
+// most maxLifetime (zero keeps them forever). With no bound the idle pool
+// keeps database/sql's default size.
+func (s *PostgresStore) ConfigurePool(maxOpen int, maxLifetime time.Duration) {
+	s.db.SetMaxOpenConns(maxOpen)
+	if maxOpen > 0 {
+		s.db.SetMaxIdleConns(maxOpen)
+	}
+	s.db.SetConnMaxLifetime(maxLifetime)
+}
+
+// Close releases the underlying connection pool.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStore) Save(ctx context.Context, conv *types.Conversation) error {
+	if conv == nil || conv.SessionID == "" {
+		return fmt.Errorf("conversation missing session id: %w", ErrInvalid)
+	}
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return fmt.Errorf("encode conversation %s: %w: %w", conv.SessionID, ErrInvalid, err)
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO conversations (session_id, data) VALUES ($1, $2)
+		 ON CONFLICT (session_id) DO UPDATE SET data = excluded.data`,
+		conv.SessionID, string(data))
+	return err
+}
+
+func (s *PostgresStore) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM conversations WHERE session_id = $1`, sessionID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("conversation %s %w", sessionID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conv types.Conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return nil, fmt.Errorf("decode conversation %s: %w", sessionID, err)
+	}
+	return &conv, nil
+}
+
+func (s *PostgresStore) ListIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT session_id FROM conversations ORDER BY session_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ListStates reads each conversation's state inside the database, so no row
+// is decoded in full.
+func (s *PostgresStore) ListStates(ctx context.Context) (map[string]types.ConversationState, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT session_id, COALESCE(data->>'state', '') FROM conversations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := make(map[string]types.ConversationState)
+	for rows.Next() {
+		var id, state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, err
+		}
+		states[id] = types.ConversationState(state)
+	}
+	return states, rows.Err()
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE session_id = $1`, sessionID)
+	return err
+}
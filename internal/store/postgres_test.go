@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"trill/internal/types"
+)
+
+// TestPostgresStoreRoundTrips runs against a real database named by
+// TRILL_TEST_POSTGRES_DSN and is skipped without one.
+func TestPostgresStoreRoundTrips(t *testing.T) {
+	dsn := os.Getenv("TRILL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TRILL_TEST_POSTGRES_DSN not set")
+	}
+	st, err := NewPostgresStore(dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer st.Close()
+	st.ConfigurePool(4, time.Minute)
+	ctx := context.Background()
+	id := "sess-pg-" + time.Now().Format("150405.000000000")
+	defer st.Delete(ctx, id)
+
+	conv := &types.Conversation{
+		SessionID:          id,
+		Prompt:             "Ship it",
+		State:              types.StateAwaitingPlanApproval,
+		AcceptanceCriteria: []string{"tests pass"},
+		Steps:              []types.Step{{ID: "step-1", Title: "1) build", Logs: []string{"ok"}}},
+	}
+	if err := st.Save(ctx, conv); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	conv.Prompt = "Ship it twice"
+	if err := st.Save(ctx, conv); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	got, err := st.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Prompt != "Ship it twice" || got.Steps[0].Logs[0] != "ok" || got.AcceptanceCriteria[0] != "tests pass" {
+		t.Fatalf("conversation not round-tripped: %+v", got)
+	}
+	ids, err := st.ListIDs(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	found := false
+	for _, got := range ids {
+		found = found || got == id
+	}
+	if !found {
+		t.Fatalf("ids %v missing %s", ids, id)
+	}
+	states, err := st.ListStates(ctx)
+	if err != nil || states[id] != types.StateAwaitingPlanApproval {
+		t.Fatalf("states = %v, err %v; want %s awaiting plan approval", states, err, id)
+	}
+	if err := st.Delete(ctx, id); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := st.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"trill/internal/types"
+)
+
+// SQLiteStore persists conversations as JSON rows in a single SQLite file.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (creating if needed) the database at path and ensures the schema exists.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite store: %w", err)
+	}
+	// One connection serializes writers, so concurrent Saves never see SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	const schema = `CREATE TABLE IF NOT EXISTS conversations (
+		session_id TEXT PRIMARY KEY,
+		data       TEXT NOT NULL
+	)`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create sqlite schema: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close releases the underlying database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Save(ctx context.Context, conv *types.Conversation) error {
+	if conv == nil || conv.SessionID == "" {
+		return fmt.Errorf("conversation missing session id: %w", ErrInvalid)
+	}
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return fmt.Errorf("encode conversation %s: %w: %w", conv.SessionID, ErrInvalid, err)
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO conversations (session_id, data) VALUES (?, ?)
+		 ON CONFLICT(session_id) DO UPDATE SET data = excluded.data`,
+		conv.SessionID, string(data))
+	return err
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, sessionID string) (*types.Conversation, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM conversations WHERE session_id = ?`, sessionID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("conversation %s %w", sessionID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conv types.Conversation
+	if err := json.Unmarshal([]byte(data), &conv); err != nil {
+		return nil, fmt.Errorf("decode conversation %s: %w", sessionID, err)
+	}
+	return &conv, nil
+}
+
+func (s *SQLiteStore) ListIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT session_id FROM conversations ORDER BY session_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ListStates reads each conversation's state inside the database, so no row
+// is decoded in full.
+func (s *SQLiteStore) ListStates(ctx context.Context) (map[string]types.ConversationState, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT session_id, COALESCE(json_extract(data, '$.state'), '') FROM conversations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := make(map[string]types.ConversationState)
+	for rows.Next() {
+		var id, state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, err
+		}
+		states[id] = types.ConversationState(state)
+	}
+	return states, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE session_id = ?`, sessionID)
+	return err
+}
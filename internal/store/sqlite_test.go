@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"trill/internal/types"
+)
+
+func TestSQLiteStoreRoundTripsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trill.db")
+	st, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := context.Background()
+	conv := &types.Conversation{
+		SessionID:          "sess-1",
+		Prompt:             "Ship it",
+		State:              types.StateExecuting,
+		AcceptanceCriteria: []string{"tests pass"},
+		Steps:              []types.Step{{ID: "step-1", Title: "1) build", Logs: []string{"ok"}}},
+		Messages:           []types.Message{{Role: "user", Content: "hi"}},
+		ModelCalls:         []types.ModelCall{{Prompt: "p", Reply: "r"}},
+		Artifacts:          []types.Artifact{{ID: "artifact-1", Content: "out"}},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := st.Save(ctx, conv); err != nil {
+				t.Errorf("save: %v", err)
+			}
+			if _, err := st.Get(ctx, "sess-1"); err != nil {
+				t.Errorf("get: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	st.Close()
+
+	reopened, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	got, err := reopened.Get(ctx, "sess-1")
+	if err != nil {
+		t.Fatalf("get after reopen: %v", err)
+	}
+	if got.Prompt != "Ship it" || got.Steps[0].Logs[0] != "ok" || got.AcceptanceCriteria[0] != "tests pass" ||
+		got.Messages[0].Content != "hi" || got.ModelCalls[0].Reply != "r" || got.Artifacts[0].Content != "out" {
+		t.Fatalf("conversation not round-tripped: %+v", got)
+	}
+	ids, err := reopened.ListIDs(ctx)
+	if err != nil || len(ids) != 1 || ids[0] != "sess-1" {
+		t.Fatalf("ids = %v, err %v", ids, err)
+	}
+	states, err := reopened.ListStates(ctx)
+	if err != nil || len(states) != 1 || states["sess-1"] != types.StateExecuting {
+		t.Fatalf("states = %v, err %v", states, err)
+	}
+	if err := reopened.Delete(ctx, "sess-1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := reopened.Get(ctx, "sess-1"); err == nil {
+		t.Fatal("expected not found after delete")
+	}
+}
@@ -2,10 +2,18 @@ package store
 
 import (
 	"context"
+	"errors"
 
 	"trill/internal/types"
 )
 
+// ErrNotFound is wrapped by Get when no conversation has the requested session ID.
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalid is wrapped by Save when the conversation itself cannot be
+// stored, e.g. it has no session ID; retrying the same save cannot succeed.
+var ErrInvalid = errors.New("invalid conversation")
+
 // ConversationStore persists conversations keyed by session ID.
 type ConversationStore interface {
 	Save(ctx context.Context, conv *types.Conversation) error
@@ -13,3 +21,10 @@ type ConversationStore interface {
 	ListIDs(ctx context.Context) ([]string, error)
 	Delete(ctx context.Context, sessionID string) error
 }
+
+// StateLister is implemented by stores that can report every conversation's
+// state without decoding whole conversations, for callers such as inbox
+// counts that only need states.
+type StateLister interface {
+	ListStates(ctx context.Context) (map[string]types.ConversationState, error)
+}
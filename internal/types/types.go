@@ -13,6 +13,7 @@ type ConversationState string
 const (
 	StatePlanning             ConversationState = "planning"
 	StateAwaitingPlanApproval ConversationState = "awaiting_plan_approval"
+	StateQueued               ConversationState = "queued"
 	StateExecuting            ConversationState = "executing"
 	StateBlocked              ConversationState = "blocked"
 	StateAwaitingCommand      ConversationState = "awaiting_command"
@@ -20,10 +21,22 @@ const (
 	StateAwaitingStepApproval ConversationState = "awaiting_step_approval"
 	StateVerifying            ConversationState = "verifying"
 	StateReplanning           ConversationState = "replanning"
+	StateAwaitingCompletion   ConversationState = "awaiting_completion"
 	StateCompleted            ConversationState = "completed"
 	StateAborted              ConversationState = "aborted"
 )
 
+// Valid reports whether s is one of the known conversation states.
+func (s ConversationState) Valid() bool {
+	switch s {
+	case StatePlanning, StateAwaitingPlanApproval, StateQueued, StateExecuting, StateBlocked,
+		StateAwaitingCommand, StateAwaitingInfo, StateAwaitingStepApproval, StateVerifying,
+		StateReplanning, StateAwaitingCompletion, StateCompleted, StateAborted:
+		return true
+	}
+	return false
+}
+
 type StepStatus string
 
 const (
@@ -35,16 +48,27 @@ const (
 )
 
 type Step struct {
-	ID                string     `json:"id"`
-	Title             string     `json:"title"`
-	Status            StepStatus `json:"status"`
-	RequiresApproval  bool       `json:"requires_approval"`
-	PendingCommand    string     `json:"pending_command"`
-	PendingInfo       string     `json:"pending_info"`
-	PendingDependency string     `json:"pending_dependency"`
-	Logs              []string   `json:"logs"`
-	StartedAt         time.Time  `json:"started_at"`
-	CompletedAt       time.Time  `json:"completed_at"`
+	ID                string             `json:"id"`
+	Title             string             `json:"title"`
+	Status            StepStatus         `json:"status"`
+	RequiresApproval  bool               `json:"requires_approval"`
+	PendingCommand    string             `json:"pending_command"`
+	CommandProvenance *CommandProvenance `json:"command_provenance,omitempty"`
+	PendingInfo       string             `json:"pending_info"`
+	PendingDependency string             `json:"pending_dependency"`
+	Result            string             `json:"result,omitempty"`             // text after "SUCCESS:" once done
+	TimeoutSeconds    int                `json:"timeout_seconds,omitempty"`    // execution budget; 0 uses the global limits
+	DiscoveryCommands int                `json:"discovery_commands,omitempty"` // discovery commands proposed for the step since it was last answered, edited, or restarted
+	Logs              []string           `json:"logs"`
+	StartedAt         time.Time          `json:"started_at"`
+	CompletedAt       time.Time          `json:"completed_at"`
+}
+
+// CommandProvenance records the NEED/DEPENDENCY a discovery command was proposed to satisfy.
+type CommandProvenance struct {
+	Need           string `json:"need"`
+	Kind           string `json:"kind"`
+	ModelCallIndex int    `json:"model_call_index"`
 }
 
 // ModelCall captures one Codex invocation.
@@ -55,8 +79,25 @@ type ModelCall struct {
 	Timestamp  time.Time `json:"timestamp"`
 	DurationMS int64     `json:"duration_ms"`
 	SessionID  string    `json:"session_id"`
+	// Phase says what the call was for, one of the CallPhase constants.
+	Phase string `json:"phase,omitempty"`
+	// Token counts as reported by the model; zero when it reports none.
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens,omitempty"`
 }
 
+// Model call phases for ModelCall.Phase.
+const (
+	CallPhasePlan      = "plan"
+	CallPhaseReplan    = "replan"
+	CallPhaseChat      = "chat"
+	CallPhaseStep      = "step"
+	CallPhaseDiscovery = "discovery"
+	CallPhaseVerify    = "verify"
+	CallPhaseResolve   = "resolve"
+)
+
 // Artifact represents cached context or command output that can be reused later.
 type Artifact struct {
 	ID          string    `json:"id"`
@@ -67,34 +108,173 @@ type Artifact struct {
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// ArtifactRef is an artifact listed alongside the conversation that owns it.
+type ArtifactRef struct {
+	SessionID string `json:"session_id"`
+	Artifact
+}
+
+// Question is an outstanding NEED or DEPENDENCY request from a step awaiting info.
+type Question struct {
+	SessionID string `json:"session_id"`
+	Prompt    string `json:"prompt"`
+	StepID    string `json:"step_id"`
+	StepTitle string `json:"step_title"`
+	// Kind is "info" for PendingInfo or "dependency" for PendingDependency.
+	Kind     string `json:"kind"`
+	Question string `json:"question"`
+}
+
+// ListPage is one page of conversation ids. NextOffset is the offset of the
+// following page, or zero when this page is the last.
+type ListPage struct {
+	IDs        []string `json:"ids"`
+	Total      int      `json:"total"`
+	NextOffset int      `json:"next_offset"`
+}
+
+// ConversationStatus is the small subset of a conversation that pollers
+// watch for changes.
+type ConversationStatus struct {
+	State          ConversationState `json:"state"`
+	AwaitingReason string            `json:"awaiting_reason"`
+	PlanVersion    int               `json:"plan_version"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	PendingCommand string            `json:"pending_command,omitempty"`
+}
+
+// BulkCreateItem is one goal in a bulk create request. Label is echoed back
+// in its result so callers can match them up.
+type BulkCreateItem struct {
+	Prompt      string               `json:"prompt"`
+	Label       string               `json:"label,omitempty"`
+	AutoApprove bool                 `json:"auto_approve,omitempty"`
+	Settings    ConversationSettings `json:"settings"`
+}
+
+// BulkCreateResult reports what became of one BulkCreateItem: the created
+// conversation, an error, or both when only auto-approval failed.
+type BulkCreateResult struct {
+	Label     string            `json:"label,omitempty"`
+	SessionID string            `json:"session_id,omitempty"`
+	State     ConversationState `json:"state,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// StateTransition is an audit record of a manual state change.
+type StateTransition struct {
+	From   ConversationState `json:"from"`
+	To     ConversationState `json:"to"`
+	Reason string            `json:"reason"`
+	Actor  string            `json:"actor"`
+	At     time.Time         `json:"at"`
+}
+
 // Conversation stores the persisted chat context for a Codex session.
 type Conversation struct {
-	SessionID          string            `json:"session_id"`
-	Prompt             string            `json:"prompt"`
-	State              ConversationState `json:"state"`
-	PlanVersion        int               `json:"plan_version"`
-	PlanText           string            `json:"plan_text"`
-	AcceptanceCriteria []string          `json:"acceptance_criteria"`
-	AwaitingReason     string            `json:"awaiting_reason"`
-	Steps              []Step            `json:"steps"`
-	Messages           []Message         `json:"messages"`
-	ModelCalls         []ModelCall       `json:"model_calls"`
-	Artifacts          []Artifact        `json:"artifacts"`
-	CompletedMessage   string            `json:"completed_message"`
-	CompletedAt        time.Time         `json:"completed_at"`
+	// SessionID is the conversation's stable ID: the Codex session it was
+	// planned in. CodexSessionID is the session model calls continue, which
+	// can move on if Codex hands back a different one.
+	SessionID      string `json:"session_id"`
+	CodexSessionID string `json:"codex_session_id,omitempty"`
+	// VerifySessionID is the session a separately configured verify model
+	// continues, so verification never moves CodexSessionID.
+	VerifySessionID string            `json:"verify_session_id,omitempty"`
+	Prompt          string            `json:"prompt"`
+	State           ConversationState `json:"state"`
+	PlanVersion     int               `json:"plan_version"`
+	// PlanCreatedAt is when the current PlanVersion was produced.
+	PlanCreatedAt      time.Time   `json:"plan_created_at"`
+	PlanText           string      `json:"plan_text"`
+	AcceptanceCriteria []string    `json:"acceptance_criteria"`
+	AwaitingReason     string      `json:"awaiting_reason"`
+	Steps              []Step      `json:"steps"`
+	Messages           []Message   `json:"messages"`
+	ModelCalls         []ModelCall `json:"model_calls"`
+	Artifacts          []Artifact  `json:"artifacts"`
+	CompletedMessage   string      `json:"completed_message"`
+	CompletedAt        time.Time   `json:"completed_at"`
+	LastActivityAt     time.Time   `json:"last_activity_at"`
+	// UpdatedAt is when the conversation was last saved, whatever changed.
+	UpdatedAt time.Time `json:"updated_at"`
+	// StateEnteredAt is when the conversation entered EnteredState, which
+	// saving keeps in step with State.
+	StateEnteredAt time.Time         `json:"state_entered_at"`
+	EnteredState   ConversationState `json:"entered_state,omitempty"`
+	Transitions    []StateTransition `json:"transitions,omitempty"`
+	// MetCriteria holds criteria an acceptance verification has confirmed,
+	// kept across replans so rephrased criteria are recognized.
+	MetCriteria []string             `json:"met_criteria,omitempty"`
+	Settings    ConversationSettings `json:"settings"`
+	// ModelCallBudget, once raised on resume, replaces the global cap on
+	// model calls for this conversation.
+	ModelCallBudget int `json:"model_call_budget,omitempty"`
+	// TotalTokens sums TotalTokens across ModelCalls.
+	TotalTokens int `json:"total_tokens,omitempty"`
+	// VerifyFailures counts failed acceptance verifications in this attempt.
+	VerifyFailures int `json:"verify_failures,omitempty"`
+	// Attempt numbers fresh restarts of the same prompt from 1. PriorAttempts
+	// lists the earlier attempts' session ids, oldest first, and RestartedAs
+	// links a given-up attempt to the one that replaced it.
+	Attempt       int      `json:"attempt,omitempty"`
+	PriorAttempts []string `json:"prior_attempts,omitempty"`
+	RestartedAs   string   `json:"restarted_as,omitempty"`
+	// Priority orders the inbox, higher first; it defaults to zero and may be
+	// negative to push a conversation down.
+	Priority int `json:"priority,omitempty"`
+	// PlanCached marks a conversation whose first plan came from the plan
+	// cache. It has no Codex session until its first execution call starts one.
+	PlanCached bool `json:"plan_cached,omitempty"`
+	// SessionReset marks a conversation whose Codex session was cleared on
+	// request. Like PlanCached, its next model call starts a fresh session.
+	SessionReset bool `json:"session_reset,omitempty"`
+}
+
+// Log verbosity levels for ConversationSettings.LogVerbosity.
+const (
+	LogVerbosityLow    = "low"
+	LogVerbosityNormal = "normal"
+	LogVerbosityFull   = "full"
+)
+
+// Command artifact modes for ConversationSettings.CommandArtifacts.
+const (
+	CommandArtifactsAlways        = "always"
+	CommandArtifactsOnlyOnFailure = "only-on-failure"
+	CommandArtifactsNever         = "never"
+)
+
+// ConversationSettings are per-conversation options chosen at create time.
+type ConversationSettings struct {
+	// LogVerbosity is "low" (raw model output is not kept), "normal" (the
+	// default: step logs hold replies, model calls hold raw output), or
+	// "full" (step logs hold raw output too).
+	LogVerbosity string `json:"log_verbosity,omitempty"`
+	// StepArtifacts, when set, overrides whether successful step results are
+	// saved as artifacts.
+	StepArtifacts *bool `json:"step_artifacts,omitempty"`
+	// CommandArtifacts, when set, overrides which approved command outputs
+	// are saved as artifacts: "always", "only-on-failure", or "never".
+	CommandArtifacts string `json:"command_artifacts,omitempty"`
+	// WorkDir, when set, is where Codex and approved commands run for this
+	// conversation instead of the server's WORK_DIR.
+	WorkDir string `json:"work_dir,omitempty"`
 }
 
 // InboxItem summarizes items needing attention.
 type InboxItem struct {
-	SessionID         string            `json:"session_id"`
-	Prompt            string            `json:"prompt"`
-	State             ConversationState `json:"state"`
-	AwaitingReason    string            `json:"awaiting_reason"`
-	StepID            string            `json:"step_id,omitempty"`
-	StepTitle         string            `json:"step_title,omitempty"`
-	PendingCommand    string            `json:"pending_command,omitempty"`
-	PendingInfo       string            `json:"pending_info,omitempty"`
-	PendingDependency string            `json:"pending_dependency,omitempty"`
-	CompletedMessage  string            `json:"completed_message,omitempty"`
-	CompletedAt       time.Time         `json:"completed_at,omitempty"`
+	SessionID         string             `json:"session_id"`
+	Prompt            string             `json:"prompt"`
+	State             ConversationState  `json:"state"`
+	AwaitingReason    string             `json:"awaiting_reason"`
+	StepID            string             `json:"step_id,omitempty"`
+	StepTitle         string             `json:"step_title,omitempty"`
+	PendingCommand    string             `json:"pending_command,omitempty"`
+	CommandProvenance *CommandProvenance `json:"command_provenance,omitempty"`
+	PendingInfo       string             `json:"pending_info,omitempty"`
+	PendingDependency string             `json:"pending_dependency,omitempty"`
+	CompletedMessage  string             `json:"completed_message,omitempty"`
+	CompletedAt       time.Time          `json:"completed_at,omitempty"`
+	Priority          int                `json:"priority,omitempty"`
+	LastActivityAt    time.Time          `json:"last_activity_at,omitempty"`
 }